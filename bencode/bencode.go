@@ -0,0 +1,106 @@
+package bencode
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//bencode编解码，解码时要求输入为规范编码：整数以及长度没有多余的前导零，字典的键按字节序严格递增
+//结构体字段使用 `bencode:"name,omitempty"` 标签，"-" 表示忽略该字段
+
+// RawMessage 未经解码的bencode值，解码时保存原始编码，编码时原样写出
+// 例如用于由原始的info字典计算infohash
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// SyntaxError 输入不是合法的规范bencode
+type SyntaxError struct {
+	Offset int64 //出错位置的字节偏移
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at offset %d", e.msg, e.Offset)
+}
+
+// UnmarshalTypeError bencode值无法存入目标类型
+type UnmarshalTypeError struct {
+	Value  string //bencode值的类型：integer、string、list 或 dictionary
+	Type   reflect.Type
+	Offset int64
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("Cannot unmarshal %s into %s at offset %d", e.Value, e.Type, e.Offset)
+}
+
+// UnknownFieldError 调用 DisallowUnknownFields 后，字典中出现了结构体没有的键
+type UnknownFieldError struct {
+	Key    string
+	Type   reflect.Type
+	Offset int64
+}
+
+func (e *UnknownFieldError) Error() string {
+	return fmt.Sprintf("Unknown field %q for %s at offset %d", e.Key, e.Type, e.Offset)
+}
+
+// UnsupportedTypeError 无法编码的类型
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("Cannot marshal %s", e.Type)
+}
+
+//结构体中参与编解码的字段
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map //reflect.Type -> []field
+
+//按照键排序的结构体字段
+func fieldsOf(t reflect.Type) []field {
+	if cached, ok := fieldCache.Load(t); ok {
+		return cached.([]field)
+	}
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if comma := strings.IndexByte(tag, ','); comma >= 0 {
+			name, opts = tag[:comma], tag[comma+1:]
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, field{name: name, index: i, omitEmpty: opts == "omitempty"})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].name < fields[j].name })
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+//由键查找字段
+func lookupField(fields []field, key string) (field, bool) {
+	i := sort.Search(len(fields), func(i int) bool { return fields[i].name >= key })
+	if i < len(fields) && fields[i].name == key {
+		return fields[i], true
+	}
+	return field{}, false
+}
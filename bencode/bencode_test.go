@@ -0,0 +1,192 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDecodeInt(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"i0e", 0, true},
+		{"i42e", 42, true},
+		{"i-42e", -42, true},
+		{"i9223372036854775807e", 9223372036854775807, true},
+		{"i-9223372036854775808e", -9223372036854775808, true},
+		{"i01e", 0, false},
+		{"i00e", 0, false},
+		{"i-0e", 0, false},
+		{"i-01e", 0, false},
+		{"i+1e", 0, false},
+		{"ie", 0, false},
+		{"i-e", 0, false},
+		{"i1.5e", 0, false},
+		{"i9223372036854775808e", 0, false},
+		{"i1", 0, false},
+	}
+	for _, tt := range tests {
+		var got int64
+		err := Unmarshal([]byte(tt.in), &got)
+		if tt.ok && (err != nil || got != tt.want) {
+			t.Errorf("Unmarshal(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("Unmarshal(%q) = %d, want error", tt.in, got)
+		}
+	}
+}
+
+func TestDecodeString(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"0:", "", true},
+		{"3:abc", "abc", true},
+		{"10:0123456789", "0123456789", true},
+		{"03:abc", "", false},
+		{"00:", "", false},
+		{"-1:a", "", false},
+		{"+3:abc", "", false},
+		{":abc", "", false},
+		{"5:abc", "", false},
+		{"3abc", "", false},
+	}
+	for _, tt := range tests {
+		var got string
+		err := Unmarshal([]byte(tt.in), &got)
+		if tt.ok && (err != nil || got != tt.want) {
+			t.Errorf("Unmarshal(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("Unmarshal(%q) = %q, want error", tt.in, got)
+		}
+	}
+}
+
+func TestDecodeKeyOrder(t *testing.T) {
+	tests := []struct {
+		in       string
+		strict   bool //默认的Decoder是否接受
+		unsorted bool //AllowUnsortedKeys 之后是否接受
+	}{
+		{"de", true, true},
+		{"d1:a0:1:b0:e", true, true},
+		{"d1:b0:1:a0:e", false, true},
+		{"d1:a0:1:a0:e", false, false},
+		{"d1:b0:1:a0:1:b0:e", false, false},
+		{"d2:ab0:1:b0:e", true, true},
+		{"di1e0:e", false, false},
+	}
+	for _, tt := range tests {
+		var v map[string]interface{}
+		if err := Unmarshal([]byte(tt.in), &v); (err == nil) != tt.strict {
+			t.Errorf("Unmarshal(%q) error = %v, want accepted %v", tt.in, err, tt.strict)
+		}
+		d := NewDecoder(strings.NewReader(tt.in))
+		d.AllowUnsortedKeys()
+		if err := d.Decode(&v); (err == nil) != tt.unsorted {
+			t.Errorf("unsorted Decode(%q) error = %v, want accepted %v", tt.in, err, tt.unsorted)
+		}
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	var v struct {
+		A RawMessage `bencode:"a"`
+		B int        `bencode:"b"`
+	}
+	in := "d1:ad1:xli1e2:yyee1:bi7ee"
+	if err := Unmarshal([]byte(in), &v); err != nil {
+		t.Fatal(err)
+	}
+	if string(v.A) != "d1:xli1e2:yyee" || v.B != 7 {
+		t.Fatalf("got A=%q B=%d", v.A, v.B)
+	}
+	out, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != in {
+		t.Fatalf("Marshal = %q, want %q", out, in)
+	}
+
+	//RawMessage 中的值同样必须是规范编码
+	if err := Unmarshal([]byte("d1:ad1:y0:1:x0:e1:bi7ee"), &v); err == nil {
+		t.Fatal("unsorted dictionary inside RawMessage was accepted")
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	deep := strings.Repeat("l", DefaultMaxDepth+1) + strings.Repeat("e", DefaultMaxDepth+1)
+	var v interface{}
+	if err := Unmarshal([]byte(deep), &v); err == nil {
+		t.Error("nesting beyond DefaultMaxDepth was accepted")
+	}
+	ok := strings.Repeat("l", DefaultMaxDepth) + strings.Repeat("e", DefaultMaxDepth)
+	if err := Unmarshal([]byte(ok), &v); err != nil {
+		t.Errorf("nesting of DefaultMaxDepth: %v", err)
+	}
+
+	d := NewDecoder(strings.NewReader("ld1:ali1eeee"))
+	d.MaxDepth = 2
+	if err := d.Decode(&v); err == nil {
+		t.Error("nesting beyond MaxDepth was accepted")
+	}
+
+	d = NewDecoder(strings.NewReader("5:hello"))
+	d.MaxStringLength = 4
+	if err := d.Decode(&v); err == nil {
+		t.Error("string beyond MaxStringLength was accepted")
+	}
+
+	//声明的长度超过限制时不应该尝试读取或分配
+	d = NewDecoder(strings.NewReader("99999999999:x"))
+	var se *SyntaxError
+	if err := d.Decode(&v); !errors.As(err, &se) {
+		t.Errorf("huge string length error = %v, want SyntaxError", err)
+	}
+
+	d = NewDecoder(strings.NewReader("l3:abc3:defe"))
+	d.MaxSize = 8
+	if err := d.Decode(&v); err == nil {
+		t.Error("value beyond MaxSize was accepted")
+	}
+	d = NewDecoder(strings.NewReader("l3:abc3:defe"))
+	d.MaxSize = 12
+	if err := d.Decode(&v); err != nil {
+		t.Errorf("value within MaxSize: %v", err)
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	d := NewDecoder(bytes.NewReader([]byte("i1e3:abcde")))
+	var a int
+	var b string
+	var c map[string]interface{}
+	if err := d.Decode(&a); err != nil || a != 1 {
+		t.Fatalf("first value %d, %v", a, err)
+	}
+	if err := d.Decode(&b); err != nil || b != "abc" {
+		t.Fatalf("second value %q, %v", b, err)
+	}
+	if err := d.Decode(&c); err != nil || len(c) != 0 {
+		t.Fatalf("third value %v, %v", c, err)
+	}
+	if d.InputOffset() != 10 {
+		t.Errorf("InputOffset = %d, want 10", d.InputOffset())
+	}
+	if err := d.Decode(&a); err != io.EOF {
+		t.Errorf("Decode at end = %v, want io.EOF", err)
+	}
+	if err := Unmarshal([]byte("i1ei2e"), &a); err == nil {
+		t.Error("trailing data was accepted")
+	}
+}
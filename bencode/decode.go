@@ -0,0 +1,512 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+const (
+	// DefaultMaxDepth 列表以及字典默认允许的最大嵌套层数
+	DefaultMaxDepth = 64
+	// DefaultMaxStringLength 默认允许的单个字符串最大长度
+	DefaultMaxStringLength = 64 << 20
+)
+
+// Decoder 从输入流中逐个读取bencode值，每次 Decode 只读取一个完整的值
+type Decoder struct {
+	// MaxDepth 列表以及字典允许的最大嵌套层数
+	MaxDepth int
+	// MaxStringLength 单个字符串允许的最大长度
+	MaxStringLength int
+	// MaxSize 单次 Decode 允许读取的最大字节数，0 表示不限制
+	MaxSize int64
+
+	r               *bufio.Reader
+	offset          int64 //已经读取的字节数
+	start           int64 //当前值开始的偏移
+	disallowUnknown bool
+	allowUnsorted   bool
+
+	recording int    //正在记录原始编码的 RawMessage 数量
+	raw       []byte //记录的原始编码
+}
+
+// NewDecoder 创建从 r 读取的Decoder，可能从 r 中预读超出当前值的数据
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{MaxDepth: DefaultMaxDepth, MaxStringLength: DefaultMaxStringLength, r: br}
+}
+
+// DisallowUnknownFields 解码到结构体时，字典中的键没有对应的字段则返回 UnknownFieldError
+func (d *Decoder) DisallowUnknownFields() {
+	d.disallowUnknown = true
+}
+
+// AllowUnsortedKeys 接受键没有排序的字典，用于兼容不规范的tracker以及peer
+// 重复的键仍然是错误
+func (d *Decoder) AllowUnsortedKeys() {
+	d.allowUnsorted = true
+}
+
+// InputOffset 已经解码的字节数
+func (d *Decoder) InputOffset() int64 {
+	return d.offset
+}
+
+// Unmarshal 解码 data 中的唯一一个bencode值到 v 指向的变量，值之后不能有多余的数据
+func Unmarshal(data []byte, v interface{}) error {
+	d := NewDecoder(bytes.NewReader(data))
+	if err := d.Decode(v); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if d.offset != int64(len(data)) {
+		return &SyntaxError{Offset: d.offset, msg: "Trailing data after value"}
+	}
+	return nil
+}
+
+// Decode 读取下一个bencode值存入 v 指向的变量，输入结束时返回 io.EOF
+// 解码到 interface{} 时字典为 map[string]interface{}，列表为 []interface{}，整数为int64，字符串为string
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("Decode requires a non-nil pointer")
+	}
+	if _, err := d.r.Peek(1); err != nil {
+		return err
+	}
+	d.start = d.offset
+	return d.value(rv.Elem(), 0)
+}
+
+func (d *Decoder) syntaxError(offset int64, format string, args ...interface{}) error {
+	return &SyntaxError{Offset: offset, msg: fmt.Sprintf(format, args...)}
+}
+
+//检查读取 n 个字节之后是否超出 MaxSize
+func (d *Decoder) checkSize(n int64) error {
+	if d.MaxSize > 0 && d.offset-d.start+n > d.MaxSize {
+		return d.syntaxError(d.offset, "Value exceeds size limit of %d bytes", d.MaxSize)
+	}
+	return nil
+}
+
+func (d *Decoder) peekByte() (byte, error) {
+	b, err := d.r.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	if err := d.checkSize(1); err != nil {
+		return 0, err
+	}
+	c, err := d.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	d.offset++
+	if d.recording > 0 {
+		d.raw = append(d.raw, c)
+	}
+	return c, nil
+}
+
+//读取 n 个字节，缓冲随实际读到的数据增长，不会因为声明的长度一次分配过多内存
+func (d *Decoder) readN(n int) ([]byte, error) {
+	if err := d.checkSize(int64(n)); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	read, err := io.CopyN(&buf, d.r, int64(n))
+	d.offset += read
+	if d.recording > 0 {
+		d.raw = append(d.raw, buf.Bytes()...)
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//读取以 end 结尾的十进制数字，不包含 end
+func (d *Decoder) readDigits(end byte) ([]byte, error) {
+	var buf []byte
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == end {
+			return buf, nil
+		}
+		//int64最多19位数字以及符号
+		if len(buf) == 20 {
+			return nil, d.syntaxError(d.offset-1, "Number is too long")
+		}
+		buf = append(buf, c)
+	}
+}
+
+//规范的整数：可选的负号加上没有前导零的数字，不允许 -0
+func validInt(b []byte) bool {
+	digits := b
+	if len(b) > 0 && b[0] == '-' {
+		digits = b[1:]
+	}
+	if len(digits) == 0 {
+		return false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return digits[0] != '0' || len(b) == 1
+}
+
+func (d *Decoder) readInt() (int64, error) {
+	start := d.offset
+	if _, err := d.readByte(); err != nil {
+		return 0, err
+	}
+	digits, err := d.readDigits('e')
+	if err != nil {
+		return 0, err
+	}
+	if !validInt(digits) {
+		return 0, d.syntaxError(start, "Invalid integer %q", digits)
+	}
+	n, err := strconv.ParseInt(string(digits), 10, 64)
+	if err != nil {
+		return 0, d.syntaxError(start, "Integer %s overflows int64", digits)
+	}
+	return n, nil
+}
+
+func (d *Decoder) readString() ([]byte, error) {
+	start := d.offset
+	digits, err := d.readDigits(':')
+	if err != nil {
+		return nil, err
+	}
+	if len(digits) == 0 || digits[0] == '-' || !validInt(digits) {
+		return nil, d.syntaxError(start, "Invalid string length %q", digits)
+	}
+	n, err := strconv.Atoi(string(digits))
+	if err != nil || n > d.MaxStringLength {
+		return nil, d.syntaxError(start, "String length %s exceeds limit of %d", digits, d.MaxStringLength)
+	}
+	return d.readN(n)
+}
+
+//依次读取列表中的元素，每个元素由 item 读取
+func (d *Decoder) list(depth int, item func() error) error {
+	if depth > d.MaxDepth {
+		return d.syntaxError(d.offset, "Nesting exceeds depth limit of %d", d.MaxDepth)
+	}
+	if _, err := d.readByte(); err != nil {
+		return err
+	}
+	for {
+		c, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			_, err := d.readByte()
+			return err
+		}
+		if err := item(); err != nil {
+			return err
+		}
+	}
+}
+
+//依次读取字典中的键，对应的值由 item 读取，同时检查键的顺序
+func (d *Decoder) dict(depth int, item func(key string, offset int64) error) error {
+	if depth > d.MaxDepth {
+		return d.syntaxError(d.offset, "Nesting exceeds depth limit of %d", d.MaxDepth)
+	}
+	if _, err := d.readByte(); err != nil {
+		return err
+	}
+	var prev string
+	var seen map[string]bool
+	for i := 0; ; i++ {
+		c, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			_, err := d.readByte()
+			return err
+		}
+		offset := d.offset
+		if c < '0' || c > '9' {
+			return d.syntaxError(offset, "Dictionary key is not a string")
+		}
+		b, err := d.readString()
+		if err != nil {
+			return err
+		}
+		key := string(b)
+		switch {
+		case d.allowUnsorted:
+			if seen == nil {
+				seen = make(map[string]bool)
+			}
+			if seen[key] {
+				return d.syntaxError(offset, "Duplicate dictionary key %q", key)
+			}
+			seen[key] = true
+		case i > 0 && key == prev:
+			return d.syntaxError(offset, "Duplicate dictionary key %q", key)
+		case i > 0 && key < prev:
+			return d.syntaxError(offset, "Dictionary key %q is not sorted after %q", key, prev)
+		}
+		prev = key
+		if err := item(key, offset); err != nil {
+			return err
+		}
+	}
+}
+
+//读取一个值并丢弃
+func (d *Decoder) skip(depth int) error {
+	c, err := d.peekByte()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c == 'i':
+		_, err = d.readInt()
+	case c >= '0' && c <= '9':
+		_, err = d.readString()
+	case c == 'l':
+		err = d.list(depth+1, func() error { return d.skip(depth + 1) })
+	case c == 'd':
+		err = d.dict(depth+1, func(string, int64) error { return d.skip(depth + 1) })
+	default:
+		err = d.syntaxError(d.offset, "Invalid value prefix %q", c)
+	}
+	return err
+}
+
+//读取一个值为 interface{} 表示
+func (d *Decoder) generic(depth int) (interface{}, error) {
+	c, err := d.peekByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c == 'i':
+		return d.readInt()
+	case c >= '0' && c <= '9':
+		s, err := d.readString()
+		return string(s), err
+	case c == 'l':
+		list := []interface{}{}
+		err := d.list(depth+1, func() error {
+			v, err := d.generic(depth + 1)
+			list = append(list, v)
+			return err
+		})
+		return list, err
+	case c == 'd':
+		dict := map[string]interface{}{}
+		err := d.dict(depth+1, func(key string, _ int64) error {
+			v, err := d.generic(depth + 1)
+			dict[key] = v
+			return err
+		})
+		return dict, err
+	}
+	return nil, d.syntaxError(d.offset, "Invalid value prefix %q", c)
+}
+
+//保存一个值的原始编码
+func (d *Decoder) rawValue(v reflect.Value, depth int) error {
+	mark := len(d.raw)
+	d.recording++
+	err := d.skip(depth)
+	d.recording--
+	if err == nil {
+		v.SetBytes(append(RawMessage(nil), d.raw[mark:]...))
+	}
+	if d.recording == 0 {
+		d.raw = d.raw[:0]
+	}
+	return err
+}
+
+//读取一个值存入 v
+func (d *Decoder) value(v reflect.Value, depth int) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if v.Type() == rawMessageType {
+		return d.rawValue(v, depth)
+	}
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		g, err := d.generic(depth)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(g))
+		return nil
+	}
+
+	c, err := d.peekByte()
+	if err != nil {
+		return err
+	}
+	offset := d.offset
+	switch {
+	case c == 'i':
+		n, err := d.readInt()
+		if err != nil {
+			return err
+		}
+		return d.setInt(v, n, offset)
+	case c >= '0' && c <= '9':
+		s, err := d.readString()
+		if err != nil {
+			return err
+		}
+		return d.setString(v, s, offset)
+	case c == 'l':
+		return d.listValue(v, depth, offset)
+	case c == 'd':
+		return d.dictValue(v, depth, offset)
+	}
+	return d.syntaxError(offset, "Invalid value prefix %q", c)
+}
+
+func (d *Decoder) setInt(v reflect.Value, n int64, offset int64) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !v.OverflowInt(n) {
+			v.SetInt(n)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n >= 0 && !v.OverflowUint(uint64(n)) {
+			v.SetUint(uint64(n))
+			return nil
+		}
+	case reflect.Bool:
+		if n == 0 || n == 1 {
+			v.SetBool(n == 1)
+			return nil
+		}
+	}
+	return &UnmarshalTypeError{Value: "integer " + strconv.FormatInt(n, 10), Type: v.Type(), Offset: offset}
+}
+
+func (d *Decoder) setString(v reflect.Value, s []byte, offset int64) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(s))
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(s)
+			return nil
+		}
+	case reflect.Array:
+		//定长数组要求长度完全一致，例如 [20]byte 的哈希
+		if v.Type().Elem().Kind() == reflect.Uint8 && v.Len() == len(s) {
+			reflect.Copy(v, reflect.ValueOf(s))
+			return nil
+		}
+	}
+	return &UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: offset}
+}
+
+func (d *Decoder) listValue(v reflect.Value, depth int, offset int64) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		slice := reflect.MakeSlice(v.Type(), 0, 0)
+		err := d.list(depth+1, func() error {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			err := d.value(elem, depth+1)
+			slice = reflect.Append(slice, elem)
+			return err
+		})
+		v.Set(slice)
+		return err
+	case reflect.Array:
+		i := 0
+		err := d.list(depth+1, func() error {
+			if i >= v.Len() {
+				return &UnmarshalTypeError{Value: "list longer than " + strconv.Itoa(v.Len()), Type: v.Type(), Offset: offset}
+			}
+			i++
+			return d.value(v.Index(i-1), depth+1)
+		})
+		for ; err == nil && i < v.Len(); i++ {
+			v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+		}
+		return err
+	}
+	return &UnmarshalTypeError{Value: "list", Type: v.Type(), Offset: offset}
+}
+
+func (d *Decoder) dictValue(v reflect.Value, depth int, offset int64) error {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		return d.dict(depth+1, func(key string, _ int64) error {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.value(elem, depth+1); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+			return nil
+		})
+	case reflect.Struct:
+		fields := fieldsOf(v.Type())
+		return d.dict(depth+1, func(key string, keyOffset int64) error {
+			f, ok := lookupField(fields, key)
+			if ok {
+				return d.value(v.Field(f.index), depth+1)
+			}
+			if d.disallowUnknown {
+				return &UnknownFieldError{Key: key, Type: v.Type(), Offset: keyOffset}
+			}
+			return d.skip(depth + 1)
+		})
+	}
+	return &UnmarshalTypeError{Value: "dictionary", Type: v.Type(), Offset: offset}
+}
@@ -0,0 +1,148 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// Encoder 向输出流写入规范编码的bencode值
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder 创建写入 w 的Encoder
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode 编码 v 并写入输出流，编码失败时不会写入任何数据
+func (e *Encoder) Encode(v interface{}) error {
+	b, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(b)
+	return err
+}
+
+// Marshal 返回 v 的规范编码，字典的键按字节序排序
+// 字符串、[]byte 以及 [N]byte 编码为字符串，整数以及bool编码为整数，切片以及数组编码为列表，
+// 键为字符串的map以及结构体编码为字典，结构体中值为nil的指针以及接口字段被省略
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encode(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeString(buf *bytes.Buffer, s []byte) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.Write(s)
+}
+
+func encode(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		return errors.New("Cannot marshal nil")
+	}
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return errors.New("Cannot marshal empty RawMessage")
+		}
+		buf.Write(v.Bytes())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return errors.New("Cannot marshal nil")
+		}
+		return encode(buf, v.Elem())
+	case reflect.String:
+		encodeString(buf, []byte(v.String()))
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteString("i1e")
+		} else {
+			buf.WriteString("i0e")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatInt(v.Int(), 10))
+		buf.WriteByte('e')
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+		buf.WriteByte('e')
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			encodeString(buf, b)
+			return nil
+		}
+		buf.WriteByte('l')
+		for i := 0; i < v.Len(); i++ {
+			if err := encode(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return &UnsupportedTypeError{Type: v.Type()}
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		buf.WriteByte('d')
+		for _, k := range keys {
+			encodeString(buf, []byte(k.String()))
+			if err := encode(buf, v.MapIndex(k)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Struct:
+		buf.WriteByte('d')
+		for _, f := range fieldsOf(v.Type()) {
+			fv := v.Field(f.index)
+			if (fv.Kind() == reflect.Ptr || fv.Kind() == reflect.Interface) && fv.IsNil() {
+				continue
+			}
+			if f.omitEmpty && isEmpty(fv) {
+				continue
+			}
+			encodeString(buf, []byte(f.name))
+			if err := encode(buf, fv); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return &UnsupportedTypeError{Type: v.Type()}
+	}
+	return nil
+}
+
+//omitempty 时省略的零值
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Array:
+		return v.IsZero()
+	}
+	return false
+}
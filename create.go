@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bitDownloader/parser"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//可以重复指定的命令行参数
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+//由文件或目录创建种子文件
+func runCreate(args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	var trackers, webSeeds stringList
+	fs.Var(&trackers, "t", "tracker URL, repeat for each tier, comma separate trackers within a tier")
+	fs.Var(&webSeeds, "w", "web seed URL, may be repeated")
+	out := fs.String("o", "", "output file, defaults to <name>.torrent")
+	name := fs.String("name", "", "torrent name, defaults to the last element of the path")
+	pieceLength := fs.Int("piece-length", 0, "piece length in KiB, a power of two, 0 to choose automatically")
+	comment := fs.String("comment", "", "comment")
+	createdBy := fs.String("created-by", parser.DefaultCreatedBy, "created by")
+	private := fs.Bool("private", false, "mark the torrent private")
+	source := fs.String("source", "", "source tag, changes the infohash")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	opts := parser.CreateOptions{
+		Name:         *name,
+		PieceLength:  *pieceLength * 1024,
+		WebSeeds:     webSeeds,
+		Comment:      *comment,
+		CreatedBy:    *createdBy,
+		CreationDate: time.Now(),
+		Private:      *private,
+		Source:       *source,
+	}
+	for _, tier := range trackers {
+		opts.AnnounceList = append(opts.AnnounceList, strings.Split(tier, ","))
+	}
+	//只有一个tracker时不需要 announce-list
+	if len(opts.AnnounceList) == 1 && len(opts.AnnounceList[0]) == 1 {
+		opts.Announce = opts.AnnounceList[0][0]
+		opts.AnnounceList = nil
+	}
+
+	data, err := parser.Create(fs.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	bto, err := parser.Open(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	tf, err := bto.ToTorrentFile()
+	if err != nil {
+		return err
+	}
+	path := *out
+	if path == "" {
+		path = filepath.Base(tf.Name) + ".torrent"
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Created %s: %d pieces of %d KiB, infohash %x\n", path, len(tf.PieceHashes), tf.PieceLength/1024, tf.InfoHash)
+	return nil
+}
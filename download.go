@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bitDownloader/downloader"
+	"bitDownloader/parser"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func runDownload(args []string) error {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	only := fs.String("only", "", "comma separated file indexes to download, all other files are skipped")
+	priority := fs.String("priority", "", "comma separated index=off|low|normal|high file priorities")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	tof, err := loadTorrent(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := applyPriorities(&tof, *only, *priority); err != nil {
+		return err
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	return tof.DownloadToFileContext(ctx, fs.Arg(1))
+}
+
+//根据命令行参数设置文件优先级
+func applyPriorities(tof *parser.TorrentFile, only, priority string) error {
+	if (only != "" || priority != "") && len(tof.Files) == 0 {
+		return fmt.Errorf("File selection requires a multi-file torrent")
+	}
+	if only != "" {
+		for i := range tof.Files {
+			tof.Files[i].Priority = downloader.PriorityOff
+		}
+		for _, field := range strings.Split(only, ",") {
+			index, err := fileIndex(tof, field)
+			if err != nil {
+				return err
+			}
+			tof.Files[index].Priority = downloader.PriorityNormal
+		}
+	}
+	if priority != "" {
+		for _, field := range strings.Split(priority, ",") {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("Malformed priority %q, expected index=priority", field)
+			}
+			index, err := fileIndex(tof, kv[0])
+			if err != nil {
+				return err
+			}
+			p, err := downloader.ParsePriority(kv[1])
+			if err != nil {
+				return err
+			}
+			tof.Files[index].Priority = p
+		}
+	}
+	return nil
+}
+
+func fileIndex(tof *parser.TorrentFile, s string) (int, error) {
+	index, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	if index < 0 || index >= len(tof.Files) {
+		return 0, fmt.Errorf("File index %d out of range [0, %d)", index, len(tof.Files))
+	}
+	return index, nil
+}
@@ -6,11 +6,23 @@ type BitField []byte
 func (bf BitField) HasPiece(index int) bool {
 	byteIndex := index / 8 //获取是在第几个字节
 	offset := index % 8    //获取偏移量
+	//peer发送的bitfield可能长度不足
+	if byteIndex < 0 || byteIndex >= len(bf) {
+		return false
+	}
 	return bf[byteIndex]>>(7-offset)&1 != 0
 }
 
 func (bf BitField) SetPiece(index int) {
 	byteIndex := index / 8 //获取是在第几个字节
 	offset := index % 8    //获取偏移量
+	if byteIndex < 0 || byteIndex >= len(bf) {
+		return
+	}
 	bf[byteIndex] |= 1 << (7 - offset)
 }
+
+// NewBitField 创建能够容纳 n 个piece的bitfield
+func NewBitField(n int) BitField {
+	return make(BitField, (n+7)/8)
+}
@@ -3,13 +3,17 @@ package downloader
 import (
 	"bitDownloader/handshake"
 	"bitDownloader/peer"
+	"bitDownloader/ratelimit"
 	"bytes"
+	"context"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
 // Client 提供tcp连接能力
+// 连接建立后由读取循环持续接收消息，Choked 以及 Bitfield 需要通过加锁的方法访问
 type Client struct {
 	Conn     net.Conn
 	Choked   bool
@@ -17,15 +21,45 @@ type Client struct {
 	peer     peer.Peer
 	InfoHash [20]byte
 	peerId   [20]byte
+
+	mu         sync.Mutex
+	amChoking  bool          //我们是否choke了对方，choke时不响应对方的请求
+	interested bool          //对方是否对我们的数据感兴趣
+	pieces     chan *Message //读取循环收到的piece消息
+	wake       chan struct{} //choke状态变化
+	done       chan struct{} //读取循环退出时关闭
+	upload     *ratelimit.Limiter
+	download   *ratelimit.Limiter
+	v2         bool //对方在握手中声明支持v2，可以向其发送hash request
+
+	chokedSince time.Time //对方开始choke我们的时间
+	lastActive  time.Time //最近一次收到或发送block的时间
+}
+
+func newClient(conn net.Conn, peer peer.Peer, bitfield BitField, infoHash, peerID [20]byte) *Client {
+	return &Client{
+		Conn:      conn,
+		Choked:    true,
+		Bitfield:  bitfield,
+		peer:      peer,
+		InfoHash:  infoHash,
+		peerId:    peerID,
+		amChoking: true,
+		pieces:    make(chan *Message, MaxBacklog*2),
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+
+		chokedSince: time.Now(),
+		lastActive:  time.Now(),
+	}
 }
 
-//peer 之间进行握手
-func completeHandShake(conn net.Conn, infoHash, peerId [20]byte) (*handshake.Handshake, error) {
+//peer 之间进行握手，h 为我们发送的握手消息
+func completeHandShake(conn net.Conn, h *handshake.Handshake) (*handshake.Handshake, error) {
 	//设置握手超时时间为3s
 	conn.SetDeadline(time.Now().Add(time.Second * 3))
 	defer conn.SetDeadline(time.Time{}) //接除限制
 
-	h := handshake.New(infoHash, peerId)
 	_, err := conn.Write(h.Serialize())
 	if err != nil {
 		return nil, err
@@ -35,8 +69,8 @@ func completeHandShake(conn net.Conn, infoHash, peerId [20]byte) (*handshake.Han
 		return nil, err
 	}
 	//检查握手得到的种子哈希值是否正确
-	if !bytes.Equal(res.InfoHash[:], infoHash[:]) {
-		return nil, fmt.Errorf("Expected infohash %x but got %x", res.InfoHash, infoHash)
+	if !bytes.Equal(res.InfoHash[:], h.InfoHash[:]) {
+		return nil, fmt.Errorf("Expected infohash %x but got %x", h.InfoHash, res.InfoHash)
 	}
 	return res, nil
 }
@@ -67,11 +101,42 @@ func recvBitfield(conn net.Conn) (BitField, error) {
 
 // New 构建client
 func New(peer peer.Peer, peerID, infoHash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), time.Second*3)
+	return NewContext(context.Background(), peer, peerID, infoHash)
+}
+
+// NewContext 构建client，ctx 取消时停止连接
+func NewContext(ctx context.Context, peer peer.Peer, peerID, infoHash [20]byte) (*Client, error) {
+	return NewWithDialer(ctx, nil, peer, peerID, infoHash)
+}
+
+// Dialer 建立到peer的连接，例如经过代理
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+//未经代理直接连接peer的超时时间
+const dialTimeout = time.Second * 3
+
+//使用 d 连接peer，d 为空时直接连接
+func dial(ctx context.Context, d Dialer, p peer.Peer) (net.Conn, error) {
+	if d == nil {
+		d = &net.Dialer{Timeout: dialTimeout}
+	}
+	return d.DialContext(ctx, "tcp", p.String())
+}
+
+// NewWithDialer 与 NewContext 相同，使用 d 建立连接，d 为空时直接连接
+func NewWithDialer(ctx context.Context, d Dialer, peer peer.Peer, peerID, infoHash [20]byte) (*Client, error) {
+	return connect(ctx, d, peer, handshake.New(infoHash, peerID))
+}
+
+//连接peer并交换握手消息，h 为我们发送的握手消息，之后接收对方的bitfield
+func connect(ctx context.Context, d Dialer, peer peer.Peer, h *handshake.Handshake) (*Client, error) {
+	conn, err := dial(ctx, d, peer)
 	if err != nil {
 		return nil, err
 	}
-	_, err = completeHandShake(conn, infoHash, peerID)
+	res, err := completeHandShake(conn, h)
 	if err != nil {
 		conn.Close()
 		return nil, err
@@ -82,15 +147,63 @@ func New(peer peer.Peer, peerID, infoHash [20]byte) (*Client, error) {
 		return nil, err
 	}
 
-	client := &Client{
-		Conn:     conn,
-		Choked:   true,
-		Bitfield: bitfield,
-		peer:     peer,
-		InfoHash: infoHash,
-		peerId:   peerID,
+	c := newClient(conn, peer, bitfield, h.InfoHash, h.PeerID)
+	c.v2 = res.SupportsV2()
+	return c, nil
+}
+
+// Peer 连接的对端
+func (c *Client) Peer() peer.Peer {
+	return c.peer
+}
+
+// HasPiece 对方是否拥有该piece
+func (c *Client) HasPiece(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Bitfield.HasPiece(index)
+}
+
+//收到have消息
+func (c *Client) setPiece(index int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Bitfield.SetPiece(index)
+}
+
+//收到或发送了block
+func (c *Client) touch() {
+	c.mu.Lock()
+	c.lastActive = time.Now()
+	c.mu.Unlock()
+}
+
+//收到bitfield消息
+func (c *Client) setBitfield(bf BitField) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Bitfield = bf
+}
+
+// IsChoked 对方是否choke了我们
+func (c *Client) IsChoked() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Choked
+}
+
+//更新choke状态并唤醒等待中的下载
+func (c *Client) setChoked(choked bool) {
+	c.mu.Lock()
+	if choked && !c.Choked {
+		c.chokedSince = time.Now()
+	}
+	c.Choked = choked
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
 	}
-	return client, nil
 }
 
 // Read reads and consumes a message from the connection
@@ -120,13 +233,68 @@ func (c *Client) SendNotInterested() error {
 	return err
 }
 
+// SendChoke sends a Choke message to the peer
+func (c *Client) SendChoke() error {
+	c.mu.Lock()
+	c.amChoking = true
+	c.mu.Unlock()
+	msg := Message{ID: MsgChoke}
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// SendKeepAlive sends a keep-alive message to the peer
+func (c *Client) SendKeepAlive() error {
+	var msg *Message
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
 // SendUnchoke sends an Unchoke message to the peer
 func (c *Client) SendUnchoke() error {
+	c.mu.Lock()
+	c.amChoking = false
+	c.mu.Unlock()
 	msg := Message{ID: MsgUnchoke}
 	_, err := c.Conn.Write(msg.Serialize())
 	return err
 }
 
+// SendBitfield sends our Bitfield message to the peer
+func (c *Client) SendBitfield(bf BitField) error {
+	msg := Message{ID: MsgBitfield, Payload: bf}
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// SendPiece sends a block of a piece to the peer
+func (c *Client) SendPiece(index, begin int, block []byte) error {
+	msg := FormatPiece(index, begin, block)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// SendHashRequest 请求对方merkle树中的一段哈希
+func (c *Client) SendHashRequest(req HashRequest) error {
+	msg := FormatHashRequest(req)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// SendHashes 响应hash request
+func (c *Client) SendHashes(req HashRequest, hashes [][32]byte) error {
+	msg := FormatHashes(req, hashes)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// SendHashReject 拒绝无法响应的hash request
+func (c *Client) SendHashReject(req HashRequest) error {
+	msg := FormatHashReject(req)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
 // SendHave sends a Have message to the peer
 func (c *Client) SendHave(index int) error {
 	msg := FormatHave(index)
@@ -0,0 +1,241 @@
+package downloader
+
+import (
+	"bitDownloader/peer"
+	"context"
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+//连接管理：维持每个种子的目标连接数，从候选peer中按照评分选择连接，失败的peer按指数退避重试
+
+// DefaultMaxConns Torrent.MaxConns 为0时每个种子维持的连接数量
+const DefaultMaxConns = 30
+
+// MaxPeerFailures 连续失败达到该次数的peer不再重试
+const MaxPeerFailures = 5
+
+// SnubTimeout 我们需要数据但对方持续choke我们超过该时间时断开，换用其他peer
+const SnubTimeout = 60 * time.Second
+
+// IdleTimeout 双方持续没有传输任何block超过该时间时断开
+const IdleTimeout = 2 * time.Minute
+
+const (
+	retryBackoff      = 2 * time.Second //第一次失败后的重试间隔，之后每次翻倍
+	maxRetryBackoff   = 5 * time.Minute
+	managerInterval   = time.Second      //检查连接数量以及到期重试的间隔
+	peerCheckInterval = 10 * time.Second //检查snub以及空闲的间隔
+)
+
+//候选peer
+type candidate struct {
+	peer     peer.Peer
+	score    int //成功下载的piece数量减去失败次数
+	failures int //连续失败次数
+	retryAt  time.Time
+}
+
+//一次连接的结果
+type peerOutcome struct {
+	pieces    int  //成功下载的piece数量
+	cancelled bool //由于暂停或停止下载而断开，不计为失败
+}
+
+//一次下载可以连接的peer，由 Torrent.mu 保护
+type peerPool struct {
+	candidates map[string]*candidate
+}
+
+func newPeerPool() *peerPool {
+	return &peerPool{candidates: make(map[string]*candidate)}
+}
+
+//加入新的候选peer，已经存在的保留原有的评分以及失败次数
+func (p *peerPool) add(peers []peer.Peer) {
+	for _, pe := range peers {
+		key := pe.String()
+		if _, ok := p.candidates[key]; !ok {
+			p.candidates[key] = &candidate{peer: pe}
+		}
+	}
+}
+
+//按照评分挑选至多 n 个可以连接的peer，跳过已经连接、被屏蔽、正在退避以及失败过多的peer
+func (p *peerPool) pick(n int, now time.Time, connected map[string]*Client, blocked func(net.IP) bool) []*candidate {
+	var ready []*candidate
+	for key, c := range p.candidates {
+		if _, ok := connected[key]; ok {
+			continue
+		}
+		if blocked(c.peer.Ip) {
+			continue
+		}
+		if c.failures >= MaxPeerFailures || now.Before(c.retryAt) {
+			continue
+		}
+		ready = append(ready, c)
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		if ready[i].score != ready[j].score {
+			return ready[i].score > ready[j].score
+		}
+		return ready[i].failures < ready[j].failures
+	})
+	if len(ready) > n {
+		ready = ready[:n]
+	}
+	return ready
+}
+
+//是否还有可以重试的peer或web seed，被屏蔽或封禁的peer不计入
+func (t *Torrent) retryable(r *run) bool {
+	blocked := t.blockedFunc()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return r.pool.retryable(blocked) || r.webSeedsRetryable()
+}
+
+func (p *peerPool) retryable(blocked func(net.IP) bool) bool {
+	for _, c := range p.candidates {
+		if c.failures < MaxPeerFailures && !blocked(c.peer.Ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//返回判断IP是否被 IPFilter 屏蔽或者已经被封禁的函数，调用时不需要持有 Torrent.mu
+func (t *Torrent) blockedFunc() func(net.IP) bool {
+	ban := t.getBan()
+	return func(ip net.IP) bool {
+		if ok, _ := t.IPFilter.Blocked(ip); ok {
+			return true
+		}
+		return ban.isBanned(ip)
+	}
+}
+
+//记录一次连接的结果并计算下一次重试的时间
+func (c *candidate) record(o peerOutcome, now time.Time) {
+	c.score += o.pieces
+	switch {
+	case o.cancelled:
+		return
+	case o.pieces > 0:
+		//有过贡献的peer断开后尽快重连
+		c.failures = 0
+		c.retryAt = now.Add(retryBackoff)
+		return
+	}
+	c.failures++
+	c.score--
+	backoff := retryBackoff << uint(c.failures-1)
+	if backoff > maxRetryBackoff || backoff <= 0 {
+		backoff = maxRetryBackoff
+	}
+	c.retryAt = now.Add(backoff)
+}
+
+//加入候选peer并立即尝试补足连接
+func (t *Torrent) connect(r *run, peers []peer.Peer) {
+	t.mu.Lock()
+	r.pool.add(peers)
+	t.mu.Unlock()
+	r.wakeManager()
+}
+
+func (r *run) wakeManager() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+//连接管理循环，直到下载结束
+func (t *Torrent) manage(r *run) {
+	defer r.wg.Done()
+	ticker := time.NewTicker(managerInterval)
+	defer ticker.Stop()
+	for {
+		t.fill(r)
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+	}
+}
+
+//连接数不足时按照评分连接候选peer并启动web seed，做种或暂停时不主动连接
+func (t *Torrent) fill(r *run) {
+	blocked := t.blockedFunc()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r.seed || t.paused || r.ctx.Err() != nil {
+		return
+	}
+	t.fillWebSeedsLocked(r, time.Now())
+	target := t.MaxConns
+	if target <= 0 {
+		target = DefaultMaxConns
+	}
+	need := target - len(r.clients)
+	if need <= 0 {
+		return
+	}
+	for _, c := range r.pool.pick(need, time.Now(), r.clients, blocked) {
+		c := c
+		t.spawn(r, c.peer, func(ctx context.Context) {
+			o := t.startDownloadWorker(ctx, r, c.peer)
+			if ctx.Err() != nil {
+				o.cancelled = true
+			}
+			t.mu.Lock()
+			c.record(o, time.Now())
+			t.mu.Unlock()
+			r.wakeManager()
+		})
+	}
+}
+
+//连接是否应该被断开：我们需要数据但持续被choke，或者双方长时间没有传输数据
+func (t *Torrent) shouldDrop(r *run, c *Client, now time.Time) string {
+	t.mu.Lock()
+	paused := t.paused
+	t.mu.Unlock()
+	if paused {
+		return ""
+	}
+	c.mu.Lock()
+	choked, chokedSince, lastActive := c.Choked, c.chokedSince, c.lastActive
+	c.mu.Unlock()
+	if !r.seed && choked && now.Sub(chokedSince) > SnubTimeout && r.picker.remaining() > 0 {
+		return "snubbed"
+	}
+	if now.Sub(lastActive) > IdleTimeout {
+		return "idle"
+	}
+	return ""
+}
+
+//定期检查连接，断开snub或空闲的peer，由连接管理选择其他peer代替
+func (t *Torrent) watchPeer(ctx context.Context, r *run, c *Client) {
+	ticker := time.NewTicker(peerCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if reason := t.shouldDrop(r, c, now); reason != "" {
+				log.Printf("Disconnecting %s peer %s\n", reason, c.peer)
+				c.Conn.Close()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package downloader
+
+import (
+	"bitDownloader/peer"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCandidateRecord(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := &candidate{}
+	//每次失败退避时间翻倍，最多 maxRetryBackoff
+	want := []time.Duration{2, 4, 8, 16, 32, 64, 128, 256, 300, 300}
+	for i, seconds := range want {
+		c.record(peerOutcome{}, now)
+		if c.failures != i+1 || c.score != -(i+1) {
+			t.Fatalf("after %d failures: failures %d, score %d", i+1, c.failures, c.score)
+		}
+		if got := c.retryAt.Sub(now); got != seconds*time.Second {
+			t.Errorf("after %d failures: backoff %v, want %v", i+1, got, seconds*time.Second)
+		}
+	}
+
+	//成功下载后清零失败次数并尽快重连
+	c.record(peerOutcome{pieces: 15}, now)
+	if c.failures != 0 || c.score != 5 || c.retryAt != now.Add(retryBackoff) {
+		t.Errorf("after success: failures %d, score %d, backoff %v", c.failures, c.score, c.retryAt.Sub(now))
+	}
+
+	//取消的连接只计入下载的piece，不计为失败
+	c.retryAt = time.Time{}
+	c.record(peerOutcome{pieces: 2, cancelled: true}, now)
+	if c.failures != 0 || c.score != 7 || !c.retryAt.IsZero() {
+		t.Errorf("after cancel: failures %d, score %d, retryAt %v", c.failures, c.score, c.retryAt)
+	}
+
+	//移位溢出时同样使用最大退避时间
+	c.failures = 63
+	c.record(peerOutcome{}, now)
+	if got := c.retryAt.Sub(now); got != maxRetryBackoff {
+		t.Errorf("backoff after %d failures = %v", c.failures, got)
+	}
+}
+
+func testPool(cs ...*candidate) *peerPool {
+	p := newPeerPool()
+	for _, c := range cs {
+		p.candidates[c.peer.String()] = c
+	}
+	return p
+}
+
+func testPeer(ip string) peer.Peer {
+	return peer.Peer{Ip: net.ParseIP(ip), Port: 6881}
+}
+
+func noneBlocked(net.IP) bool { return false }
+
+func TestPeerPoolPick(t *testing.T) {
+	now := time.Unix(1000, 0)
+	p := testPool(
+		&candidate{peer: testPeer("10.0.0.1"), score: 3},
+		&candidate{peer: testPeer("10.0.0.2"), score: 5},
+		&candidate{peer: testPeer("10.0.0.3"), score: -1, failures: 1},
+		&candidate{peer: testPeer("10.0.0.4"), score: -1, failures: 2},
+		&candidate{peer: testPeer("10.0.0.5"), score: 9},                                  //已经连接
+		&candidate{peer: testPeer("10.0.0.6"), score: 9},                                  //被屏蔽
+		&candidate{peer: testPeer("10.0.0.7"), score: 9, retryAt: now.Add(time.Second)},   //正在退避
+		&candidate{peer: testPeer("10.0.0.8"), score: 9, failures: MaxPeerFailures},       //失败过多
+		&candidate{peer: testPeer("10.0.0.9"), score: 0, retryAt: now.Add(-time.Second)},  //退避已经结束
+		&candidate{peer: testPeer("10.0.0.10"), score: -1, failures: MaxPeerFailures - 1}, //还可以重试
+	)
+	connected := map[string]*Client{testPeer("10.0.0.5").String(): nil}
+	blocked := func(ip net.IP) bool { return ip.Equal(net.ParseIP("10.0.0.6")) }
+
+	ips := func(cs []*candidate) string {
+		var s []string
+		for _, c := range cs {
+			s = append(s, c.peer.Ip.String())
+		}
+		return strings.Join(s, " ")
+	}
+	//按照评分由高到低，评分相同时失败次数少的优先
+	want := "10.0.0.2 10.0.0.1 10.0.0.9 10.0.0.3 10.0.0.4 10.0.0.10"
+	if got := ips(p.pick(100, now, connected, blocked)); got != want {
+		t.Errorf("pick = %s, want %s", got, want)
+	}
+	if got := ips(p.pick(2, now, connected, blocked)); got != "10.0.0.2 10.0.0.1" {
+		t.Errorf("pick(2) = %s", got)
+	}
+	//退避结束后可以再次连接
+	if got := ips(p.pick(1, now.Add(time.Second), nil, noneBlocked)); got != "10.0.0.5" && got != "10.0.0.6" && got != "10.0.0.7" {
+		t.Errorf("pick after backoff = %s", got)
+	}
+	if n := len(p.pick(100, now.Add(time.Second), nil, noneBlocked)); n != 9 {
+		t.Errorf("picked %d peers, want all but the failed one", n)
+	}
+}
+
+func TestPeerPoolRetryable(t *testing.T) {
+	failed := &candidate{peer: testPeer("10.0.0.1"), failures: MaxPeerFailures}
+	banned := &candidate{peer: testPeer("10.0.0.2")}
+	p := testPool(failed, banned)
+	isBanned := func(ip net.IP) bool { return ip.Equal(banned.peer.Ip) }
+	if p.retryable(isBanned) {
+		t.Error("pool with only failed and banned peers is retryable")
+	}
+	if !p.retryable(noneBlocked) {
+		t.Error("unbanned peer is not retryable")
+	}
+	//失败次数未达到上限的peer正在退避时仍然可以重试
+	failed.failures = MaxPeerFailures - 1
+	failed.retryAt = time.Now().Add(time.Hour)
+	if !p.retryable(isBanned) {
+		t.Error("peer below MaxPeerFailures is not retryable")
+	}
+	if newPeerPool().retryable(noneBlocked) {
+		t.Error("empty pool is retryable")
+	}
+}
@@ -1,18 +1,31 @@
 package downloader
 
 import (
+	"bitDownloader/ipfilter"
+	"bitDownloader/merkle"
 	"bitDownloader/peer"
+	"bitDownloader/ratelimit"
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
-	"runtime"
+	"net/http"
+	"sync"
 	"time"
 )
 
 //提供最终的下载方法
 const MaxBlockSize = 16384 //16k
 
+// KeepAliveInterval 发送keep-alive的间隔，避免空闲或暂停时被peer断开
+const KeepAliveInterval = 90 * time.Second
+
+//超过该时间没有收到任何block则放弃当前piece
+const pieceTimeout = 30 * time.Second
+
 // MaxBacklog 一个client所能持有的最大未完成请求数量
 // MaxBacklog is the number of unfulfilled requests a client can have in its pipeline
 const MaxBacklog = 5
@@ -26,8 +39,58 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Files       []File   //多文件种子的文件列表，单文件种子为空
+	Bitfield    BitField //已经拥有并通过校验的piece，下载时将被跳过
+	Sequential  bool     //按顺序下载，适用于边下边播
+	Tracker     Tracker  //下载结束时汇报 completed 或 stopped，为空时不汇报
+
+	// DisconnectOnPause 暂停时断开全部连接，否则保持连接并choke全部peer
+	DisconnectOnPause bool
+	// ConnLimit 连接数限制，多个种子共享同一个channel时限制全局连接数，为空时不限制
+	ConnLimit chan struct{}
+	// MaxConns 每个种子维持的连接数量，0 时使用 DefaultMaxConns
+	MaxConns int
+	// UploadLimiter DownloadLimiter 上级（例如会话）的限速器，可以由多个种子共享，为空时不限制
+	UploadLimiter   *ratelimit.Limiter
+	DownloadLimiter *ratelimit.Limiter
+	// IPFilter 屏蔽列表，连接peer之前以及接受传入连接时检查，可以由多个种子共享，为空时不过滤
+	IPFilter *ipfilter.Filter
+	// Dialer 连接peer使用的拨号器，例如经过代理，为空时直接连接
+	Dialer Dialer
+	// WebSeeds 提供完整数据的HTTP镜像(BEP 19)，作为伪peer与普通peer一起下载，可以没有普通peer
+	WebSeeds []string
+	// HTTPSeeds 按piece提供数据的HTTP脚本(BEP 17)，与 WebSeeds 使用方式相同
+	HTTPSeeds []string
+	// WebSeedClient 请求web seed使用的HTTP客户端，例如经过代理，为空时使用默认客户端
+	WebSeedClient *http.Client
+	// MaxWebSeedConns 每个web seed同时进行的请求数量，0 时使用 DefaultWebSeedConns
+	MaxWebSeedConns int
+
+	// InfoHashV2 v2以及混合种子的SHA-256 infohash，v1种子为零
+	// 纯v2种子的 InfoHash 为其前20字节，混合种子的peer可以使用任意一个握手
+	InfoHashV2 [32]byte
+	// PiecesRoot 单文件v2种子的merkle树根，多文件种子使用 File.PiecesRoot
+	PiecesRoot [32]byte
+	// PieceLayers 超过一个piece的v2文件的piece layer，由pieces root索引
+	// 缺失的piece layer在下载过程中通过hash request向支持v2的peer获取，纯v2种子在获取之前无法下载对应的piece
+	PieceLayers map[[32]byte][][32]byte
+
+	mu         sync.Mutex
+	storage    *Storage     //OpenStorage 打开的存储
+	picker     *piecePicker //下载过程中的piece选择器
+	uploaded   int64
+	downloaded int64
+	paused     bool
+	run        *run //正在进行的下载
+	limits     *torrentLimits
+	ban        *smartBan
+	pieceFiles []pieceFile              //每个piece所在的v2文件
+	fetches    map[[32]byte]*layerFetch //正在获取的piece layer
 }
 
+// ErrNoPeers 全部peer都已断开连接，但仍有piece没有下载完成
+var ErrNoPeers = errors.New("No peers remaining")
+
 //每一个piece请求
 type pieceWork struct {
 	index  int
@@ -49,49 +112,189 @@ type pieceProgress struct {
 	downloaded int
 	requested  int
 	backlog    int
+	received   map[int]bool //已经收到的block起始位置
 }
 
 // Download 下载文件并将所有数据保存在内存中 ，返回的[]byte 切片为文件数据
 func (t *Torrent) Download() ([]byte, error) {
-	log.Println("Starting download for", t.Name)
-	//创建请求队列
-	workChan := make(chan *pieceWork, len(t.PieceHashes))
-	results := make(chan *pieceResult)
-	//接下来创建每一个请求填充入请求队列
-	for index, hash := range t.PieceHashes {
-		p := &pieceWork{
-			hash:   hash,
-			length: t.calculatePieceSize(index), //需要计算开始结束边界
-		}
-		workChan <- p //完成请求入队，此时需要开启协程同步处理请求
-	}
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workChan, results)
-	}
-	//此时正在进行下载
+	return t.DownloadContext(context.Background())
+}
 
+// DownloadContext 与 Download 相同，ctx 取消时停止下载并返回错误
+func (t *Torrent) DownloadContext(ctx context.Context) ([]byte, error) {
+	//内存中没有任何已有数据，需要下载全部piece
+	t.mu.Lock()
+	t.Bitfield = NewBitField(len(t.PieceHashes))
+	t.picker = nil
+	t.mu.Unlock()
 	//创建缓冲数组，将接收下载到的数据
 	buf := make([]byte, t.Length)
-
-	//记录已经完成的次数
-	donePieces := 0
-
-	for donePieces < len(t.PieceHashes) {
-		//获取res
-		res := <-results
+	err := t.download(ctx, func(res *pieceResult) error {
 		//计算开始于结束下标
 		start, end := t.calculateBoundsForPiece(res.index)
 		copy(buf[start:end], res.buf)
-		donePieces++
-		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		//获取当前允许的goroutine
-		numWorkers := runtime.NumGoroutine() - 1 // subtract 1 for main thread
-		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
+		return nil
+	}, false)
+	if err != nil {
+		return nil, err
 	}
-	close(workChan)
 	return buf, nil
 }
 
+// DownloadTo 下载文件并将每个piece直接写入存储，已经在 Bitfield 中的piece不会重复下载
+func (t *Torrent) DownloadTo(s *Storage) error {
+	return t.DownloadToContext(context.Background(), s)
+}
+
+// DownloadToContext 与 DownloadTo 相同，ctx 取消时停止全部worker，
+// 将已经下载的数据写入磁盘并向tracker汇报 stopped 后返回错误
+func (t *Torrent) DownloadToContext(ctx context.Context, s *Storage) error {
+	err := t.download(ctx, writeTo(t, s), false)
+	//无论是否完成都需要将数据落盘
+	if ferr := s.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// Seed 做种：接受传入连接并向peer上传已有的数据，直到 ctx 取消，需要先调用 OpenStorage
+// 做种期间被读取窗口要求的piece仍会从已连接的peer下载
+func (t *Torrent) Seed(ctx context.Context) error {
+	t.mu.Lock()
+	s := t.storage
+	t.mu.Unlock()
+	if s == nil {
+		return errors.New("Storage is not opened")
+	}
+	err := t.download(ctx, writeTo(t, s), true)
+	if ferr := s.Flush(); err == nil {
+		err = ferr
+	}
+	//正常停止做种不是错误
+	if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		return nil
+	}
+	return err
+}
+
+//将下载完成的piece写入存储
+func writeTo(t *Torrent, s *Storage) func(res *pieceResult) error {
+	return func(res *pieceResult) error {
+		start, _ := t.calculateBoundsForPiece(res.index)
+		_, err := s.WriteAt(res.buf, int64(start))
+		return err
+	}
+}
+
+//下载全部需要的piece，每完成一个piece调用一次 handle
+//seed 为真时全部完成后继续运行，只接受传入连接，直到 ctx 取消
+//返回前会停止全部worker并关闭连接
+func (t *Torrent) download(ctx context.Context, handle func(res *pieceResult) error, seed bool) (err error) {
+	if seed {
+		log.Println("Starting to seed", t.Name)
+	} else {
+		log.Println("Starting download for", t.Name)
+	}
+	//按照文件优先级获取piece选择器，跳过已经拥有的piece
+	picker := t.getPicker()
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := newRun(ctx, picker)
+	r.seed = seed
+	t.mu.Lock()
+	if t.run != nil {
+		t.mu.Unlock()
+		cancel()
+		return errors.New("Torrent is already running")
+	}
+	t.run = r
+	paused, peers := t.paused, t.Peers
+	t.mu.Unlock()
+	picker.open()
+	//本次下载完成的piece数量
+	donePieces := 0
+	defer func() {
+		t.mu.Lock()
+		t.run = nil
+		t.mu.Unlock()
+		//唤醒等待任务的worker，并关闭全部连接
+		picker.close()
+		cancel()
+		r.wg.Wait()
+		//只有本次下载了最后的piece并且拥有全部数据时才是完成
+		completed := err == nil && donePieces > 0 && t.Stats().Left == 0
+		t.announceDone(err, completed)
+	}()
+
+	if !seed && picker.remaining() == 0 {
+		log.Println("All wanted pieces already present for", t.Name)
+		return nil
+	}
+	//由连接管理维持连接数量，暂停状态下等到 Resume 时再连接
+	t.mu.Lock()
+	r.pool.add(peers)
+	r.webSeeds = newWebSeeds(t.WebSeeds, t.HTTPSeeds)
+	t.mu.Unlock()
+	r.wg.Add(1)
+	go t.manage(r)
+	if !seed && !paused && len(peers) == 0 && len(r.webSeeds) == 0 {
+		return ErrNoPeers
+	}
+	//此时正在进行下载
+
+	for seed || picker.remaining() > 0 {
+		var res *pieceResult
+		select {
+		case res = <-r.results:
+		case <-picker.update:
+			//优先级发生变化，重新检查剩余数量
+			continue
+		case <-r.exits:
+			//暂停时断开全部连接是正常的，做种时等待新的传入连接
+			//仍有peer等待重试时继续等待
+			if !seed && r.active() == 0 && !t.Paused() && !t.retryable(r) {
+				return ErrNoPeers
+			}
+			continue
+		case <-ctx.Done():
+			return fmt.Errorf("Download cancelled: %w", ctx.Err())
+		}
+		if err := handle(res); err != nil {
+			return err
+		}
+		picker.done(res.index)
+		t.mu.Lock()
+		t.downloaded += int64(len(res.buf))
+		t.mu.Unlock()
+		//通知全部peer我们拥有了新的piece
+		t.broadcastHave(r, res.index)
+		donePieces++
+		percent := float64(donePieces) / float64(donePieces+picker.remaining()) * 100
+		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, r.active())
+	}
+	return nil
+}
+
+//下载结束后向tracker汇报，此时下载使用的ctx可能已经取消
+//出错或取消时汇报 stopped，完成时汇报 completed，
+//没有下载任何piece或者跳过的文件使种子仍不完整时不汇报，避免tracker统计错误的完成次数
+func (t *Torrent) announceDone(err error, completed bool) {
+	var event string
+	switch {
+	case err != nil:
+		event = EventStopped
+	case completed:
+		event = EventCompleted
+	default:
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := t.announce(ctx, event); err != nil {
+		log.Printf("Could not announce %s: %v\n", event, err)
+	}
+}
+
 func (t *Torrent) calculateBoundsForPiece(index int) (begin int, end int) {
 	begin = index * t.PieceLength
 	end = (index + 1) * t.PieceLength
@@ -107,89 +310,81 @@ func (t *Torrent) calculatePieceSize(index int) int {
 
 }
 
-//开始下载，向各个peer发起请求，对应几个peer就对应几个工作线程
-func (t *Torrent) startDownloadWorker(peer peer.Peer, workChan chan *pieceWork, results chan *pieceResult) {
+//开始下载，向peer发起连接并请求数据，返回连接的结果供连接管理评分
+//ctx 取消时关闭连接并退出
+func (t *Torrent) startDownloadWorker(ctx context.Context, r *run, peer peer.Peer) peerOutcome {
+	//受连接数限制时等待空闲的连接
+	if t.ConnLimit != nil {
+		select {
+		case t.ConnLimit <- struct{}{}:
+			defer func() { <-t.ConnLimit }()
+		case <-ctx.Done():
+			return peerOutcome{cancelled: true}
+		}
+	}
+	//等待连接数限制期间屏蔽列表可能已经重新加载
+	if blocked, _ := t.IPFilter.Blocked(peer.Ip); blocked {
+		return peerOutcome{}
+	}
 	//首先需要创建客户端
-	c, err := New(peer, t.PeerID, t.InfoHash)
+	c, err := connect(ctx, t.Dialer, peer, t.newHandshake(t.InfoHash))
 	if err != nil {
 		log.Printf("Could not handshake with %s. Disconnecting\n", peer.Ip)
-		return
+		return peerOutcome{}
 	}
-	defer c.Conn.Close()
-
 	log.Printf("Completed handshake with %s\n", peer.Ip)
 	//此时以及完成了握手以及获取了peer存有的piece
-	//发送unbolck ，interested消息
-
-	c.SendUnchoke()
-	c.SendInterested()
-
-	//接下来要由工作队列中不断取出请求并进行下载
-	for work := range workChan {
-		if !c.Bitfield.HasPiece(work.index) {
-			//如果没有想要的piece就返回
-			workChan <- work
-			continue
-		}
-		//尝试开始下载
-		buf, err := attemptDownloadPiece(c, work)
-
-		//下载失败，此时不应该再向该peer请求
-		if err != nil {
-			workChan <- work
-			return
-		}
-
-		//检查下载数据的完整性
-		err = checkIntegrity(work, buf)
+	pieces := t.runPeer(ctx, r, c)
+	return peerOutcome{pieces: pieces}
+}
 
-		//校验失败
-		if err != nil {
-			log.Printf("Piece #%d failed integrity check\n", work.index)
-			workChan <- work
-			continue
+//检查完整性，v1的SHA-1哈希以及v2的merkle树根存在时都需要匹配
+func (t *Torrent) checkIntegrity(work *pieceWork, buf []byte) error {
+	hasV1 := work.hash != [20]byte{}
+	if hasV1 {
+		hash := sha1.Sum(buf)
+		if !bytes.Equal(work.hash[:], hash[:]) {
+			return fmt.Errorf("Index %d failed integrity check", work.index)
 		}
-
-		//此时数据成功下载,发送message说明数据已经完成下载
-		c.SendHave(work.index)
-
-		//将结果添加至结果队列
-		result := &pieceResult{
-			index: work.index,
-			buf:   buf,
+	}
+	root, width, length, ok := t.pieceHashV2(work.index)
+	if !ok {
+		if !hasV1 {
+			return fmt.Errorf("Index %d has no known hash", work.index)
 		}
-		results <- result
+		return nil
 	}
-
-}
-
-//检查完整性
-func checkIntegrity(work *pieceWork, buf []byte) error {
-	hash := sha1.Sum(buf)
-	if !bytes.Equal(work.hash[:], hash[:]) {
-		return fmt.Errorf("Index %d failed integrity check", work.index)
+	//混合种子piece末尾的padding不属于v2文件
+	if merkle.Root(merkle.BlockHashes(buf[:length]), width, [32]byte{}) != root {
+		return fmt.Errorf("Index %d failed merkle integrity check", work.index)
 	}
 	return nil
 }
 
 //尝试下载piece，需要多块下载
-func attemptDownloadPiece(c *Client, work *pieceWork) ([]byte, error) {
+func attemptDownloadPiece(ctx context.Context, c *Client, work *pieceWork) ([]byte, error) {
 	state := pieceProgress{
-		index:  work.index,
-		client: c,
-		buf:    make([]byte, work.length),
+		index:    work.index,
+		client:   c,
+		buf:      make([]byte, work.length),
+		received: make(map[int]bool),
 	}
-	c.Conn.SetDeadline(time.Now().Add(time.Second * 30)) //30秒下载piece
-	defer c.Conn.SetDeadline(time.Time{})
+	timeout := time.NewTimer(pieceTimeout) //30秒下载piece
+	defer timeout.Stop()
 	for state.downloaded < work.length {
 		//没有下载好并且没有阻塞
-		if !state.client.Choked {
+		if !c.IsChoked() {
 			//积压的工作小于最大积压数，请求的数据小于最终数据
 			for state.backlog < MaxBacklog && state.requested < work.length {
 				blockSize := MaxBlockSize
 				if work.length-state.requested < blockSize {
 					blockSize = work.length - state.requested
 				}
+				//choke之后重新请求时跳过已经收到的block
+				if state.received[state.requested] {
+					state.requested += blockSize
+					continue
+				}
 				err := c.SendRequest(work.index, state.requested, blockSize)
 				if err != nil {
 					return nil, err
@@ -198,46 +393,60 @@ func attemptDownloadPiece(c *Client, work *pieceWork) ([]byte, error) {
 				state.requested += blockSize
 			}
 		}
-		err := state.readMessage()
+		before := state.downloaded
+		err := state.readMessage(ctx, timeout.C)
 		if err != nil {
 			return nil, err
 		}
+		//限速时下载整个piece可能超过30秒，只要仍在收到数据就重新计时
+		if state.downloaded > before {
+			if !timeout.Stop() {
+				select {
+				case <-timeout.C:
+				default:
+				}
+			}
+			timeout.Reset(pieceTimeout)
+		}
 	}
 	return state.buf, nil
 }
 
-//接收msg
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.Read() // this call blocks
-	if err != nil {
-		return err
-	}
-
-	if msg == nil { // keep-alive
-		return nil
-	}
-	switch msg.ID {
-	case MsgUnchoke:
-		//标识没有阻塞
-		state.client.Choked = false
-	case MsgChoke:
-		//标识阻塞
-		state.client.Choked = true
-	case MsgHave:
-		//标识存在该piece
-		index, err := ParseHave(msg)
-		if err != nil {
-			return err
+//接收读取循环转发的msg
+func (state *pieceProgress) readMessage(ctx context.Context, timeout <-chan time.Time) error {
+	c := state.client
+	select {
+	case msg := <-c.pieces:
+		//忽略之前超时或被choke的piece迟到的block
+		if len(msg.Payload) < 8 || int(binary.BigEndian.Uint32(msg.Payload[0:4])) != state.index {
+			return nil
+		}
+		begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+		if state.received[begin] {
+			return nil
 		}
-		state.client.Bitfield.SetPiece(index)
-	case MsgPiece:
 		//接收piece
 		n, err := ParsePiece(state.index, state.buf, msg)
 		if err != nil {
 			return err
 		}
+		state.received[begin] = true
 		state.downloaded += n
-		state.backlog--
+		if state.backlog > 0 {
+			state.backlog--
+		}
+	case <-c.wake:
+		//被choke后对方会丢弃全部未完成的请求，解除后需要重新请求
+		if c.IsChoked() {
+			state.backlog = 0
+			state.requested = 0
+		}
+	case <-c.done:
+		return fmt.Errorf("Connection to %s closed", c.peer)
+	case <-timeout:
+		return fmt.Errorf("Timed out downloading piece #%d from %s", state.index, c.peer)
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 	return nil
 }
@@ -0,0 +1,74 @@
+package downloader
+
+import "bitDownloader/ratelimit"
+
+//种子以及单个peer级别的限速，会话级别的限速器由 Torrent.UploadLimiter 以及 Torrent.DownloadLimiter 传入
+
+//种子的限速器，创建后不会被替换
+type torrentLimits struct {
+	upload       *ratelimit.Limiter
+	download     *ratelimit.Limiter
+	peerUpload   int
+	peerDownload int
+}
+
+//获取种子的限速器，不存在时创建，调用者需持有 t.mu
+func (t *Torrent) limitsLocked() *torrentLimits {
+	if t.limits == nil {
+		t.limits = &torrentLimits{
+			upload:   ratelimit.NewLimiter(0),
+			download: ratelimit.NewLimiter(0),
+		}
+	}
+	return t.limits
+}
+
+// SetRateLimit 设置整个种子的上传以及下载速度，单位为字节每秒，0 表示不限制，下载过程中调用立即生效
+func (t *Torrent) SetRateLimit(upload, download int) {
+	t.mu.Lock()
+	l := t.limitsLocked()
+	t.mu.Unlock()
+	l.upload.SetLimit(upload)
+	l.download.SetLimit(download)
+}
+
+// RateLimit 返回整个种子的上传以及下载速度限制
+func (t *Torrent) RateLimit() (upload, download int) {
+	t.mu.Lock()
+	l := t.limitsLocked()
+	t.mu.Unlock()
+	return l.upload.Limit(), l.download.Limit()
+}
+
+// SetPeerRateLimit 设置每个peer的上传以及下载速度，已经连接的peer同样生效
+func (t *Torrent) SetPeerRateLimit(upload, download int) {
+	t.mu.Lock()
+	l := t.limitsLocked()
+	l.peerUpload, l.peerDownload = upload, download
+	var clients []*Client
+	if t.run != nil {
+		for _, c := range t.run.clients {
+			if c != nil {
+				clients = append(clients, c)
+			}
+		}
+	}
+	t.mu.Unlock()
+	for _, c := range clients {
+		c.upload.SetLimit(upload)
+		c.download.SetLimit(download)
+	}
+}
+
+//对连接的读写依次应用peer、种子以及上级的限速
+func (t *Torrent) limitConn(c *Client) {
+	t.mu.Lock()
+	l := t.limitsLocked()
+	c.upload = ratelimit.NewLimiter(l.peerUpload)
+	c.download = ratelimit.NewLimiter(l.peerDownload)
+	t.mu.Unlock()
+	c.Conn = ratelimit.NewConn(c.Conn,
+		[]*ratelimit.Limiter{c.download, l.download, t.DownloadLimiter},
+		[]*ratelimit.Limiter{c.upload, l.upload, t.UploadLimiter},
+	)
+}
@@ -19,8 +19,16 @@ const (
 	MsgRequest       messageID = 6
 	MsgPiece         messageID = 7
 	MsgCancel        messageID = 8
+	MsgExtended      messageID = 20 //扩展协议(BEP 10)
+	MsgHashRequest   messageID = 21 //请求v2 merkle树中的哈希(BEP 52)
+	MsgHashes        messageID = 22
+	MsgHashReject    messageID = 23
 )
 
+// MaxMessageLength 接受的最大消息长度，piece、hashes 以及扩展消息都远小于该长度，
+// bitfield 可以容纳约800万个piece，对方声明更长的消息时返回错误，避免被迫分配大量内存
+const MaxMessageLength = 1 << 20
+
 // Message 中间字段给出message信息
 type Message struct {
 	ID      messageID
@@ -51,13 +59,16 @@ func Read(r io.Reader) (*Message, error) {
 	var lengthBuf = make([]byte, 4)
 	_, err := io.ReadFull(r, lengthBuf)
 	if err != nil {
-		return nil, nil
+		return nil, err
 	}
 	length := binary.BigEndian.Uint32(lengthBuf)
 	if length == 0 {
 		// keep-alive message
 		return nil, nil
 	}
+	if length > MaxMessageLength {
+		return nil, fmt.Errorf("Message length %d exceeds limit of %d", length, MaxMessageLength)
+	}
 	message := make([]byte, length)
 
 	_, err = io.ReadFull(r, message)
@@ -94,6 +105,14 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgExtended:
+		return "Extended"
+	case MsgHashRequest:
+		return "HashRequest"
+	case MsgHashes:
+		return "Hashes"
+	case MsgHashReject:
+		return "HashReject"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
@@ -127,6 +146,29 @@ func FormatRequest(index, begin, length int) *Message {
 	return msg
 }
 
+// FormatPiece 构建携带一个block数据的piece消息
+func FormatPiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
+// ParseRequest parses a REQUEST message
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if msg.ID != MsgRequest {
+		return 0, 0, 0, fmt.Errorf("Expected REQUEST (ID %d), got ID %d", MsgRequest, msg.ID)
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("Expected payload length 12, got length %d", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
 // ParseHave parses a HAVE message
 func ParseHave(msg *Message) (int, error) {
 	//解析haveMsg ,获取peer拥有的index序号
@@ -167,3 +209,84 @@ func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	copy(buf[begin:], data)
 	return len(data), nil
 }
+
+// HashRequest hash request、hashes以及hash reject消息共同的头部
+// 请求 PiecesRoot 对应文件merkle树第 BaseLayer 层（叶子为第0层）从 Index 开始的 Length 个哈希，
+// 以及验证它们所需的 ProofLayers 层兄弟节点
+type HashRequest struct {
+	PiecesRoot  [32]byte
+	BaseLayer   int
+	Index       int
+	Length      int
+	ProofLayers int
+}
+
+const hashRequestLength = 48
+
+func formatHashRequest(id messageID, req HashRequest, extra int) *Message {
+	payload := make([]byte, hashRequestLength, hashRequestLength+extra)
+	copy(payload[0:32], req.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:36], uint32(req.BaseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(req.Index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(req.Length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(req.ProofLayers))
+	return &Message{ID: id, Payload: payload}
+}
+
+// FormatHashRequest 构建hash request消息
+func FormatHashRequest(req HashRequest) *Message {
+	return formatHashRequest(MsgHashRequest, req, 0)
+}
+
+// FormatHashReject 构建hash reject消息
+func FormatHashReject(req HashRequest) *Message {
+	return formatHashRequest(MsgHashReject, req, 0)
+}
+
+// FormatHashes 构建hashes消息，hashes 为请求的哈希，后接由下至上的兄弟节点
+func FormatHashes(req HashRequest, hashes [][32]byte) *Message {
+	msg := formatHashRequest(MsgHashes, req, len(hashes)*32)
+	for _, h := range hashes {
+		msg.Payload = append(msg.Payload, h[:]...)
+	}
+	return msg
+}
+
+// ParseHashRequest 解析hash request或hash reject消息
+func ParseHashRequest(msg *Message) (HashRequest, error) {
+	var req HashRequest
+	if msg.ID != MsgHashRequest && msg.ID != MsgHashReject {
+		return req, fmt.Errorf("Expected HASH REQUEST (ID %d), got ID %d", MsgHashRequest, msg.ID)
+	}
+	if len(msg.Payload) != hashRequestLength {
+		return req, fmt.Errorf("Expected payload length %d, got length %d", hashRequestLength, len(msg.Payload))
+	}
+	return parseHashHeader(msg.Payload), nil
+}
+
+// ParseHashes 解析hashes消息
+func ParseHashes(msg *Message) (HashRequest, [][32]byte, error) {
+	if msg.ID != MsgHashes {
+		return HashRequest{}, nil, fmt.Errorf("Expected HASHES (ID %d), got ID %d", MsgHashes, msg.ID)
+	}
+	if len(msg.Payload) < hashRequestLength || (len(msg.Payload)-hashRequestLength)%32 != 0 {
+		return HashRequest{}, nil, fmt.Errorf("Malformed hashes payload of length %d", len(msg.Payload))
+	}
+	req := parseHashHeader(msg.Payload)
+	data := msg.Payload[hashRequestLength:]
+	hashes := make([][32]byte, len(data)/32)
+	for i := range hashes {
+		copy(hashes[i][:], data[i*32:])
+	}
+	return req, hashes, nil
+}
+
+func parseHashHeader(payload []byte) HashRequest {
+	var req HashRequest
+	copy(req.PiecesRoot[:], payload[0:32])
+	req.BaseLayer = int(binary.BigEndian.Uint32(payload[32:36]))
+	req.Index = int(binary.BigEndian.Uint32(payload[36:40]))
+	req.Length = int(binary.BigEndian.Uint32(payload[40:44]))
+	req.ProofLayers = int(binary.BigEndian.Uint32(payload[44:48]))
+	return req
+}
@@ -0,0 +1,43 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestReadMessage(t *testing.T) {
+	msg := &Message{ID: MsgPiece, Payload: bytes.Repeat([]byte{1}, MaxBlockSize+8)}
+	got, err := Read(bytes.NewReader(msg.Serialize()))
+	if err != nil || got.ID != MsgPiece || !bytes.Equal(got.Payload, msg.Payload) {
+		t.Fatalf("Read = %v, %v", got, err)
+	}
+	got, err = Read(bytes.NewReader((*Message)(nil).Serialize()))
+	if err != nil || got != nil {
+		t.Fatalf("keep-alive: %v, %v", got, err)
+	}
+
+	tests := []struct {
+		length uint32
+		ok     bool
+	}{
+		{MaxMessageLength, true},
+		{MaxMessageLength + 1, false},
+		{0xFFFFFFFF, false},
+	}
+	for _, tt := range tests {
+		var prefix [4]byte
+		binary.BigEndian.PutUint32(prefix[:], tt.length)
+		//只有声明的长度合法时才会读取消息体
+		r := io.MultiReader(bytes.NewReader(prefix[:]), bytes.NewReader(make([]byte, MaxMessageLength)))
+		_, err := Read(r)
+		if (err == nil) != tt.ok {
+			t.Errorf("Read with length %d: error %v, want accepted %v", tt.length, err, tt.ok)
+		}
+	}
+
+	if _, err := Read(bytes.NewReader([]byte{0, 0, 0, 5, 7})); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated message: %v, want io.ErrUnexpectedEOF", err)
+	}
+}
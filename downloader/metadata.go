@@ -0,0 +1,236 @@
+package downloader
+
+import (
+	"bitDownloader/bencode"
+	"bitDownloader/handshake"
+	"bitDownloader/peer"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+//通过扩展协议(BEP 10)以及 ut_metadata(BEP 9)获取磁力链接缺失的info字典
+
+// MetadataPieceSize ut_metadata 每个分块的大小
+const MetadataPieceSize = 16384
+
+// MaxMetadataSize 接受的最大info字典长度，避免恶意peer声明过大的长度
+const MaxMetadataSize = 16 << 20
+
+//本地为 ut_metadata 分配的扩展消息编号
+const utMetadataID = 1
+
+//同时尝试获取元数据的peer数量
+const metadataWorkers = 8
+
+// ErrNoMetadata 全部peer都无法提供元数据
+var ErrNoMetadata = errors.New("No peer provided metadata")
+
+// FetchMetadata 从 peers 获取 infoHash 对应的info字典，同时尝试多个peer
+// 返回第一个通过infohash校验的bencode数据，d 为空时直接连接peer
+// infoHash 可以是v1 infohash或截断的v2 infohash
+func FetchMetadata(ctx context.Context, d Dialer, peers []peer.Peer, peerID, infoHash [20]byte) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sem := make(chan struct{}, metadataWorkers)
+	results := make(chan []byte, len(peers))
+	errs := make(chan error, len(peers))
+	for _, p := range peers {
+		go func(p peer.Peer) {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+			info, err := fetchMetadataFrom(ctx, d, p, peerID, infoHash)
+			if err != nil {
+				log.Printf("Could not fetch metadata from %s: %v\n", p, err)
+				errs <- err
+				return
+			}
+			results <- info
+		}(p)
+	}
+
+	for failed := 0; failed < len(peers); {
+		select {
+		case info := <-results:
+			return info, nil
+		case <-errs:
+			failed++
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, ErrNoMetadata
+}
+
+//从单个peer获取元数据
+func fetchMetadataFrom(ctx context.Context, d Dialer, p peer.Peer, peerID, infoHash [20]byte) ([]byte, error) {
+	conn, err := dial(ctx, d, p)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	//ctx 取消时关闭连接以打断阻塞的读取
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	conn.SetDeadline(time.Now().Add(time.Second * 30))
+
+	h := handshake.New(infoHash, peerID)
+	h.Reserved[handshake.ExtensionBit] |= 0x10
+	if _, err := conn.Write(h.Serialize()); err != nil {
+		return nil, err
+	}
+	res, err := handshake.Read(conn)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(res.InfoHash[:], infoHash[:]) {
+		return nil, fmt.Errorf("Expected infohash %x but got %x", infoHash, res.InfoHash)
+	}
+	if !res.SupportsExtensions() {
+		return nil, errors.New("Peer does not support extensions")
+	}
+
+	err = sendExtended(conn, 0, map[string]interface{}{
+		"m": map[string]interface{}{"ut_metadata": utMetadataID},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		buf      []byte
+		received []bool
+		left     int
+	)
+	for {
+		msg, err := Read(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		//只关心扩展消息，其余消息忽略
+		if msg == nil || msg.ID != MsgExtended || len(msg.Payload) == 0 {
+			continue
+		}
+		dict, data, err := parseExtended(msg.Payload[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg.Payload[0] {
+		case 0:
+			//扩展握手，得到对方的 ut_metadata 编号以及元数据长度
+			if buf != nil {
+				continue
+			}
+			m, _ := dict["m"].(map[string]interface{})
+			remoteID, ok := toInt(m["ut_metadata"])
+			if !ok || remoteID <= 0 || remoteID > 255 {
+				return nil, errors.New("Peer does not support ut_metadata")
+			}
+			size, ok := toInt(dict["metadata_size"])
+			if !ok || size <= 0 || size > MaxMetadataSize {
+				return nil, fmt.Errorf("Invalid metadata size %d", size)
+			}
+			buf = make([]byte, size)
+			left = (size + MetadataPieceSize - 1) / MetadataPieceSize
+			received = make([]bool, left)
+			for i := 0; i < left; i++ {
+				err := sendExtended(conn, byte(remoteID), map[string]interface{}{"msg_type": 0, "piece": i})
+				if err != nil {
+					return nil, err
+				}
+			}
+		case utMetadataID:
+			if buf == nil {
+				return nil, errors.New("Received metadata before extension handshake")
+			}
+			msgType, _ := toInt(dict["msg_type"])
+			index, ok := toInt(dict["piece"])
+			if !ok || index < 0 || index >= len(received) {
+				return nil, fmt.Errorf("Invalid metadata piece %d", index)
+			}
+			switch msgType {
+			case 1:
+				begin := index * MetadataPieceSize
+				end := begin + MetadataPieceSize
+				if end > len(buf) {
+					end = len(buf)
+				}
+				if len(data) != end-begin {
+					return nil, fmt.Errorf("Expected metadata piece of length %d but got %d", end-begin, len(data))
+				}
+				if received[index] {
+					continue
+				}
+				copy(buf[begin:end], data)
+				received[index] = true
+				left--
+			case 2:
+				return nil, fmt.Errorf("Peer rejected metadata piece %d", index)
+			}
+			if left == 0 {
+				hash, hashV2 := sha1.Sum(buf), sha256.Sum256(buf)
+				if !bytes.Equal(hash[:], infoHash[:]) && !bytes.Equal(hashV2[:20], infoHash[:]) {
+					return nil, errors.New("Metadata failed integrity check")
+				}
+				return buf, nil
+			}
+		}
+	}
+}
+
+//发送扩展消息，id 为对方分配的扩展编号，0 表示扩展握手
+func sendExtended(w io.Writer, id byte, v interface{}) error {
+	dict, err := bencode.Marshal(v)
+	if err != nil {
+		return err
+	}
+	msg := Message{ID: MsgExtended, Payload: append([]byte{id}, dict...)}
+	_, err = w.Write(msg.Serialize())
+	return err
+}
+
+//解析扩展消息中的bencode字典，返回字典之后的原始数据
+func parseExtended(payload []byte) (map[string]interface{}, []byte, error) {
+	//ut_metadata 的数据块紧跟在字典之后，部分客户端输出的字典没有排序
+	d := bencode.NewDecoder(bytes.NewReader(payload))
+	d.AllowUnsortedKeys()
+	var dict map[string]interface{}
+	if err := d.Decode(&dict); err != nil {
+		return nil, nil, err
+	}
+	return dict, payload[d.InputOffset():], nil
+}
+
+//bencode整数解码后为int64
+func toInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int64:
+		return int(n), true
+	case int:
+		return n, true
+	}
+	return 0, false
+}
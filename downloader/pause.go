@@ -0,0 +1,177 @@
+package downloader
+
+import (
+	"bitDownloader/peer"
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+//一次正在进行的下载，记录全部worker以及已经建立的连接
+type run struct {
+	ctx     context.Context
+	picker  *piecePicker
+	results chan *pieceResult
+	exits   chan struct{} //有worker退出时通知下载主循环
+	wake    chan struct{} //唤醒连接管理
+	workers int32
+	seed    bool //做种时只接受传入连接
+	wg      sync.WaitGroup
+
+	//以下字段由 Torrent.mu 保护
+	connCtx    context.Context //worker使用的ctx，断开式暂停时取消
+	connCancel context.CancelFunc
+	clients    map[string]*Client //已经连接或正在连接的peer，握手完成前为nil
+	pool       *peerPool
+	webSeeds   []*webSeed
+}
+
+func newRun(ctx context.Context, picker *piecePicker) *run {
+	r := &run{
+		ctx:     ctx,
+		picker:  picker,
+		results: make(chan *pieceResult),
+		exits:   make(chan struct{}, 1),
+		wake:    make(chan struct{}, 1),
+		clients: make(map[string]*Client),
+		pool:    newPeerPool(),
+	}
+	r.connCtx, r.connCancel = context.WithCancel(ctx)
+	return r
+}
+
+//仍在运行的worker数量
+func (r *run) active() int {
+	return int(atomic.LoadInt32(&r.workers))
+}
+
+//在下载的生命周期内为peer运行 fn，调用者需持有 t.mu
+func (t *Torrent) spawn(r *run, p peer.Peer, fn func(ctx context.Context)) {
+	r.clients[p.String()] = nil
+	r.goWorker(func(ctx context.Context) {
+		fn(ctx)
+		t.mu.Lock()
+		delete(r.clients, p.String())
+		t.mu.Unlock()
+	})
+}
+
+//运行计入活跃数量的worker，退出时通知下载主循环，调用者需持有 t.mu
+func (r *run) goWorker(fn func(ctx context.Context)) {
+	r.wg.Add(1)
+	atomic.AddInt32(&r.workers, 1)
+	go func(ctx context.Context) {
+		defer r.wg.Done()
+		fn(ctx)
+		atomic.AddInt32(&r.workers, -1)
+		select {
+		case r.exits <- struct{}{}:
+		default:
+		}
+	}(r.connCtx)
+}
+
+// Paused 是否处于暂停状态
+func (t *Torrent) Paused() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.paused
+}
+
+// Pause 暂停下载，不再向peer请求数据，已经通过校验的piece以及选择器状态均被保留
+// DisconnectOnPause 为真时断开全部连接，否则保持连接并choke全部peer
+// 正在下载的piece会在完成后停止，断开连接时则被放回选择器
+func (t *Torrent) Pause() {
+	picker := t.getPicker()
+	t.mu.Lock()
+	if t.paused {
+		t.mu.Unlock()
+		return
+	}
+	t.paused = true
+	r := t.run
+	var clients []*Client
+	var cancel context.CancelFunc
+	if r != nil {
+		if t.DisconnectOnPause {
+			cancel = r.connCancel
+			r.connCtx, r.connCancel = context.WithCancel(r.ctx)
+		} else {
+			for _, c := range r.clients {
+				if c != nil {
+					clients = append(clients, c)
+				}
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	picker.pause(true)
+	if cancel != nil {
+		cancel()
+		//唤醒等待任务的worker使其退出
+		picker.cond.Broadcast()
+	}
+	for _, c := range clients {
+		c.SendChoke()
+		c.SendNotInterested()
+	}
+	log.Println("Paused", t.Name)
+}
+
+// Resume 恢复下载，重新向tracker汇报 started 获取最新的peers并连接尚未连接的peer
+// tracker请求失败时仍会使用已知的peers恢复下载，并返回该错误
+func (t *Torrent) Resume(ctx context.Context) error {
+	picker := t.getPicker()
+	t.mu.Lock()
+	if !t.paused {
+		t.mu.Unlock()
+		return nil
+	}
+	t.paused = false
+	r := t.run
+	var clients []*Client
+	if r != nil {
+		for _, c := range r.clients {
+			if c != nil {
+				clients = append(clients, c)
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	for _, c := range clients {
+		c.SendUnchoke()
+		c.SendInterested()
+	}
+	picker.pause(false)
+	log.Println("Resumed", t.Name)
+
+	if _, err := t.Announce(ctx, EventStarted); err != nil {
+		//仍然使用已知的peers恢复下载
+		t.mu.Lock()
+		known := t.Peers
+		t.mu.Unlock()
+		if r != nil && !r.seed {
+			t.connect(r, known)
+		}
+		return err
+	}
+	return nil
+}
+
+//合并peer列表，去除重复地址
+func mergePeers(a, b []peer.Peer) []peer.Peer {
+	seen := make(map[string]bool, len(a))
+	merged := make([]peer.Peer, 0, len(a)+len(b))
+	for _, list := range [][]peer.Peer{a, b} {
+		for _, p := range list {
+			if !seen[p.String()] {
+				seen[p.String()] = true
+				merged = append(merged, p)
+			}
+		}
+	}
+	return merged
+}
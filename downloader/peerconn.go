@@ -0,0 +1,340 @@
+package downloader
+
+import (
+	"bitDownloader/handshake"
+	"bitDownloader/peer"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// PeerTimeout 超过该时间没有收到任何消息（包括keep-alive）则断开连接
+const PeerTimeout = 3 * time.Minute
+
+// MaxRequestLength 响应对方请求时允许的最大block长度
+const MaxRequestLength = 128 * 1024
+
+// ErrTooManyConns 达到连接数限制，拒绝新的连接
+var ErrTooManyConns = errors.New("Too many connections")
+
+//与一个已经完成握手的peer交换数据，返回从该peer下载的piece数量
+//读取循环负责接收消息并响应对方的请求，当前协程负责从选择器中取出piece进行下载
+func (t *Torrent) runPeer(ctx context.Context, r *run, c *Client) (pieces int) {
+	picker, results := r.picker, r.results
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	t.limitConn(c)
+	defer c.Conn.Close()
+
+	t.mu.Lock()
+	r.clients[c.peer.String()] = c
+	paused := t.paused
+	t.mu.Unlock()
+
+	go func() {
+		t.readLoop(r, c)
+		//对方断开连接，唤醒可能正在等待任务的下载
+		cancel()
+		picker.cond.Broadcast()
+	}()
+	go t.watchPeer(ctx, r, c)
+	//关闭连接使阻塞中的读取立即返回，空闲时定期发送keep-alive
+	go func() {
+		ticker := time.NewTicker(KeepAliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				c.Conn.Close()
+				return
+			case <-ticker.C:
+				c.SendKeepAlive()
+			}
+		}
+	}()
+
+	//告知对方我们已经拥有的piece
+	if bf := t.haveBitfield(); bf != nil {
+		c.SendBitfield(bf)
+	}
+	//向支持v2的peer请求缺失的piece layer
+	t.requestLayers(c)
+	//发送unbolck ，interested消息
+	if !paused {
+		c.SendUnchoke()
+		c.SendInterested()
+	}
+
+	//接下来要由选择器中不断取出该peer拥有的piece并进行下载
+	ban := t.getBan()
+	has := func(index int) bool { return t.canDownload(r, ban, c, index) }
+	for {
+		work := picker.next(ctx, has)
+		if work == nil {
+			//下载结束或连接断开
+			return
+		}
+		//尝试开始下载
+		buf, err := attemptDownloadPiece(ctx, c, work)
+
+		//下载失败，此时不应该再向该peer请求
+		if err != nil {
+			picker.put(work)
+			return
+		}
+
+		//检查下载数据的完整性
+		err = t.checkIntegrity(work, buf)
+
+		//校验失败，记录发送者，之后优先由其他peer重新下载
+		if err != nil {
+			log.Printf("Piece #%d from %s failed integrity check\n", work.index, c.peer)
+			strikes := ban.failedPiece(work.index, c.peer)
+			picker.put(work)
+			if strikes >= MaxHashStrikes {
+				t.banPeer(r, c.peer.String(), fmt.Sprintf("%d pieces failed integrity check", strikes))
+			}
+			continue
+		}
+		//封禁之前发送过该piece错误数据的peer
+		for _, bad := range ban.verified(work.index) {
+			t.banPeer(r, bad, fmt.Sprintf("sent corrupt data for piece #%d", work.index))
+		}
+
+		//将结果添加至结果队列
+		result := &pieceResult{
+			index: work.index,
+			buf:   buf,
+		}
+		select {
+		case results <- result:
+			pieces++
+		case <-ctx.Done():
+			picker.put(work)
+			return
+		}
+	}
+}
+
+//持续读取对方的消息，连接出错或超时后返回
+func (t *Torrent) readLoop(r *run, c *Client) {
+	defer close(c.done)
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(PeerTimeout))
+		msg, err := c.Read()
+		if err != nil {
+			return
+		}
+		if msg == nil { // keep-alive
+			continue
+		}
+		switch msg.ID {
+		case MsgChoke:
+			c.setChoked(true)
+		case MsgUnchoke:
+			c.setChoked(false)
+		case MsgInterested:
+			c.mu.Lock()
+			c.interested = true
+			c.mu.Unlock()
+		case MsgNotInterested:
+			c.mu.Lock()
+			c.interested = false
+			c.mu.Unlock()
+		case MsgHave:
+			//标识存在该piece
+			index, err := ParseHave(msg)
+			if err != nil {
+				return
+			}
+			c.setPiece(index)
+			r.picker.cond.Broadcast()
+		case MsgBitfield:
+			c.setBitfield(msg.Payload)
+			r.picker.cond.Broadcast()
+		case MsgRequest:
+			if err := t.serveRequest(c, msg); err != nil {
+				log.Printf("Disconnecting %s: %v\n", c.peer, err)
+				return
+			}
+		case MsgPiece:
+			c.touch()
+			//交给正在下载的协程，没有在下载时丢弃
+			select {
+			case c.pieces <- msg:
+			default:
+			}
+		case MsgHashRequest:
+			if err := t.serveHashRequest(c, msg); err != nil {
+				log.Printf("Disconnecting %s: %v\n", c.peer, err)
+				return
+			}
+		case MsgHashes:
+			complete, err := t.receiveHashes(msg)
+			if err != nil {
+				log.Printf("Disconnecting %s: %v\n", c.peer, err)
+				return
+			}
+			//获取到piece layer后之前无法校验的piece可以开始下载
+			if complete {
+				r.picker.cond.Broadcast()
+			}
+		case MsgHashReject:
+			//对方无法提供该piece layer，等待其他支持v2的peer
+		}
+	}
+}
+
+//响应对方的请求，choke了对方、处于暂停状态或者没有该piece时忽略
+func (t *Torrent) serveRequest(c *Client, msg *Message) error {
+	index, begin, length, err := ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(t.PieceHashes) {
+		return fmt.Errorf("Requested piece #%d out of range", index)
+	}
+	pieceBegin, pieceEnd := t.calculateBoundsForPiece(index)
+	if length <= 0 || length > MaxRequestLength || begin < 0 || pieceBegin+begin+length > pieceEnd {
+		return fmt.Errorf("Invalid request for piece #%d [%d, %d)", index, begin, begin+length)
+	}
+
+	c.mu.Lock()
+	choking := c.amChoking
+	c.mu.Unlock()
+	t.mu.Lock()
+	storage, picker, paused := t.storage, t.picker, t.paused
+	t.mu.Unlock()
+	if choking || paused || storage == nil || picker == nil || !picker.has(index) {
+		return nil
+	}
+
+	block := make([]byte, length)
+	if _, err := storage.ReadAt(block, int64(pieceBegin+begin)); err != nil {
+		log.Printf("Could not read piece #%d for upload: %v\n", index, err)
+		return nil
+	}
+	if err := c.SendPiece(index, begin, block); err != nil {
+		return err
+	}
+	c.touch()
+	t.mu.Lock()
+	t.uploaded += int64(length)
+	t.mu.Unlock()
+	return nil
+}
+
+//已经拥有的piece，一个都没有时返回nil
+func (t *Torrent) haveBitfield() BitField {
+	picker := t.getPicker()
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	for _, b := range picker.have {
+		if b != 0 {
+			return append(BitField(nil), picker.have...)
+		}
+	}
+	return nil
+}
+
+//通知全部已连接的peer我们拥有了新的piece
+func (t *Torrent) broadcastHave(r *run, index int) {
+	t.mu.Lock()
+	var clients []*Client
+	for _, c := range r.clients {
+		if c != nil {
+			clients = append(clients, c)
+		}
+	}
+	t.mu.Unlock()
+	for _, c := range clients {
+		c.SendHave(index)
+	}
+}
+
+// NumPeers 当前已经建立连接的peer数量
+func (t *Torrent) NumPeers() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.run == nil {
+		return 0
+	}
+	n := 0
+	for _, c := range t.run.clients {
+		if c != nil {
+			n++
+		}
+	}
+	return n
+}
+
+//连接对端的地址，TCP以及uTP连接分别使用 *net.TCPAddr 以及 *net.UDPAddr
+func remotePeer(conn net.Conn) (peer.Peer, error) {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return peer.Peer{Ip: addr.IP, Port: uint16(addr.Port)}, nil
+	case *net.UDPAddr:
+		return peer.Peer{Ip: addr.IP, Port: uint16(addr.Port)}, nil
+	}
+	return peer.Peer{}, fmt.Errorf("Unsupported remote address %s", conn.RemoteAddr())
+}
+
+// AddConn 接管一个传入连接，调用者已经读取了对方的握手消息 h
+// 混合种子的peer可以使用v1或v2 infohash，我们的握手使用对方的infohash回复
+// 只有在下载或做种时才能接受连接，失败时由调用者关闭连接
+func (t *Torrent) AddConn(conn net.Conn, h *handshake.Handshake) error {
+	if !t.matchesInfoHash(h.InfoHash) {
+		return fmt.Errorf("Unexpected infohash %x", h.InfoHash)
+	}
+	p, err := remotePeer(conn)
+	if err != nil {
+		return err
+	}
+	if t.getBan().isBanned(p.Ip) {
+		return fmt.Errorf("Peer %s is banned", p.Ip)
+	}
+	if blocked, rng := t.IPFilter.Blocked(p.Ip); blocked {
+		return fmt.Errorf("Peer %s is blocked by IP filter (%s)", p.Ip, rng.Description)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := t.run
+	if r == nil {
+		return errors.New("Torrent is not running")
+	}
+	if _, ok := r.clients[p.String()]; ok {
+		return fmt.Errorf("Already connected to %s", p)
+	}
+	if t.ConnLimit != nil {
+		select {
+		case t.ConnLimit <- struct{}{}:
+		default:
+			return ErrTooManyConns
+		}
+	}
+
+	reply := t.newHandshake(h.InfoHash)
+	conn.SetWriteDeadline(time.Now().Add(time.Second * 3))
+	_, err = conn.Write(reply.Serialize())
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		if t.ConnLimit != nil {
+			<-t.ConnLimit
+		}
+		return err
+	}
+
+	c := newClient(conn, p, NewBitField(len(t.PieceHashes)), h.InfoHash, t.PeerID)
+	c.v2 = h.SupportsV2()
+	t.spawn(r, p, func(ctx context.Context) {
+		if t.ConnLimit != nil {
+			defer func() { <-t.ConnLimit }()
+		}
+		t.runPeer(ctx, r, c)
+	})
+	return nil
+}
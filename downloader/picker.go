@@ -0,0 +1,334 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// Priority 文件以及piece的下载优先级，零值为普通优先级
+type Priority int8
+
+const (
+	PriorityOff    Priority = -2 //不下载
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityOff:
+		return "off"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("Priority(%d)", int8(p))
+	}
+}
+
+// ParsePriority 解析 off/low/normal/high
+func ParsePriority(s string) (Priority, error) {
+	for _, p := range []Priority{PriorityOff, PriorityLow, PriorityNormal, PriorityHigh} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return PriorityNormal, fmt.Errorf("Unknown priority %q", s)
+}
+
+// piecePriorities 根据文件优先级计算每个piece的优先级
+// 与多个文件重叠的piece取其中最高的优先级，只有全部文件都跳过时piece才不会被下载
+func (t *Torrent) piecePriorities() []Priority {
+	priority := make([]Priority, len(t.PieceHashes))
+	for i := range priority {
+		priority[i] = PriorityOff
+	}
+	offset := 0
+	for _, f := range t.files() {
+		if f.Length > 0 && !f.Padding {
+			first := offset / t.PieceLength
+			last := (offset + f.Length - 1) / t.PieceLength
+			for index := first; index <= last; index++ {
+				if f.Priority > priority[index] {
+					priority[index] = f.Priority
+				}
+			}
+		}
+		offset += f.Length
+	}
+	return priority
+}
+
+//按照优先级分发piece下载任务，取代原先的FIFO工作队列
+//读取位置附近窗口内的piece最为紧急，其次按照优先级，顺序模式下相同优先级按下标顺序，否则随机
+type piecePicker struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	works      []*pieceWork
+	priority   []Priority
+	have       BitField
+	active     []bool //正在被某个peer下载
+	rank       []int  //非顺序模式下相同优先级piece的随机次序
+	sequential bool
+	paused     bool
+	windows    map[int][2]int //读取窗口 [first, last]
+	nextWindow int
+	closed     bool
+	update     chan struct{} //需要下载的piece发生变化时通知下载主循环
+	changed    chan struct{} //有piece完成或选择器关闭时关闭并替换，供读取者等待
+}
+
+func newPiecePicker(t *Torrent) *piecePicker {
+	p := &piecePicker{
+		works:      make([]*pieceWork, len(t.PieceHashes)),
+		priority:   t.piecePriorities(),
+		have:       t.Bitfield,
+		active:     make([]bool, len(t.PieceHashes)),
+		rank:       rand.Perm(len(t.PieceHashes)),
+		sequential: t.Sequential,
+		paused:     t.paused,
+		windows:    make(map[int][2]int),
+		update:     make(chan struct{}, 1),
+		changed:    make(chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	for index, hash := range t.PieceHashes {
+		p.works[index] = &pieceWork{
+			index:  index,
+			hash:   hash,
+			length: t.calculatePieceSize(index), //需要计算开始结束边界
+		}
+	}
+	return p
+}
+
+//获取种子的piece选择器，不存在时创建
+func (t *Torrent) getPicker() *piecePicker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Bitfield == nil {
+		t.Bitfield = NewBitField(len(t.PieceHashes))
+	}
+	if t.picker == nil {
+		t.picker = newPiecePicker(t)
+	}
+	return t.picker
+}
+
+//是否位于某个读取窗口内，调用者需持有锁
+func (p *piecePicker) urgent(index int) bool {
+	for _, w := range p.windows {
+		if index >= w[0] && index <= w[1] {
+			return true
+		}
+	}
+	return false
+}
+
+//是否还需要下载该piece，读取窗口内的piece即使文件被跳过也需要下载，调用者需持有锁
+func (p *piecePicker) wanted(index int) bool {
+	if p.have.HasPiece(index) {
+		return false
+	}
+	return p.priority[index] > PriorityOff || p.urgent(index)
+}
+
+//a 是否比 b 更应该先下载，调用者需持有锁
+func (p *piecePicker) before(a, b int) bool {
+	ua, ub := p.urgent(a), p.urgent(b)
+	if ua != ub {
+		return ua
+	}
+	if ua {
+		return a < b
+	}
+	if p.priority[a] != p.priority[b] {
+		return p.priority[a] > p.priority[b]
+	}
+	if p.sequential {
+		return a < b
+	}
+	return p.rank[a] < p.rank[b]
+}
+
+// next 为拥有 has 中piece的peer挑选下一个任务
+// 暂时没有可下载的piece或处于暂停状态时阻塞，关闭或 ctx 取消后返回nil
+// ctx 取消后需要调用 cond.Broadcast 唤醒
+func (p *piecePicker) next(ctx context.Context, has func(index int) bool) *pieceWork {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for !p.closed && ctx.Err() == nil {
+		if p.paused {
+			p.cond.Wait()
+			continue
+		}
+		best := -1
+		for index := range p.works {
+			if !p.wanted(index) || p.active[index] || !has(index) {
+				continue
+			}
+			if best < 0 || p.before(index, best) {
+				best = index
+			}
+		}
+		if best >= 0 {
+			p.active[best] = true
+			return p.works[best]
+		}
+		p.cond.Wait()
+	}
+	return nil
+}
+
+//是否已经拥有该piece
+func (p *piecePicker) has(index int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.have.HasPiece(index)
+}
+
+// put 下载失败，将任务放回
+func (p *piecePicker) put(work *pieceWork) {
+	p.mu.Lock()
+	p.active[work.index] = false
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// done piece已经写入存储并通过校验
+func (p *piecePicker) done(index int) {
+	p.mu.Lock()
+	p.active[index] = false
+	p.have.SetPiece(index)
+	p.notifyLocked()
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+//唤醒等待piece的读取者，调用者需持有锁
+func (p *piecePicker) notifyLocked() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// wait 返回piece是否已经完成，未完成时同时返回一个在状态变化时关闭的channel
+func (p *piecePicker) wait(index int) (bool, <-chan struct{}, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.have.HasPiece(index), p.changed, p.closed
+}
+
+// remaining 仍需下载的piece数量
+func (p *piecePicker) remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for index := range p.works {
+		if p.wanted(index) {
+			n++
+		}
+	}
+	return n
+}
+
+//需要下载的piece发生变化，唤醒等待中的worker以及下载主循环
+func (p *piecePicker) signal() {
+	p.cond.Broadcast()
+	select {
+	case p.update <- struct{}{}:
+	default:
+	}
+}
+
+//更新piece优先级
+func (p *piecePicker) setPriorities(priority []Priority) {
+	p.mu.Lock()
+	p.priority = priority
+	p.mu.Unlock()
+	p.signal()
+}
+
+//创建读取窗口，返回窗口编号
+func (p *piecePicker) addWindow() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextWindow++
+	p.windows[p.nextWindow] = [2]int{-1, -2}
+	return p.nextWindow
+}
+
+//移动读取窗口，[first, last] 内的piece将被优先下载
+func (p *piecePicker) setWindow(id, first, last int) {
+	p.mu.Lock()
+	if last >= len(p.works) {
+		last = len(p.works) - 1
+	}
+	w, ok := p.windows[id]
+	if !ok || w == [2]int{first, last} {
+		p.mu.Unlock()
+		return
+	}
+	p.windows[id] = [2]int{first, last}
+	p.mu.Unlock()
+	p.signal()
+}
+
+func (p *piecePicker) removeWindow(id int) {
+	p.mu.Lock()
+	delete(p.windows, id)
+	p.mu.Unlock()
+	p.signal()
+}
+
+//暂停或恢复分发任务
+func (p *piecePicker) pause(paused bool) {
+	p.mu.Lock()
+	p.paused = paused
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+//开始下载
+func (p *piecePicker) open() {
+	p.mu.Lock()
+	p.closed = false
+	p.mu.Unlock()
+}
+
+//停止下载，唤醒全部worker以及读取者
+func (p *piecePicker) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.notifyLocked()
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// SetFilePriority 修改文件的下载优先级，下载过程中调用会立即影响之后的piece选择
+// 设置为 PriorityOff 的文件不会在磁盘上创建，与其共享边界piece的数据保存在partfile中
+func (t *Torrent) SetFilePriority(index int, priority Priority) error {
+	if index < 0 || index >= len(t.Files) {
+		return fmt.Errorf("File index %d out of range [0, %d)", index, len(t.Files))
+	}
+	t.mu.Lock()
+	t.Files[index].Priority = priority
+	if t.storage != nil {
+		if err := t.storage.setSkipped(index, priority == PriorityOff); err != nil {
+			t.mu.Unlock()
+			return err
+		}
+	}
+	picker, priorities := t.picker, t.piecePriorities()
+	t.mu.Unlock()
+	//选择器分配任务时会获取 t.mu，不能在持有 t.mu 时获取选择器的锁
+	if picker != nil {
+		picker.setPriorities(priorities)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package downloader
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func testFiles(lengths []int, priorities []Priority) []File {
+	fs := make([]File, len(lengths))
+	for i, n := range lengths {
+		fs[i] = File{Path: []string{string(rune('a' + i))}, Length: n}
+		if priorities != nil {
+			fs[i].Priority = priorities[i]
+		}
+	}
+	return fs
+}
+
+func testTorrent(pieceLength int, fs []File) *Torrent {
+	length := 0
+	for _, f := range fs {
+		length += f.Length
+	}
+	return &Torrent{
+		Name:        "t",
+		PieceLength: pieceLength,
+		Length:      length,
+		PieceHashes: make([][20]byte, (length+pieceLength-1)/pieceLength),
+		Files:       fs,
+	}
+}
+
+func TestPiecePriorities(t *testing.T) {
+	const (
+		off  = PriorityOff
+		low  = PriorityLow
+		norm = PriorityNormal
+		high = PriorityHigh
+	)
+	tests := []struct {
+		name       string
+		lengths    []int
+		priorities []Priority
+		want       []Priority
+	}{
+		{"single file", []int{10}, nil, []Priority{norm, norm, norm}},
+		{"aligned", []int{8, 4}, []Priority{high, low}, []Priority{high, high, low}},
+		{"skipped file", []int{8, 4}, []Priority{off, norm}, []Priority{off, off, norm}},
+		//与两个文件重叠的piece取较高的优先级，只有两个文件都跳过时才不下载
+		{"straddling skipped and wanted", []int{6, 9, 7}, []Priority{norm, off, norm},
+			[]Priority{norm, norm, off, norm, norm, norm}},
+		{"straddling low and high", []int{6, 6}, []Priority{low, high}, []Priority{low, high, high}},
+		{"all skipped", []int{6, 6}, []Priority{off, off}, []Priority{off, off, off}},
+		//空文件不影响相邻的piece
+		{"empty file", []int{4, 0, 4}, []Priority{off, high, off}, []Priority{off, off}},
+	}
+	for _, tt := range tests {
+		tor := testTorrent(4, testFiles(tt.lengths, tt.priorities))
+		if got := tor.piecePriorities(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: priorities %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	//padding文件不会被下载
+	fs := testFiles([]int{6, 2, 4}, []Priority{off, norm, off})
+	fs[1].Padding = true
+	if got := testTorrent(4, fs).piecePriorities(); !reflect.DeepEqual(got, []Priority{off, off, off}) {
+		t.Errorf("padding: priorities %v", got)
+	}
+}
+
+//依次取出全部可以下载的piece
+func drain(p *piecePicker, has func(int) bool) []int {
+	var order []int
+	for p.remaining() > len(order) {
+		work := p.next(context.Background(), has)
+		order = append(order, work.index)
+	}
+	return order
+}
+
+func hasAll(int) bool { return true }
+
+func TestPickerOrder(t *testing.T) {
+	//piece 0-1 low, 2-3 off, 4-5 high, 6-7 normal
+	fs := testFiles([]int{8, 8, 8, 8}, []Priority{PriorityLow, PriorityOff, PriorityHigh, PriorityNormal})
+	tor := testTorrent(4, fs)
+	tor.Sequential = true
+	p := tor.getPicker()
+	if got := drain(p, hasAll); !reflect.DeepEqual(got, []int{4, 5, 6, 7, 0, 1}) {
+		t.Errorf("sequential order %v", got)
+	}
+
+	//随机模式下相同优先级内顺序随机，但不会越过优先级
+	tor = testTorrent(4, testFiles([]int{8, 8, 8, 8}, []Priority{PriorityLow, PriorityOff, PriorityHigh, PriorityNormal}))
+	got := drain(tor.getPicker(), hasAll)
+	rank := map[int]int{4: 0, 5: 0, 6: 1, 7: 1, 0: 2, 1: 2}
+	for i := 1; i < len(got); i++ {
+		if rank[got[i-1]] > rank[got[i]] {
+			t.Fatalf("random order %v crosses priorities", got)
+		}
+	}
+	if len(got) != 6 {
+		t.Fatalf("random order %v", got)
+	}
+
+	//读取窗口内的piece最先下载，即使文件被跳过
+	tor = testTorrent(4, testFiles([]int{8, 8, 8, 8}, []Priority{PriorityLow, PriorityOff, PriorityHigh, PriorityNormal}))
+	tor.Sequential = true
+	p = tor.getPicker()
+	id := p.addWindow()
+	p.setWindow(id, 2, 3)
+	if got := drain(p, hasAll); !reflect.DeepEqual(got, []int{2, 3, 4, 5, 6, 7, 0, 1}) {
+		t.Errorf("order with window %v", got)
+	}
+}
+
+func TestPickerStates(t *testing.T) {
+	tor := testTorrent(4, testFiles([]int{16}, nil))
+	tor.Sequential = true
+	p := tor.getPicker()
+	ctx := context.Background()
+
+	//只分配对方拥有的piece
+	odd := func(index int) bool { return index%2 == 1 }
+	if w := p.next(ctx, odd); w.index != 1 || w.length != 4 {
+		t.Fatalf("next = %+v, want piece 1", w)
+	}
+	//正在下载的piece不会再次分配
+	w3 := p.next(ctx, odd)
+	if w3.index != 3 {
+		t.Fatalf("next = %d, want 3", w3.index)
+	}
+	//下载失败放回后可以再次分配，完成的piece不再分配
+	p.put(w3)
+	p.done(1)
+	if w := p.next(ctx, odd); w.index != 3 {
+		t.Fatalf("next after put = %d, want 3", w.index)
+	}
+	if n := p.remaining(); n != 3 || !p.has(1) {
+		t.Errorf("remaining = %d", n)
+	}
+
+	//没有可分配的piece时阻塞，ctx 取消后返回nil
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if w := p.next(ctx, odd); w != nil {
+		t.Errorf("next after cancel = %+v", w)
+	}
+	//修改文件优先级立即影响分配
+	if err := tor.SetFilePriority(0, PriorityOff); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.remaining(); n != 0 {
+		t.Errorf("remaining = %d after skipping the file", n)
+	}
+	if err := tor.SetFilePriority(1, PriorityOff); err == nil {
+		t.Error("file index out of range accepted")
+	}
+}
@@ -0,0 +1,202 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultReadahead 读取位置之后优先下载的字节数
+const DefaultReadahead = 8 << 20 //8M
+
+// Reader 在下载过程中读取种子中的单个文件，实现 io.ReadSeeker 以及 io.ReaderAt
+// 读取会阻塞直到所需piece完成校验，读取位置之后 readahead 字节内的piece会被优先下载
+type Reader struct {
+	t       *Torrent
+	storage *Storage
+	picker  *piecePicker
+	offset  int //文件在种子连续数据中的偏移
+	length  int
+
+	mu        sync.Mutex
+	ctx       context.Context
+	pos       int
+	readahead int
+	window    int //顺序读取使用的窗口
+}
+
+// NewReader 创建读取第 index 个文件的Reader，需要先调用 OpenStorage
+// 使用完毕后需要调用 Close 释放其占用的下载优先级
+func (t *Torrent) NewReader(index int) (*Reader, error) {
+	files := t.files()
+	if index < 0 || index >= len(files) {
+		return nil, fmt.Errorf("File index %d out of range [0, %d)", index, len(files))
+	}
+	t.mu.Lock()
+	storage := t.storage
+	t.mu.Unlock()
+	if storage == nil {
+		return nil, errors.New("Storage is not opened")
+	}
+	picker := t.getPicker()
+	r := &Reader{
+		t:         t,
+		storage:   storage,
+		picker:    picker,
+		offset:    storage.files[index].offset,
+		length:    files[index].Length,
+		ctx:       context.Background(),
+		readahead: DefaultReadahead,
+		window:    picker.addWindow(),
+	}
+	return r, nil
+}
+
+// SetContext 设置等待piece时使用的context，取消后阻塞中的读取返回 ctx.Err()
+func (r *Reader) SetContext(ctx context.Context) {
+	r.mu.Lock()
+	r.ctx = ctx
+	r.mu.Unlock()
+}
+
+// SetReadahead 设置读取位置之后优先下载的字节数
+func (r *Reader) SetReadahead(n int) {
+	r.mu.Lock()
+	r.readahead = n
+	r.mu.Unlock()
+}
+
+// Length 文件长度
+func (r *Reader) Length() int64 {
+	return int64(r.length)
+}
+
+//移动读取窗口，覆盖文件中 [off, off+n+readahead) 所在的piece
+func (r *Reader) moveWindow(window, off, n, readahead int) {
+	pl := r.t.PieceLength
+	first := (r.offset + off) / pl
+	end := off + n + readahead
+	if end > r.length {
+		end = r.length
+	}
+	last := (r.offset + end - 1) / pl
+	r.picker.setWindow(window, first, last)
+}
+
+//等待piece完成校验，下载停止时仍未完成则返回错误
+func (r *Reader) waitPiece(ctx context.Context, index int) error {
+	for {
+		have, changed, closed := r.picker.wait(index)
+		if have {
+			return nil
+		}
+		if closed {
+			return fmt.Errorf("Piece #%d is not available", index)
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//读取文件中 off 处最多到当前piece末尾的数据
+func (r *Reader) readPiece(ctx context.Context, p []byte, off int) (int, error) {
+	pl := r.t.PieceLength
+	index := (r.offset + off) / pl
+	n := len(p)
+	if n > r.length-off {
+		n = r.length - off
+	}
+	if end := (index+1)*pl - r.offset; off+n > end {
+		n = end - off
+	}
+	if err := r.waitPiece(ctx, index); err != nil {
+		return 0, err
+	}
+	return r.storage.ReadAt(p[:n], int64(r.offset+off))
+}
+
+// Read 从当前位置读取，每次最多读取到当前piece末尾
+func (r *Reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	pos, ctx, readahead := r.pos, r.ctx, r.readahead
+	r.mu.Unlock()
+	if pos >= r.length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	//等待期间不持有锁，SetContext 等调用不会被阻塞
+	r.moveWindow(r.window, pos, len(p), readahead)
+	n, err := r.readPiece(ctx, p, pos)
+
+	r.mu.Lock()
+	r.pos = pos + n
+	r.mu.Unlock()
+	return n, err
+}
+
+// ReadAt 读取文件中 off 处的 len(p) 字节，不影响 Read 的当前位置，可以并发调用
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	if off >= int64(r.length) {
+		return 0, io.EOF
+	}
+	r.mu.Lock()
+	ctx, readahead := r.ctx, r.readahead
+	r.mu.Unlock()
+
+	//每次调用使用独立的窗口，避免与顺序读取相互干扰
+	window := r.picker.addWindow()
+	defer r.picker.removeWindow(window)
+	r.moveWindow(window, int(off), len(p), readahead)
+
+	read := 0
+	for read < len(p) {
+		pos := int(off) + read
+		if pos >= r.length {
+			return read, io.EOF
+		}
+		n, err := r.readPiece(ctx, p[read:], pos)
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// Seek 修改 Read 的当前位置
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = int64(r.pos) + offset
+	case io.SeekEnd:
+		pos = int64(r.length) + offset
+	default:
+		return 0, fmt.Errorf("Invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, errors.New("Negative position")
+	}
+	r.pos = int(pos)
+	return pos, nil
+}
+
+// Close 释放读取窗口，之后不再影响下载顺序
+func (r *Reader) Close() error {
+	r.picker.removeWindow(r.window)
+	return nil
+}
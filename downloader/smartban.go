@@ -0,0 +1,191 @@
+package downloader
+
+import (
+	"bitDownloader/peer"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+//智能封禁：一个piece总是由单个peer下载，校验失败时记录发送该piece的peer，
+//之后优先由其他peer重新下载，通过校验说明正确的数据可以获得，此时封禁之前发送错误数据的peer
+//由于没有多个peer共同下载同一个piece，不需要逐个block比较
+
+// BannedPeer 被封禁的peer
+type BannedPeer struct {
+	IP     net.IP
+	Reason string
+	Time   time.Time
+}
+
+//种子的封禁状态，由自身的锁保护，跨越多次下载保留
+type smartBan struct {
+	mu      sync.Mutex
+	failed  map[int]map[string]bool //piece下标 -> 发送过校验失败数据的peer
+	strikes map[string]int          //peer发送的piece校验失败的次数
+	banned  map[string]BannedPeer   //按IP封禁
+	fails   int                     //校验失败的次数
+}
+
+// MaxHashStrikes 发送的piece校验失败达到该次数的peer直接封禁，即使还没有其他peer提供正确的数据
+const MaxHashStrikes = 3
+
+func (t *Torrent) getBan() *smartBan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ban == nil {
+		t.ban = &smartBan{
+			failed:  make(map[int]map[string]bool),
+			strikes: make(map[string]int),
+			banned:  make(map[string]BannedPeer),
+		}
+	}
+	return t.ban
+}
+
+// failedPiece 记录 p 发送的piece校验失败，返回该peer累计的失败次数
+func (b *smartBan) failedPiece(index int, p peer.Peer) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fails++
+	if b.failed[index] == nil {
+		b.failed[index] = make(map[string]bool)
+	}
+	b.failed[index][p.String()] = true
+	b.strikes[p.String()]++
+	return b.strikes[p.String()]
+}
+
+// verified piece通过校验，返回之前发送过该piece错误数据的peer
+func (b *smartBan) verified(index int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var peers []string
+	for p := range b.failed[index] {
+		peers = append(peers, p)
+	}
+	delete(b.failed, index)
+	sort.Strings(peers)
+	return peers
+}
+
+//该peer是否参与过这个piece的失败下载
+func (b *smartBan) suspect(index int, p peer.Peer) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failed[index][p.String()]
+}
+
+// isBanned 该IP是否已经被封禁
+func (b *smartBan) isBanned(ip net.IP) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.banned[ip.String()]
+	return ok
+}
+
+func (b *smartBan) add(ip net.IP, reason string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.banned[ip.String()]; ok {
+		return false
+	}
+	b.banned[ip.String()] = BannedPeer{IP: ip, Reason: reason, Time: time.Now()}
+	return true
+}
+
+// BannedPeers 返回全部被封禁的peer，按照封禁时间排序
+func (t *Torrent) BannedPeers() []BannedPeer {
+	b := t.getBan()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := make([]BannedPeer, 0, len(b.banned))
+	for _, p := range b.banned {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.Before(list[j].Time) })
+	return list
+}
+
+// HashFailures 校验失败的piece数量
+func (t *Torrent) HashFailures() int {
+	b := t.getBan()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.fails
+}
+
+//封禁peer所在的IP并断开该IP的全部连接
+func (t *Torrent) banPeer(r *run, addr string, reason string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !t.getBan().add(ip, reason) {
+		return
+	}
+	log.Printf("Banned %s: %s\n", ip, reason)
+
+	t.mu.Lock()
+	var clients []*Client
+	for _, c := range r.clients {
+		if c != nil && c.peer.Ip.Equal(ip) {
+			clients = append(clients, c)
+		}
+	}
+	t.mu.Unlock()
+	for _, c := range clients {
+		c.Conn.Close()
+	}
+}
+
+// DisconnectBlocked 断开已经被 IPFilter 屏蔽的peer，屏蔽列表更新后调用，返回断开的连接数量
+func (t *Torrent) DisconnectBlocked() int {
+	t.mu.Lock()
+	var clients []*Client
+	if r := t.run; r != nil {
+		for _, c := range r.clients {
+			if c == nil {
+				continue
+			}
+			if blocked, _ := t.IPFilter.Blocked(c.peer.Ip); blocked {
+				clients = append(clients, c)
+			}
+		}
+	}
+	t.mu.Unlock()
+	for _, c := range clients {
+		log.Printf("Disconnecting blocked peer %s\n", c.peer)
+		c.Conn.Close()
+	}
+	return len(clients)
+}
+
+//是否可以从 c 下载该piece：参与过该piece失败下载的peer，在有其他peer拥有该piece时不再分配
+//尚未获取v2哈希的piece无法校验，暂不分配
+//选择器持有自身的锁时调用
+func (t *Torrent) canDownload(r *run, ban *smartBan, c *Client, index int) bool {
+	if !c.HasPiece(index) || !t.hashKnown(index) {
+		return false
+	}
+	if !ban.suspect(index, c.peer) {
+		return true
+	}
+	t.mu.Lock()
+	var others []*Client
+	for _, o := range r.clients {
+		if o != nil && o != c {
+			others = append(others, o)
+		}
+	}
+	t.mu.Unlock()
+	for _, o := range others {
+		if o.HasPiece(index) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,167 @@
+package downloader
+
+import (
+	"bitDownloader/handshake"
+	"bitDownloader/peer"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSmartBan(t *testing.T) {
+	bad := peer.Peer{Ip: net.ParseIP("10.0.0.1"), Port: 1}
+	other := peer.Peer{Ip: net.ParseIP("10.0.0.2"), Port: 2}
+	b := (&Torrent{}).getBan()
+
+	if n := b.failedPiece(3, bad); n != 1 {
+		t.Fatalf("strikes = %d, want 1", n)
+	}
+	if !b.suspect(3, bad) || b.suspect(3, other) || b.suspect(4, bad) {
+		t.Fatal("wrong suspects after failure")
+	}
+	//同一个piece再次失败，以及其他peer的失败
+	b.failedPiece(3, bad)
+	b.failedPiece(3, other)
+	if b.fails != 3 || b.strikes[bad.String()] != 2 || b.strikes[other.String()] != 1 {
+		t.Fatalf("fails = %d, strikes %v", b.fails, b.strikes)
+	}
+
+	//重新下载通过校验后返回全部发送过错误数据的peer，只返回一次
+	got := b.verified(3)
+	if strings.Join(got, ",") != bad.String()+","+other.String() {
+		t.Fatalf("verified = %v", got)
+	}
+	if b.suspect(3, bad) || b.verified(3) != nil {
+		t.Fatal("failure record kept after verification")
+	}
+	//没有失败过的piece
+	if b.verified(5) != nil {
+		t.Fatal("verified returned peers for a clean piece")
+	}
+
+	//跨越不同piece累计失败次数
+	if n := b.failedPiece(7, bad); n != MaxHashStrikes {
+		t.Fatalf("strikes = %d, want %d", n, MaxHashStrikes)
+	}
+
+	if !b.add(bad.Ip, "test") || b.add(bad.Ip, "again") || !b.isBanned(bad.Ip) || b.isBanned(other.Ip) {
+		t.Fatal("ban list")
+	}
+}
+
+func TestBanPeerDisconnects(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	tor := &Torrent{}
+	r := &run{clients: map[string]*Client{
+		"10.0.0.1:1": {Conn: a, peer: peer.Peer{Ip: net.ParseIP("10.0.0.1"), Port: 1}},
+		"10.0.0.2:2": nil, //正在连接
+	}}
+	tor.banPeer(r, "10.0.0.1:1", "sent corrupt data for piece #0")
+	if _, err := a.Write([]byte{0}); err == nil {
+		t.Error("connection to banned peer is still open")
+	}
+	banned := tor.BannedPeers()
+	if len(banned) != 1 || !banned[0].IP.Equal(net.ParseIP("10.0.0.1")) || banned[0].Reason != "sent corrupt data for piece #0" {
+		t.Fatalf("BannedPeers = %+v", banned)
+	}
+	//无效地址被忽略
+	tor.banPeer(r, "not an address", "x")
+	if len(tor.BannedPeers()) != 1 {
+		t.Fatal("invalid address was banned")
+	}
+}
+
+//总是发送错误数据的peer，达到 MaxHashStrikes 后被封禁
+func TestBanAfterHashStrikes(t *testing.T) {
+	data := make([]byte, 2*16384)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	hashes := [][20]byte{sha1.Sum(data[:16384]), sha1.Sum(data[16384:])}
+	infoHash := [20]byte{'i'}
+	bad := corruptSeeder(t, data, 16384)
+
+	tor := &Torrent{
+		Peers:       []peer.Peer{bad},
+		InfoHash:    infoHash,
+		PieceHashes: hashes,
+		PieceLength: 16384,
+		Length:      len(data),
+		Name:        "a.bin",
+	}
+	st := tor.OpenStorage(filepath.Join(t.TempDir(), "a.bin"))
+	defer st.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := tor.DownloadToContext(ctx, st); !errors.Is(err, ErrNoPeers) {
+		t.Fatalf("download error %v, want ErrNoPeers", err)
+	}
+	if n := tor.HashFailures(); n != MaxHashStrikes {
+		t.Errorf("HashFailures = %d, want %d", n, MaxHashStrikes)
+	}
+	banned := tor.BannedPeers()
+	if len(banned) != 1 || !banned[0].IP.Equal(bad.Ip) {
+		t.Fatalf("BannedPeers = %+v", banned)
+	}
+}
+
+//拥有全部piece但每个block都发送错误数据的peer
+func corruptSeeder(t *testing.T, data []byte, pieceLength int) peer.Peer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveCorrupt(conn, data, pieceLength)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return peer.Peer{Ip: addr.IP, Port: uint16(addr.Port)}
+}
+
+func serveCorrupt(conn net.Conn, data []byte, pieceLength int) {
+	defer conn.Close()
+	h, err := handshake.Read(conn)
+	if err != nil {
+		return
+	}
+	conn.Write(handshake.New(h.InfoHash, [20]byte{'s'}).Serialize())
+	n := (len(data) + pieceLength - 1) / pieceLength
+	bf := NewBitField(n)
+	for i := 0; i < n; i++ {
+		bf.SetPiece(i)
+	}
+	conn.Write((&Message{ID: MsgBitfield, Payload: bf}).Serialize())
+	conn.Write((&Message{ID: MsgUnchoke}).Serialize())
+	for {
+		msg, err := Read(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil || msg.ID != MsgRequest {
+			continue
+		}
+		index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+		begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+		length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+		payload := make([]byte, 8+length)
+		binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+		binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+		copy(payload[8:], data[index*pieceLength+begin:])
+		payload[8] ^= 0xff
+		conn.Write((&Message{ID: MsgPiece, Payload: payload}).Serialize())
+	}
+}
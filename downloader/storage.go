@@ -0,0 +1,323 @@
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// File 种子中的单个文件，Path 为相对于下载根目录的路径分段
+type File struct {
+	Path       []string
+	Length     int
+	Priority   Priority //下载优先级，零值为普通优先级
+	PiecesRoot [32]byte //v2文件的merkle树根，v1种子以及空文件为零
+	Padding    bool     //用于将下一个文件对齐到piece边界的padding文件，内容全部为零，不会写入磁盘
+}
+
+// files 返回种子包含的全部文件，单文件种子视为只有一个名为 Name 的文件
+func (t *Torrent) files() []File {
+	if len(t.Files) > 0 {
+		return t.Files
+	}
+	return []File{{Path: []string{t.Name}, Length: t.Length, PiecesRoot: t.PiecesRoot}}
+}
+
+//磁盘上的一个文件，offset 为该文件在种子连续数据中的起始位置
+type storageFile struct {
+	path    string
+	offset  int
+	length  int
+	fd      *os.File
+	skip    bool //跳过的文件，数据写入partfile
+	padding bool //padding文件，读取得到全零，写入被丢弃
+}
+
+// Storage 将种子的连续数据映射到磁盘上的一个或多个文件
+// 跳过下载的文件不会被创建，落在其中的边界piece数据按照原始偏移写入稀疏的partfile
+type Storage struct {
+	mu          sync.Mutex
+	files       []*storageFile
+	length      int
+	pieceLength int
+	part        *storageFile
+	root        string //多文件种子的根目录，删除数据时只会删除其中的空目录
+}
+
+// OpenStorage 为种子创建存储
+// 单文件种子的数据直接写入 root，多文件种子的文件放置在 root 目录下
+func (t *Torrent) OpenStorage(root string) *Storage {
+	s := &Storage{pieceLength: t.PieceLength}
+	offset := 0
+	for _, f := range t.files() {
+		path := root
+		if len(t.Files) > 0 {
+			path = filepath.Join(append([]string{root}, f.Path...)...)
+		}
+		s.files = append(s.files, &storageFile{
+			path:    path,
+			offset:  offset,
+			length:  f.Length,
+			padding: f.Padding,
+		})
+		offset += f.Length
+	}
+	s.length = offset
+
+	partPath := root + ".parts"
+	if len(t.Files) > 0 {
+		partPath = filepath.Join(root, ".parts")
+		s.root = filepath.Clean(root)
+	}
+	s.part = &storageFile{path: partPath, length: s.length}
+	for i, f := range t.files() {
+		s.files[i].skip = f.Priority == PriorityOff && !exists(s.files[i].path)
+	}
+
+	t.mu.Lock()
+	t.storage = s
+	t.mu.Unlock()
+	return s
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+//修改文件是否跳过，已经存在于磁盘上的文件继续使用原文件
+//取消跳过时将partfile中属于该文件的边界piece数据迁移回文件
+func (s *Storage) setSkipped(index int, skip bool) error {
+	s.mu.Lock()
+	f := s.files[index]
+	wasSkipped := f.skip
+	f.skip = skip && !exists(f.path)
+	s.mu.Unlock()
+	if !wasSkipped || f.skip || f.padding || f.length == 0 || !exists(s.part.path) {
+		return nil
+	}
+
+	//只有首尾两个piece可能与其他文件共享
+	ranges := [][2]int{
+		{f.offset, f.offset + s.pieceLength - f.offset%s.pieceLength},
+		{(f.offset + f.length - 1) / s.pieceLength * s.pieceLength, f.offset + f.length},
+	}
+	for _, r := range ranges {
+		begin, end := r[0], r[1]
+		if begin < f.offset {
+			begin = f.offset
+		}
+		if end > f.offset+f.length {
+			end = f.offset + f.length
+		}
+		buf := make([]byte, end-begin)
+		if _, err := s.readFile(s.part, buf, begin); err != nil {
+			continue
+		}
+		if _, err := s.writeFile(f, buf, begin-f.offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//跳过的文件实际读写partfile，partfile中使用种子连续数据的偏移
+func (s *Storage) target(f *storageFile, fileOff int) (*storageFile, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f.skip {
+		return s.part, f.offset + fileOff
+	}
+	return f, fileOff
+}
+
+func (s *Storage) readFile(f *storageFile, p []byte, off int) (int, error) {
+	fd, err := s.open(f, false)
+	if err != nil {
+		return 0, err
+	}
+	n, err := fd.ReadAt(p, int64(off))
+	if err == io.EOF {
+		if n < len(p) {
+			return n, io.ErrUnexpectedEOF
+		}
+		return n, nil
+	}
+	return n, err
+}
+
+func (s *Storage) writeFile(f *storageFile, p []byte, off int) (int, error) {
+	fd, err := s.open(f, true)
+	if err != nil {
+		return 0, err
+	}
+	return fd.WriteAt(p, int64(off))
+}
+
+//打开文件，create 为 false 时文件不存在将返回错误
+func (s *Storage) open(f *storageFile, create bool) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f.fd != nil {
+		return f.fd, nil
+	}
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+		if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			return nil, err
+		}
+	}
+	fd, err := os.OpenFile(f.path, flag, 0644)
+	if err != nil && !create && os.IsPermission(err) {
+		//只读文件仍然可以用于校验
+		fd, err = os.Open(f.path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.fd = fd
+	return fd, nil
+}
+
+//遍历 [off, off+n) 覆盖到的每个文件片段
+func (s *Storage) each(off, n int, fn func(f *storageFile, fileOff, size int) error) error {
+	if off < 0 || off+n > s.length {
+		return fmt.Errorf("Range [%d, %d) out of bounds for length %d", off, off+n, s.length)
+	}
+	for _, f := range s.files {
+		if n == 0 {
+			break
+		}
+		end := f.offset + f.length
+		if off >= end || f.length == 0 {
+			continue
+		}
+		size := end - off
+		if size > n {
+			size = n
+		}
+		if err := fn(f, off-f.offset, size); err != nil {
+			return err
+		}
+		off += size
+		n -= size
+	}
+	return nil
+}
+
+// ReadAt 读取种子连续数据中 off 处的内容，文件不存在或长度不足时返回错误
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	err := s.each(int(off), len(p), func(f *storageFile, fileOff, size int) error {
+		if f.padding {
+			for i := read; i < read+size; i++ {
+				p[i] = 0
+			}
+			read += size
+			return nil
+		}
+		f, fileOff = s.target(f, fileOff)
+		n, err := s.readFile(f, p[read:read+size], fileOff)
+		read += n
+		return err
+	})
+	return read, err
+}
+
+// WriteAt 将数据写入种子连续数据中的 off 处，必要时创建文件以及目录
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	written := 0
+	err := s.each(int(off), len(p), func(f *storageFile, fileOff, size int) error {
+		if f.padding {
+			written += size
+			return nil
+		}
+		f, fileOff = s.target(f, fileOff)
+		n, err := s.writeFile(f, p[written:written+size], fileOff)
+		written += n
+		return err
+	})
+	return written, err
+}
+
+// Flush 将所有已经打开的文件写入磁盘
+func (s *Storage) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	files := append([]*storageFile{s.part}, s.files...)
+	for _, f := range files {
+		if f.fd == nil {
+			continue
+		}
+		if err := f.fd.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close 关闭所有已经打开的文件
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	files := append([]*storageFile{s.part}, s.files...)
+	for _, f := range files {
+		if f.fd == nil {
+			continue
+		}
+		if err := f.fd.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		f.fd = nil
+	}
+	return firstErr
+}
+
+// Remove 关闭并删除存储中的全部文件以及partfile，随后删除变为空的目录
+func (s *Storage) Remove() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	dirs := make(map[string]bool)
+	files := append([]*storageFile{s.part}, s.files...)
+	for _, f := range files {
+		if f.padding {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+		if s.root != "" {
+			dirs[filepath.Dir(f.path)] = true
+		}
+	}
+	//由深到浅删除根目录内的空目录，非空目录删除失败时忽略
+	for len(dirs) > 0 {
+		next := make(map[string]bool)
+		for dir := range dirs {
+			if !s.within(dir) {
+				continue
+			}
+			if os.Remove(dir) == nil && dir != s.root {
+				next[filepath.Dir(dir)] = true
+			}
+		}
+		dirs = next
+	}
+	return firstErr
+}
+
+//dir 是否为根目录或位于根目录内
+func (s *Storage) within(dir string) bool {
+	rel, err := filepath.Rel(s.root, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,131 @@
+package downloader
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	return data
+}
+
+func TestStorageFileBoundaries(t *testing.T) {
+	//文件 a[0,5) 空文件b padding文件c[5,8) d[8,18) e[18,21)
+	fs := testFiles([]int{5, 0, 3, 10, 3}, nil)
+	fs[2].Padding = true
+	tor := testTorrent(4, fs)
+	root := t.TempDir()
+	st := tor.OpenStorage(root)
+	defer st.Close()
+	data := testData(tor.Length)
+	for i := 5; i < 8; i++ {
+		data[i] = 0
+	}
+
+	//按piece写入，piece跨越文件边界
+	for index := range tor.PieceHashes {
+		begin, end := tor.calculateBoundsForPiece(index)
+		if n, err := st.WriteAt(data[begin:end], int64(begin)); err != nil || n != end-begin {
+			t.Fatalf("WriteAt piece %d: %d, %v", index, n, err)
+		}
+	}
+	want := map[string][]byte{"a": data[0:5], "d": data[8:18], "e": data[18:21]}
+	for name, content := range want {
+		got, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("file %s = %v, %v, want %v", name, got, err, content)
+		}
+	}
+	//padding文件以及空文件不会写入磁盘
+	for _, name := range []string{"b", "c"} {
+		if exists(filepath.Join(root, name)) {
+			t.Errorf("file %s was created", name)
+		}
+	}
+
+	//跨越多个文件的读取
+	got := make([]byte, 14)
+	if n, err := st.ReadAt(got, 3); err != nil || n != 14 || !bytes.Equal(got, data[3:17]) {
+		t.Errorf("ReadAt = %v, %d, %v", got, n, err)
+	}
+	if _, err := st.ReadAt(make([]byte, 2), int64(tor.Length-1)); err == nil {
+		t.Error("ReadAt past the end succeeded")
+	}
+	if _, err := st.WriteAt([]byte{1}, -1); err == nil {
+		t.Error("WriteAt before the start succeeded")
+	}
+}
+
+func TestStoragePartfile(t *testing.T) {
+	//a[0,6) b[6,15) 跳过 c[15,22)，piece长度4
+	//piece 1 [4,8) 以及 piece 3 [12,16) 跨越跳过的文件与需要的文件
+	tor := testTorrent(4, testFiles([]int{6, 9, 7}, []Priority{PriorityNormal, PriorityOff, PriorityNormal}))
+	root := t.TempDir()
+	st := tor.OpenStorage(root)
+	defer st.Close()
+	data := testData(tor.Length)
+
+	priorities := tor.piecePriorities()
+	for index, priority := range priorities {
+		if priority == PriorityOff {
+			if index != 2 {
+				t.Errorf("piece %d skipped", index)
+			}
+			continue
+		}
+		begin, end := tor.calculateBoundsForPiece(index)
+		if _, err := st.WriteAt(data[begin:end], int64(begin)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bPath := filepath.Join(root, "b")
+	if exists(bPath) {
+		t.Fatal("skipped file was created")
+	}
+	//partfile按照种子连续数据的偏移保存跳过文件中的边界数据
+	part, err := os.ReadFile(filepath.Join(root, ".parts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(part) != 15 || !bytes.Equal(part[6:8], data[6:8]) || !bytes.Equal(part[12:15], data[12:15]) {
+		t.Fatalf("partfile = %v", part)
+	}
+	//边界piece可以完整读取用于校验以及上传
+	for _, index := range []int{1, 3} {
+		begin, end := tor.calculateBoundsForPiece(index)
+		got := make([]byte, end-begin)
+		if _, err := st.ReadAt(got, int64(begin)); err != nil || !bytes.Equal(got, data[begin:end]) {
+			t.Errorf("ReadAt piece %d = %v, %v", index, got, err)
+		}
+	}
+	got, _ := os.ReadFile(filepath.Join(root, "c"))
+	if !bytes.Equal(got, data[15:22]) {
+		t.Errorf("file c = %v", got)
+	}
+
+	//取消跳过后边界数据从partfile迁移到文件
+	if err := tor.SetFilePriority(1, PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+	got, err = os.ReadFile(bPath)
+	if err != nil || len(got) != 9 || !bytes.Equal(got[0:2], data[6:8]) || !bytes.Equal(got[6:9], data[12:15]) {
+		t.Fatalf("file b after unskipping = %v, %v", got, err)
+	}
+	if p := tor.piecePriorities(); p[2] != PriorityNormal {
+		t.Errorf("piece 2 priority %v after unskipping", p[2])
+	}
+
+	if err := st.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("%d entries left after Remove", len(entries))
+	}
+}
@@ -0,0 +1,60 @@
+package downloader
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Handler 返回提供种子中文件访问的HTTP处理器，支持Range请求
+// GET / 列出全部文件，GET /<文件路径> 返回文件内容，所需piece会被优先下载
+func (t *Torrent) Handler() http.Handler {
+	return http.HandlerFunc(t.serveHTTP)
+}
+
+func (t *Torrent) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if name == "" {
+		t.serveIndex(w)
+		return
+	}
+	for index, f := range t.files() {
+		if f.Padding || path.Join(f.Path...) != name {
+			continue
+		}
+		reader, err := t.NewReader(index)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer reader.Close()
+		//客户端断开连接时停止等待
+		reader.SetContext(r.Context())
+		http.ServeContent(w, r, path.Base(name), time.Time{}, reader)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+//列出种子中的全部文件
+func (t *Torrent) serveIndex(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html><head><title>%s</title></head><body><ul>\n", html.EscapeString(t.Name))
+	for _, f := range t.files() {
+		if f.Padding {
+			continue
+		}
+		name := path.Join(f.Path...)
+		link := (&url.URL{Path: "/" + name}).String()
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a> (%d bytes)</li>\n", link, html.EscapeString(name), f.Length)
+	}
+	fmt.Fprintln(w, "</ul></body></html>")
+}
@@ -0,0 +1,70 @@
+package downloader
+
+import (
+	"bitDownloader/peer"
+	"context"
+)
+
+// 向tracker汇报的事件
+const (
+	EventNone      = ""
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
+)
+
+// AnnounceStats 汇报给tracker的传输统计
+type AnnounceStats struct {
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+}
+
+// Tracker 向tracker汇报下载状态并获取peers
+type Tracker interface {
+	Announce(ctx context.Context, event string, stats AnnounceStats) ([]peer.Peer, error)
+}
+
+// Stats 返回当前的传输统计
+func (t *Torrent) Stats() AnnounceStats {
+	picker := t.getPicker()
+	t.mu.Lock()
+	stats := AnnounceStats{
+		Uploaded:   t.uploaded,
+		Downloaded: t.downloaded,
+	}
+	t.mu.Unlock()
+
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+	for index, work := range picker.works {
+		if !picker.have.HasPiece(index) {
+			stats.Left += int64(work.length)
+		}
+	}
+	return stats
+}
+
+// Announce 向tracker汇报事件，获得的peers会加入 Peers，正在下载时立即连接这些peer
+func (t *Torrent) Announce(ctx context.Context, event string) ([]peer.Peer, error) {
+	peers, err := t.announce(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.Peers = mergePeers(t.Peers, peers)
+	known, r, paused := t.Peers, t.run, t.paused
+	t.mu.Unlock()
+	if r != nil && !r.seed && !paused {
+		t.connect(r, known)
+	}
+	return peers, nil
+}
+
+//向tracker汇报事件，没有配置tracker时忽略
+func (t *Torrent) announce(ctx context.Context, event string) ([]peer.Peer, error) {
+	if t.Tracker == nil {
+		return nil, nil
+	}
+	return t.Tracker.Announce(ctx, event, t.Stats())
+}
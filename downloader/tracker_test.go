@@ -0,0 +1,63 @@
+package downloader
+
+import (
+	"bitDownloader/peer"
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type recordingTracker struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recordingTracker) Announce(ctx context.Context, event string, stats AnnounceStats) ([]peer.Peer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	return nil, nil
+}
+
+func TestNoCompletedWhenNothingDownloaded(t *testing.T) {
+	tr := &recordingTracker{}
+	tor := &Torrent{
+		Name:        "a.bin",
+		PieceHashes: make([][20]byte, 2),
+		PieceLength: 16384,
+		Length:      20000,
+		Bitfield:    NewBitField(2),
+		Tracker:     tr,
+	}
+	tor.Bitfield.SetPiece(0)
+	tor.Bitfield.SetPiece(1)
+	st := tor.OpenStorage(filepath.Join(t.TempDir(), "a.bin"))
+	defer st.Close()
+	if err := tor.DownloadToContext(context.Background(), st); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.events) != 0 {
+		t.Fatalf("announced %q for a torrent that was already complete", tr.events)
+	}
+}
+
+func TestAnnounceDoneEvents(t *testing.T) {
+	tests := []struct {
+		err       error
+		completed bool
+		want      []string
+	}{
+		{nil, true, []string{EventCompleted}},
+		{nil, false, nil},
+		{ErrNoPeers, false, []string{EventStopped}},
+		{ErrNoPeers, true, []string{EventStopped}},
+	}
+	for _, tt := range tests {
+		tr := &recordingTracker{}
+		(&Torrent{Tracker: tr}).announceDone(tt.err, tt.completed)
+		if len(tr.events) != len(tt.want) || (len(tt.want) > 0 && tr.events[0] != tt.want[0]) {
+			t.Errorf("announceDone(%v, %v) = %q, want %q", tt.err, tt.completed, tr.events, tt.want)
+		}
+	}
+}
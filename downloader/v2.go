@@ -0,0 +1,243 @@
+package downloader
+
+import (
+	"bitDownloader/handshake"
+	"bitDownloader/merkle"
+	"fmt"
+)
+
+//BitTorrent v2(BEP 52)：每个文件对齐到piece边界并拥有独立的merkle树
+//piece使用文件merkle树中对应子树的根校验，超过一个piece的文件的piece layer可以通过hash request获取
+
+// MaxHashesPerRequest 一次hash request请求的最大哈希数量
+const MaxHashesPerRequest = 512
+
+//piece所在的v2文件
+type pieceFile struct {
+	root   [32]byte //文件的pieces root，不属于任何v2文件时为零
+	index  int      //文件中的第几个piece
+	length int      //piece中属于该文件的字节数，其余为padding
+	pieces int      //文件的piece数量
+}
+
+//正在通过hash request获取的piece layer，按照 MaxHashesPerRequest 分块请求
+type layerFetch struct {
+	pieces   int
+	hashes   [][32]byte //补齐到2的幂
+	received []bool     //每个分块是否已经收到并通过校验
+}
+
+//每个分块请求的哈希数量
+func (f *layerFetch) chunk() int {
+	if len(f.hashes) < MaxHashesPerRequest {
+		return len(f.hashes)
+	}
+	return MaxHashesPerRequest
+}
+
+//是否为v2或混合种子
+func (t *Torrent) isV2() bool {
+	return t.InfoHashV2 != [32]byte{}
+}
+
+//我们发送的握手消息，v2以及混合种子声明支持v2
+func (t *Torrent) newHandshake(infoHash [20]byte) *handshake.Handshake {
+	h := handshake.New(infoHash, t.PeerID)
+	if t.isV2() {
+		h.Reserved[handshake.V2Bit] |= 0x10
+	}
+	return h
+}
+
+//对方握手使用的infohash是否属于该种子，混合种子可以使用v1或截断的v2 infohash
+func (t *Torrent) matchesInfoHash(infoHash [20]byte) bool {
+	if infoHash == t.InfoHash {
+		return true
+	}
+	var v2 [20]byte
+	copy(v2[:], t.InfoHashV2[:20])
+	return t.isV2() && infoHash == v2
+}
+
+//merkle树中piece layer所在的层
+func (t *Torrent) pieceLayer() int {
+	return merkle.Log2(t.PieceLength / merkle.BlockSize)
+}
+
+//piece layer中补齐使用的哈希，即一个piece大小的全零子树的根
+func (t *Torrent) piecePad() [32]byte {
+	return merkle.PadHash(t.PieceLength / merkle.BlockSize)
+}
+
+//计算每个piece所在的v2文件，调用者需持有锁
+//没有对齐到piece边界的文件无法使用v2校验，视为v1文件
+func (t *Torrent) pieceFilesLocked() []pieceFile {
+	if t.pieceFiles != nil {
+		return t.pieceFiles
+	}
+	t.pieceFiles = make([]pieceFile, len(t.PieceHashes))
+	if !t.isV2() {
+		return t.pieceFiles
+	}
+	offset := 0
+	for _, f := range t.files() {
+		if f.Length > 0 && !f.Padding && f.PiecesRoot != [32]byte{} && offset%t.PieceLength == 0 {
+			pieces := (f.Length + t.PieceLength - 1) / t.PieceLength
+			for i := 0; i < pieces && offset/t.PieceLength+i < len(t.pieceFiles); i++ {
+				length := f.Length - i*t.PieceLength
+				if length > t.PieceLength {
+					length = t.PieceLength
+				}
+				t.pieceFiles[offset/t.PieceLength+i] = pieceFile{root: f.PiecesRoot, index: i, length: length, pieces: pieces}
+			}
+		}
+		offset += f.Length
+	}
+	return t.pieceFiles
+}
+
+//piece的v2哈希、计算时补齐到的叶子数量以及piece中属于文件的字节数
+//ok 为假表示不是v2 piece，或者所在文件的piece layer尚未获取
+func (t *Torrent) pieceHashV2(index int) (root [32]byte, width, length int, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pf := t.pieceFilesLocked()[index]
+	if pf.root == [32]byte{} {
+		return root, 0, 0, false
+	}
+	//不超过一个piece的文件没有piece layer，piece的哈希就是文件的pieces root
+	if pf.pieces == 1 {
+		blocks := (pf.length + merkle.BlockSize - 1) / merkle.BlockSize
+		return pf.root, merkle.NextPow2(blocks), pf.length, true
+	}
+	layer := t.PieceLayers[pf.root]
+	if layer == nil {
+		return root, 0, 0, false
+	}
+	return layer[pf.index], t.PieceLength / merkle.BlockSize, pf.length, true
+}
+
+//是否已经知道piece的哈希，纯v2种子在获取piece layer之前无法校验
+func (t *Torrent) hashKnown(index int) bool {
+	if t.PieceHashes[index] != [20]byte{} {
+		return true
+	}
+	_, _, _, ok := t.pieceHashV2(index)
+	return ok
+}
+
+//向支持v2的peer请求尚未获取的piece layer
+func (t *Torrent) requestLayers(c *Client) {
+	if !c.v2 || !t.isV2() {
+		return
+	}
+	var reqs []HashRequest
+	t.mu.Lock()
+	for _, pf := range t.pieceFilesLocked() {
+		if pf.pieces <= 1 || pf.index != 0 || t.PieceLayers[pf.root] != nil {
+			continue
+		}
+		if t.fetches == nil {
+			t.fetches = make(map[[32]byte]*layerFetch)
+		}
+		fetch := t.fetches[pf.root]
+		if fetch == nil {
+			width := merkle.NextPow2(pf.pieces)
+			fetch = &layerFetch{pieces: pf.pieces, hashes: make([][32]byte, width)}
+			fetch.received = make([]bool, width/fetch.chunk())
+			t.fetches[pf.root] = fetch
+		}
+		chunk := fetch.chunk()
+		for i, done := range fetch.received {
+			if done {
+				continue
+			}
+			reqs = append(reqs, HashRequest{
+				PiecesRoot:  pf.root,
+				BaseLayer:   t.pieceLayer(),
+				Index:       i * chunk,
+				Length:      chunk,
+				ProofLayers: merkle.Log2(len(fetch.received)),
+			})
+		}
+	}
+	t.mu.Unlock()
+	for _, req := range reqs {
+		if err := c.SendHashRequest(req); err != nil {
+			return
+		}
+	}
+}
+
+//接收hashes消息，校验通过后保存，返回是否获取到了完整的piece layer
+//没有请求过的哈希被忽略，无法通过校验时返回错误
+func (t *Torrent) receiveHashes(msg *Message) (bool, error) {
+	req, hashes, err := ParseHashes(msg)
+	if err != nil {
+		return false, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fetch := t.fetches[req.PiecesRoot]
+	if fetch == nil || req.BaseLayer != t.pieceLayer() {
+		return false, nil
+	}
+	chunk := fetch.chunk()
+	if req.Length != chunk || req.Index%chunk != 0 || req.Index >= len(fetch.hashes) || len(hashes) < chunk {
+		return false, fmt.Errorf("Unexpected hashes [%d, %d) for %x", req.Index, req.Index+req.Length, req.PiecesRoot)
+	}
+	pos := req.Index / chunk
+	if fetch.received[pos] {
+		return false, nil
+	}
+	sub := merkle.Root(hashes[:chunk], chunk, t.piecePad())
+	if merkle.RootFromProof(sub, pos, hashes[chunk:]) != req.PiecesRoot {
+		return false, fmt.Errorf("Hashes [%d, %d) for %x failed verification", req.Index, req.Index+req.Length, req.PiecesRoot)
+	}
+	copy(fetch.hashes[req.Index:], hashes[:chunk])
+	fetch.received[pos] = true
+	for _, done := range fetch.received {
+		if !done {
+			return false, nil
+		}
+	}
+	if t.PieceLayers == nil {
+		t.PieceLayers = make(map[[32]byte][][32]byte)
+	}
+	t.PieceLayers[req.PiecesRoot] = fetch.hashes[:fetch.pieces]
+	delete(t.fetches, req.PiecesRoot)
+	return true, nil
+}
+
+//响应hash request，只能提供piece layer及以上各层的哈希，其余请求被拒绝
+func (t *Torrent) serveHashRequest(c *Client, msg *Message) error {
+	req, err := ParseHashRequest(msg)
+	if err != nil {
+		return err
+	}
+	hashes := t.layerHashes(req)
+	if hashes == nil {
+		return c.SendHashReject(req)
+	}
+	return c.SendHashes(req, hashes)
+}
+
+//hash request请求的哈希以及兄弟节点，无法提供时返回nil
+func (t *Torrent) layerHashes(req HashRequest) [][32]byte {
+	t.mu.Lock()
+	layer := t.PieceLayers[req.PiecesRoot]
+	t.mu.Unlock()
+	base := t.pieceLayer()
+	if layer == nil || req.BaseLayer < base || req.Length <= 0 || req.Length > MaxHashesPerRequest ||
+		req.Length != merkle.NextPow2(req.Length) || req.Index%req.Length != 0 {
+		return nil
+	}
+	layers := merkle.Layers(layer, merkle.NextPow2(len(layer)), t.piecePad())
+	level := req.BaseLayer - base
+	if level >= len(layers) || req.Index+req.Length > len(layers[level]) {
+		return nil
+	}
+	hashes := append([][32]byte(nil), layers[level][req.Index:req.Index+req.Length]...)
+	top := level + merkle.Log2(req.Length)
+	return append(hashes, merkle.Proof(layers[top:], req.Index/req.Length, req.ProofLayers)...)
+}
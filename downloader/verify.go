@@ -0,0 +1,109 @@
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// FileStatus 单个文件的校验结果
+type FileStatus struct {
+	Path     string
+	Length   int
+	Exists   bool //磁盘上是否存在该文件
+	Pieces   int  //与该文件有重叠的piece数量
+	Verified int  //其中通过校验的数量
+}
+
+// Complete 文件涉及的全部piece均通过校验
+func (f FileStatus) Complete() bool {
+	return f.Pieces == f.Verified
+}
+
+// VerifyResult 校验已有数据的结果
+type VerifyResult struct {
+	Have     BitField     //通过校验的piece
+	Verified int          //通过校验的piece数量
+	Bad      []int        //校验失败或缺失的piece下标
+	Files    []FileStatus //每个文件的校验结果
+}
+
+// Verify 读取存储中已有的数据，使用全部CPU核心并行校验每一个piece
+// 校验通过的piece将写入 t.Bitfield，之后的下载只会请求缺失或损坏的piece
+func (t *Torrent) Verify(s *Storage) *VerifyResult {
+	numPieces := len(t.PieceHashes)
+	ok := make([]bool, numPieces)
+
+	//与下载时相同，按照piece分发任务
+	workChan := make(chan *pieceWork, numPieces)
+	for index, hash := range t.PieceHashes {
+		workChan <- &pieceWork{
+			index:  index,
+			hash:   hash,
+			length: t.calculatePieceSize(index),
+		}
+	}
+	close(workChan)
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, t.PieceLength)
+			for work := range workChan {
+				begin, _ := t.calculateBoundsForPiece(work.index)
+				data := buf[:work.length]
+				//文件缺失或长度不足时视为损坏
+				if _, err := s.ReadAt(data, int64(begin)); err != nil {
+					continue
+				}
+				ok[work.index] = t.checkIntegrity(work, data) == nil
+			}
+		}()
+	}
+	wg.Wait()
+
+	res := &VerifyResult{Have: NewBitField(numPieces)}
+	for index, good := range ok {
+		if good {
+			res.Have.SetPiece(index)
+			res.Verified++
+		} else {
+			res.Bad = append(res.Bad, index)
+		}
+	}
+
+	//统计每个文件涉及的piece
+	for i, f := range s.files {
+		if f.padding {
+			continue
+		}
+		status := FileStatus{
+			Path:   filepath.Join(t.files()[i].Path...),
+			Length: f.length,
+		}
+		if _, err := os.Stat(f.path); err == nil {
+			status.Exists = true
+		}
+		if f.length > 0 {
+			first := f.offset / t.PieceLength
+			last := (f.offset + f.length - 1) / t.PieceLength
+			for index := first; index <= last; index++ {
+				status.Pieces++
+				if ok[index] {
+					status.Verified++
+				}
+			}
+		}
+		res.Files = append(res.Files, status)
+	}
+
+	t.mu.Lock()
+	t.Bitfield = res.Have
+	//已经创建的选择器需要重新根据校验结果创建
+	t.picker = nil
+	t.mu.Unlock()
+	return res
+}
@@ -0,0 +1,318 @@
+package downloader
+
+import (
+	"bitDownloader/ratelimit"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//web seed：通过HTTP从镜像获取piece，作为不需要握手、拥有全部piece的伪peer
+//支持BEP 19的 url-list（对文件发送Range请求）以及BEP 17的 httpseeds（按piece请求脚本）
+//由连接管理按照退避时间以及并发限制启动，获取到的piece与普通peer一样经过完整性校验
+
+// DefaultWebSeedConns Torrent.MaxWebSeedConns 为0时每个web seed同时进行的请求数量
+const DefaultWebSeedConns = 2
+
+// MaxWebSeedFailures 连续失败达到该次数的web seed不再使用
+const MaxWebSeedFailures = 5
+
+//单个HTTP请求的超时时间
+const webSeedTimeout = 2 * time.Minute
+
+//httpseed响应中断后继续请求剩余部分的最多次数
+const maxHTTPSeedResumes = 3
+
+//一个web seed的状态，由 Torrent.mu 保护
+type webSeed struct {
+	url      string
+	hoffman  bool //BEP 17 httpseed
+	active   int  //正在运行的worker数量
+	failures int  //连续失败次数
+	retryAt  time.Time
+}
+
+func newWebSeeds(urls, httpSeeds []string) []*webSeed {
+	seeds := make([]*webSeed, 0, len(urls)+len(httpSeeds))
+	for _, u := range urls {
+		seeds = append(seeds, &webSeed{url: u})
+	}
+	for _, u := range httpSeeds {
+		seeds = append(seeds, &webSeed{url: u, hoffman: true})
+	}
+	return seeds
+}
+
+//服务器繁忙，要求在 after 之后重试，不计为失败
+type busyError struct {
+	url   string
+	after time.Duration
+}
+
+func (e *busyError) Error() string {
+	return fmt.Sprintf("%s is busy, retrying in %s", e.url, e.after)
+}
+
+//由 503 响应的 Retry-After 头或者BEP 17响应体中的秒数得到重试间隔，不是繁忙响应时返回nil
+func busyResponse(u string, resp *http.Response, body bool) error {
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		return nil
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" && body {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 32))
+		value = strings.TrimSpace(string(b))
+	}
+	after := retryBackoff
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		after = time.Duration(seconds) * time.Second
+	} else if when, err := http.ParseTime(value); err == nil {
+		after = time.Until(when)
+	}
+	if after > maxRetryBackoff {
+		after = maxRetryBackoff
+	}
+	return &busyError{url: u, after: after}
+}
+
+//记录一次失败并计算下一次重试的时间
+func (ws *webSeed) fail(now time.Time) {
+	ws.failures++
+	backoff := retryBackoff << uint(ws.failures-1)
+	if backoff > maxRetryBackoff || backoff <= 0 {
+		backoff = maxRetryBackoff
+	}
+	ws.retryAt = now.Add(backoff)
+}
+
+//为每个可用的web seed补足并发的worker，调用者需持有 t.mu
+func (t *Torrent) fillWebSeedsLocked(r *run, now time.Time) {
+	limit := t.MaxWebSeedConns
+	if limit <= 0 {
+		limit = DefaultWebSeedConns
+	}
+	for _, ws := range r.webSeeds {
+		if ws.failures >= MaxWebSeedFailures || now.Before(ws.retryAt) {
+			continue
+		}
+		for ; ws.active < limit; ws.active++ {
+			ws := ws
+			r.goWorker(func(ctx context.Context) { t.runWebSeed(ctx, r, ws) })
+		}
+	}
+}
+
+//是否还有可以重试的web seed，调用者需持有 t.mu
+func (r *run) webSeedsRetryable() bool {
+	for _, ws := range r.webSeeds {
+		if ws.failures < MaxWebSeedFailures {
+			return true
+		}
+	}
+	return false
+}
+
+//从web seed下载piece直到下载结束或请求失败，失败后由连接管理在退避时间之后重新启动
+func (t *Torrent) runWebSeed(ctx context.Context, r *run, ws *webSeed) {
+	defer func() {
+		t.mu.Lock()
+		ws.active--
+		t.mu.Unlock()
+		r.wakeManager()
+	}()
+	picker := r.picker
+	ban := t.getBan()
+	//web seed拥有全部piece，只需要能够校验
+	has := func(index int) bool { return t.hashKnown(index) }
+	for {
+		work := picker.next(ctx, has)
+		if work == nil {
+			return
+		}
+		var buf []byte
+		var err error
+		if ws.hoffman {
+			buf, err = t.fetchHTTPSeed(ctx, ws.url, work)
+		} else {
+			buf, err = t.fetchWebSeed(ctx, ws.url, work)
+		}
+		if err == nil {
+			err = t.checkIntegrity(work, buf)
+		}
+		if err != nil {
+			picker.put(work)
+			if ctx.Err() != nil {
+				return
+			}
+			var busy *busyError
+			t.mu.Lock()
+			if errors.As(err, &busy) {
+				ws.retryAt = time.Now().Add(busy.after)
+			} else {
+				ws.fail(time.Now())
+			}
+			t.mu.Unlock()
+			log.Printf("Web seed %s failed: %v\n", ws.url, err)
+			return
+		}
+		for _, bad := range ban.verified(work.index) {
+			t.banPeer(r, bad, fmt.Sprintf("sent corrupt data for piece #%d", work.index))
+		}
+		t.mu.Lock()
+		ws.failures = 0
+		t.mu.Unlock()
+
+		select {
+		case r.results <- &pieceResult{index: work.index, buf: buf}:
+		case <-ctx.Done():
+			picker.put(work)
+			return
+		}
+	}
+}
+
+//web seed上文件的地址：单文件种子的地址以 / 结尾时加上种子名称，
+//多文件种子为 地址/种子名称/文件路径
+func webSeedURL(base string, t *Torrent, f File) string {
+	if len(t.Files) == 0 {
+		if strings.HasSuffix(base, "/") {
+			return base + url.PathEscape(t.Name)
+		}
+		return base
+	}
+	parts := make([]string, 0, len(f.Path)+1)
+	for _, p := range append([]string{t.Name}, f.Path...) {
+		parts = append(parts, url.PathEscape(p))
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.Join(parts, "/")
+}
+
+//下载一个piece，跨越多个文件时对每个文件分别发送Range请求，padding文件直接填零
+func (t *Torrent) fetchWebSeed(ctx context.Context, base string, work *pieceWork) ([]byte, error) {
+	buf := make([]byte, work.length)
+	begin, end := t.calculateBoundsForPiece(work.index)
+	offset := 0
+	for _, f := range t.files() {
+		fileEnd := offset + f.Length
+		if fileEnd > begin && offset < end && !f.Padding {
+			from, to := begin, end
+			if offset > from {
+				from = offset
+			}
+			if fileEnd < to {
+				to = fileEnd
+			}
+			if err := t.fetchRange(ctx, webSeedURL(base, t, f), from-offset, buf[from-begin:to-begin]); err != nil {
+				return nil, err
+			}
+		}
+		offset = fileEnd
+	}
+	return buf, nil
+}
+
+//读取文件 [offset, offset+len(dst)) 范围的数据
+func (t *Torrent) fetchRange(ctx context.Context, u string, offset int, dst []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, webSeedTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+len(dst)-1))
+	resp, err := t.webSeedClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := busyResponse(u, resp, false); err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && offset == 0:
+		//不支持Range的服务器返回整个文件，只需要开头的部分
+	default:
+		return fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	if _, err := io.ReadFull(t.limitReader(ctx, resp.Body), dst); err != nil {
+		return fmt.Errorf("Reading %s: %w", u, err)
+	}
+	return nil
+}
+
+//下载一个piece，先按照BEP 17请求整个piece：<url>?info_hash=<infohash>&piece=<下标>
+//响应中断时使用 ranges 参数请求剩余的部分，只要每次都有进展就继续，至多 maxHTTPSeedResumes 次
+func (t *Torrent) fetchHTTPSeed(ctx context.Context, base string, work *pieceWork) ([]byte, error) {
+	buf := make([]byte, work.length)
+	got := 0
+	for resumes := 0; got < len(buf); resumes++ {
+		n, err := t.fetchHTTPSeedRange(ctx, base, work.index, got, buf[got:])
+		got += n
+		if err != nil && (n == 0 || resumes >= maxHTTPSeedResumes || ctx.Err() != nil) {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+//请求piece中 [offset, offset+len(dst)) 的数据，返回读取到的字节数
+//繁忙的服务器返回503，响应体为需要等待的秒数
+func (t *Torrent) fetchHTTPSeedRange(ctx context.Context, base string, index, offset int, dst []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, webSeedTimeout)
+	defer cancel()
+	sep := "?"
+	if strings.Contains(base, "?") {
+		sep = "&"
+	}
+	u := base + sep + "info_hash=" + url.QueryEscape(string(t.InfoHash[:])) + "&piece=" + strconv.Itoa(index)
+	if offset > 0 {
+		//结束位置包含在范围内
+		u += fmt.Sprintf("&ranges=%d-%d", offset, offset+len(dst)-1)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := t.webSeedClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if err := busyResponse(base, resp, true); err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s returned %s for piece #%d", base, resp.Status, index)
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength != int64(len(dst)) {
+		return 0, fmt.Errorf("%s returned %d bytes for piece #%d at offset %d, expected %d", base, resp.ContentLength, index, offset, len(dst))
+	}
+	n, err := io.ReadFull(t.limitReader(ctx, resp.Body), dst)
+	if err != nil {
+		return n, fmt.Errorf("Reading piece #%d from %s: %w", index, base, err)
+	}
+	return n, nil
+}
+
+func (t *Torrent) webSeedClient() *http.Client {
+	if t.WebSeedClient != nil {
+		return t.WebSeedClient
+	}
+	return http.DefaultClient
+}
+
+//HTTP响应同样受种子以及上级的下载限速
+func (t *Torrent) limitReader(ctx context.Context, r io.Reader) io.Reader {
+	t.mu.Lock()
+	l := t.limitsLocked()
+	t.mu.Unlock()
+	return ratelimit.NewReader(ctx, r, l.download, t.DownloadLimiter)
+}
@@ -0,0 +1,183 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//记录web seed收到的请求
+type requestLog struct {
+	mu   sync.Mutex
+	reqs []string
+}
+
+func (l *requestLog) add(s string) {
+	l.mu.Lock()
+	l.reqs = append(l.reqs, s)
+	l.mu.Unlock()
+}
+
+func (l *requestLog) take() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	reqs := l.reqs
+	l.reqs = nil
+	return reqs
+}
+
+func TestWebSeedURL(t *testing.T) {
+	single := &Torrent{Name: "a b.iso"}
+	multi := &Torrent{Name: "dir", Files: []File{{Path: []string{"sub", "c#1.bin"}}}}
+	tests := []struct {
+		base string
+		t    *Torrent
+		want string
+	}{
+		{"http://x/a.iso", single, "http://x/a.iso"},
+		{"http://x/files/", single, "http://x/files/a%20b.iso"},
+		{"http://x/files", multi, "http://x/files/dir/sub/c%231.bin"},
+		{"http://x/files/", multi, "http://x/files/dir/sub/c%231.bin"},
+	}
+	for _, tt := range tests {
+		if got := webSeedURL(tt.base, tt.t, tt.t.files()[0]); got != tt.want {
+			t.Errorf("webSeedURL(%q) = %q, want %q", tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestFetchWebSeedSpansFiles(t *testing.T) {
+	//文件 "a b"[0,6) padding[6,8) sub/c[8,18)，piece长度5
+	//piece 1 [5,10) 跨越a的结尾、padding以及c的开头
+	fs := testFiles([]int{6, 2, 10}, nil)
+	fs[0].Path = []string{"a b"}
+	fs[1].Padding = true
+	fs[2].Path = []string{"sub", "c"}
+	tor := testTorrent(5, fs)
+	tor.Name = "dir"
+	data := testData(tor.Length)
+	data[6], data[7] = 0, 0
+	content := map[string][]byte{"/seed/dir/a b": data[0:6], "/seed/dir/sub/c": data[8:18]}
+
+	var log requestLog
+	ignoreRange := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r.URL.Path + " " + r.Header.Get("Range"))
+		b, ok := content[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if ignoreRange {
+			w.Write(b)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		index int
+		reqs  []string
+	}{
+		{0, []string{"/seed/dir/a b bytes=0-4"}},
+		{1, []string{"/seed/dir/a b bytes=5-5", "/seed/dir/sub/c bytes=0-1"}},
+		{3, []string{"/seed/dir/sub/c bytes=7-9"}},
+	}
+	for _, tt := range tests {
+		work := &pieceWork{index: tt.index, length: tor.calculatePieceSize(tt.index)}
+		buf, err := tor.fetchWebSeed(context.Background(), srv.URL+"/seed/", work)
+		begin, end := tor.calculateBoundsForPiece(tt.index)
+		if err != nil || !bytes.Equal(buf, data[begin:end]) {
+			t.Errorf("piece %d = %v, %v, want %v", tt.index, buf, err, data[begin:end])
+		}
+		if reqs := log.take(); strings.Join(reqs, ",") != strings.Join(tt.reqs, ",") {
+			t.Errorf("piece %d requests %q, want %q", tt.index, reqs, tt.reqs)
+		}
+	}
+
+	//不支持Range的服务器只能用于文件开头的数据
+	ignoreRange = true
+	if buf, err := tor.fetchWebSeed(context.Background(), srv.URL+"/seed", &pieceWork{index: 0, length: 5}); err != nil || !bytes.Equal(buf, data[0:5]) {
+		t.Errorf("piece 0 without Range support = %v, %v", buf, err)
+	}
+	if _, err := tor.fetchWebSeed(context.Background(), srv.URL+"/seed", &pieceWork{index: 2, length: 5}); err == nil || !strings.Contains(err.Error(), "200 OK") {
+		t.Errorf("piece 2 without Range support = %v", err)
+	}
+}
+
+func TestFetchHTTPSeedResume(t *testing.T) {
+	tor := testTorrent(16384, testFiles([]int{40000}, nil))
+	tor.InfoHash = [20]byte{'h', '&', '='}
+	data := testData(tor.Length)
+
+	var log requestLog
+	//每个响应最多发送 limit 字节后中断，0 表示不中断
+	limit := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		log.add(fmt.Sprintf("piece=%s ranges=%s", q.Get("piece"), q.Get("ranges")))
+		if q.Get("info_hash") != string(tor.InfoHash[:]) || q.Get("x") != "y" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if q.Get("piece") == "2" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "7")
+			return
+		}
+		var index, from, to int
+		fmt.Sscan(q.Get("piece"), &index)
+		piece := data[index*16384 : (index+1)*16384]
+		from, to = 0, len(piece)-1
+		if ranges := q.Get("ranges"); ranges != "" {
+			fmt.Sscanf(ranges, "%d-%d", &from, &to)
+		}
+		body := piece[from : to+1]
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		if limit == 0 || len(body) <= limit {
+			w.Write(body)
+			return
+		}
+		w.Write(body[:limit])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer srv.Close()
+	base := srv.URL + "/seed?x=y"
+
+	//中断的响应使用 ranges 参数请求剩余部分
+	limit = 10000
+	buf, err := tor.fetchHTTPSeed(context.Background(), base, &pieceWork{index: 1, length: 16384})
+	if err != nil || !bytes.Equal(buf, data[16384:32768]) {
+		t.Fatalf("piece 1 = %d bytes, %v", len(buf), err)
+	}
+	want := []string{"piece=1 ranges=", "piece=1 ranges=10000-16383"}
+	if reqs := log.take(); strings.Join(reqs, ",") != strings.Join(want, ",") {
+		t.Errorf("requests %q, want %q", reqs, want)
+	}
+
+	//每次都有进展但始终没有完成时，至多继续 maxHTTPSeedResumes 次
+	limit = 1000
+	if _, err := tor.fetchHTTPSeed(context.Background(), base, &pieceWork{index: 0, length: 16384}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("always truncated piece = %v, want io.ErrUnexpectedEOF", err)
+	}
+	want = []string{"piece=0 ranges=", "piece=0 ranges=1000-16383", "piece=0 ranges=2000-16383", "piece=0 ranges=3000-16383"}
+	if reqs := log.take(); strings.Join(reqs, ",") != strings.Join(want, ",") {
+		t.Errorf("requests %q, want %q", reqs, want)
+	}
+
+	//繁忙的服务器在响应体中给出等待的秒数
+	var busy *busyError
+	if _, err := tor.fetchHTTPSeed(context.Background(), base, &pieceWork{index: 2, length: 7232}); !errors.As(err, &busy) || busy.after != 7*time.Second {
+		t.Errorf("busy server = %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bitDownloader/parser"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//修改种子的tracker、注释以及web seed，infohash保持不变
+//参数可以是多个种子文件或目录，目录中的全部 .torrent 文件都会被修改
+func runEdit(args []string) error {
+	flags := flag.NewFlagSet("edit", flag.ExitOnError)
+	var trackers, replaces, removes, webSeeds stringList
+	announce := flags.String("announce", "", "set the main tracker, empty to remove it")
+	flags.Var(&trackers, "t", "replace announce-list, repeat for each tier, comma separate trackers within a tier")
+	flags.Var(&replaces, "replace", "old=new, replace a tracker wherever it appears, may be repeated")
+	flags.Var(&removes, "remove", "remove a tracker wherever it appears, may be repeated")
+	flags.Var(&webSeeds, "w", "replace url-list with this web seed, may be repeated, empty to remove all")
+	comment := flags.String("comment", "", "set the comment, empty to remove it")
+	createdBy := flags.String("created-by", "", "set created by, empty to remove it")
+	out := flags.String("o", "", "write to this file instead of editing in place, single torrent only")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	//只修改命令行中给出的字段，值为空表示删除
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var replacements [][2]string
+	for _, r := range replaces {
+		kv := strings.SplitN(r, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("Malformed replacement %q, expected old=new", r)
+		}
+		replacements = append(replacements, [2]string{kv[0], kv[1]})
+	}
+	for _, r := range removes {
+		replacements = append(replacements, [2]string{r, ""})
+	}
+
+	edit := func(e *parser.Editor) error {
+		if given["t"] {
+			var tiers [][]string
+			for _, tier := range trackers {
+				tiers = append(tiers, strings.Split(tier, ","))
+			}
+			if err := e.SetAnnounceList(tiers); err != nil {
+				return err
+			}
+			//只替换列表时主tracker使用列表中的第一个
+			if list := e.AnnounceList(); !given["announce"] && len(list) > 0 {
+				if err := e.SetAnnounce(list[0][0]); err != nil {
+					return err
+				}
+			}
+		}
+		if given["announce"] {
+			if err := e.SetAnnounce(*announce); err != nil {
+				return err
+			}
+		}
+		for _, r := range replacements {
+			if _, err := e.ReplaceTracker(r[0], r[1]); err != nil {
+				return err
+			}
+		}
+		if given["w"] {
+			if err := e.SetWebSeeds(webSeeds); err != nil {
+				return err
+			}
+		}
+		if given["comment"] {
+			if err := e.SetComment(*comment); err != nil {
+				return err
+			}
+		}
+		if given["created-by"] {
+			return e.SetCreatedBy(*createdBy)
+		}
+		return nil
+	}
+
+	paths, err := torrentPaths(flags.Args())
+	if err != nil {
+		return err
+	}
+	if *out != "" && len(paths) != 1 {
+		return fmt.Errorf("-o requires exactly one torrent, got %d", len(paths))
+	}
+	failed := 0
+	for _, path := range paths {
+		dest := path
+		if *out != "" {
+			dest = *out
+		}
+		if err := editFile(path, dest, edit); err != nil {
+			log.Printf("Could not edit %s: %v\n", path, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d torrents could not be edited", failed, len(paths))
+	}
+	return nil
+}
+
+//展开参数中的目录，返回全部种子文件
+func torrentPaths(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		st, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !st.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		err = filepath.WalkDir(arg, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type().IsRegular() && strings.EqualFold(filepath.Ext(p), ".torrent") {
+				paths = append(paths, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+//读取 path，修改后写入 dest，先写临时文件再重命名，避免中断时损坏原文件
+func editFile(path, dest string, edit func(*parser.Editor) error) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	e, err := parser.NewEditor(data)
+	if err != nil {
+		return err
+	}
+	if err := edit(e); err != nil {
+		return err
+	}
+	result, err := e.Bytes()
+	if err != nil {
+		return err
+	}
+	tmp := dest + ".tmp"
+	if err := os.WriteFile(tmp, result, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	fmt.Printf("Edited %s, infohash %x\n", dest, e.InfoHash())
+	return nil
+}
@@ -8,17 +8,34 @@ import (
 //尝试与peers建立TCP连接
 type Handshake struct {
 	Pstr     string   //比特协议 always BitTorrent protocol
+	Reserved [8]byte  //保留位，用于声明支持的扩展
 	InfoHash [20]byte //文件信息标识
 	PeerID   [20]byte //peerId 随机生成的id
 }
 
+// ExtensionBit 扩展协议(BEP 10)在保留位中的位置：第5字节的0x10
+const ExtensionBit = 5
+
+// SupportsExtensions 对方是否支持扩展协议
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[ExtensionBit]&0x10 != 0
+}
+
+// V2Bit BitTorrent v2(BEP 52)在保留位中的位置：第7字节的0x10
+const V2Bit = 7
+
+// SupportsV2 对方是否支持v2协议，支持时可以发送hash request
+func (h *Handshake) SupportsV2() bool {
+	return h.Reserved[V2Bit]&0x10 != 0
+}
+
 // Serialize 序列化方法
 func (h *Handshake) Serialize() []byte {
 	buf := make([]byte, len(h.Pstr)+49) //其余都是固定字节数（1+8+20+20）
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8))
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -46,13 +63,16 @@ func Read(r io.Reader) (*Handshake, error) {
 		return nil, err
 	}
 
+	var reserved [8]byte
 	var infoHash [20]byte
 	var peerId [20]byte
+	copy(reserved[:], handshakeBuf[pstrLen:pstrLen+8])
 	copy(infoHash[:], handshakeBuf[pstrLen+8:pstrLen+28])
 	copy(peerId[:], handshakeBuf[pstrLen+28:pstrLen+48])
 
 	handshake := &Handshake{
 		Pstr:     string(handshakeBuf[0:pstrLen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerId,
 	}
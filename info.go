@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bitDownloader/parser"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+//info --json 的输出格式
+type infoOutput struct {
+	Name         string     `json:"name"`
+	InfoHash     string     `json:"info_hash,omitempty"` //v1 infohash，纯v2种子没有
+	InfoHashV2   string     `json:"info_hash_v2,omitempty"`
+	MetaVersion  int        `json:"meta_version"`
+	Hybrid       bool       `json:"hybrid"`
+	PieceLength  int        `json:"piece_length"`
+	Pieces       int        `json:"pieces"`
+	Length       int        `json:"length"`
+	Private      bool       `json:"private"`
+	Source       string     `json:"source,omitempty"`
+	Comment      string     `json:"comment,omitempty"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	CreationDate *time.Time `json:"creation_date,omitempty"`
+	Trackers     [][]string `json:"trackers"`
+	WebSeeds     []string   `json:"web_seeds"`
+	HTTPSeeds    []string   `json:"http_seeds"`
+	Files        []infoFile `json:"files"`
+	Magnet       string     `json:"magnet"`
+}
+
+type infoFile struct {
+	Index  int    `json:"index"` //download -only 以及 -priority 使用的编号
+	Path   string `json:"path"`
+	Length int    `json:"length"`
+}
+
+//输出种子的元数据
+func runInfo(args []string) error {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the metadata as JSON")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	tof, err := loadTorrent(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	out := describeTorrent(&tof)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(out)
+	}
+	printInfo(out)
+	return nil
+}
+
+func describeTorrent(tof *parser.TorrentFile) infoOutput {
+	out := infoOutput{
+		Name:        tof.Name,
+		MetaVersion: tof.MetaVersion,
+		Hybrid:      tof.Hybrid(),
+		PieceLength: tof.PieceLength,
+		Pieces:      len(tof.PieceHashes),
+		Length:      tof.Length,
+		Private:     tof.Private,
+		Source:      tof.Source,
+		Comment:     tof.Comment,
+		CreatedBy:   tof.CreatedBy,
+		Trackers:    tof.Trackers(),
+		WebSeeds:    tof.WebSeeds,
+		HTTPSeeds:   tof.HTTPSeeds,
+		Magnet:      tof.MagnetURI(),
+	}
+	if tof.MetaVersion == 1 || out.Hybrid {
+		out.InfoHash = hex.EncodeToString(tof.InfoHash[:])
+	}
+	if tof.MetaVersion == 2 {
+		out.InfoHashV2 = hex.EncodeToString(tof.InfoHashV2[:])
+	}
+	if !tof.CreationDate.IsZero() {
+		date := tof.CreationDate.UTC()
+		out.CreationDate = &date
+	}
+	if out.Trackers == nil {
+		out.Trackers = [][]string{}
+	}
+	if out.WebSeeds == nil {
+		out.WebSeeds = []string{}
+	}
+	if out.HTTPSeeds == nil {
+		out.HTTPSeeds = []string{}
+	}
+	if len(tof.Files) == 0 {
+		out.Files = []infoFile{{Index: 0, Path: tof.Name, Length: tof.Length}}
+	}
+	for i, f := range tof.Files {
+		//padding文件只用于对齐，不会写入磁盘
+		if f.Padding {
+			continue
+		}
+		out.Files = append(out.Files, infoFile{Index: i, Path: strings.Join(f.Path, "/"), Length: f.Length})
+	}
+	return out
+}
+
+func printInfo(out infoOutput) {
+	version := "v1"
+	switch {
+	case out.Hybrid:
+		version = "hybrid v1/v2"
+	case out.MetaVersion == 2:
+		version = "v2"
+	}
+	fmt.Printf("Name:          %s\n", out.Name)
+	fmt.Printf("Version:       %s\n", version)
+	if out.InfoHash != "" {
+		fmt.Printf("Info hash:     %s\n", out.InfoHash)
+	}
+	if out.InfoHashV2 != "" {
+		fmt.Printf("Info hash v2:  %s\n", out.InfoHashV2)
+	}
+	fmt.Printf("Pieces:        %d x %s\n", out.Pieces, formatSize(out.PieceLength))
+	fmt.Printf("Total size:    %s (%d bytes)\n", formatSize(out.Length), out.Length)
+	fmt.Printf("Private:       %v\n", out.Private)
+	if out.Source != "" {
+		fmt.Printf("Source:        %s\n", out.Source)
+	}
+	if out.CreatedBy != "" {
+		fmt.Printf("Created by:    %s\n", out.CreatedBy)
+	}
+	if out.CreationDate != nil {
+		fmt.Printf("Creation date: %s\n", out.CreationDate.Format(time.RFC3339))
+	}
+	if out.Comment != "" {
+		fmt.Printf("Comment:       %s\n", out.Comment)
+	}
+	if len(out.Trackers) > 0 {
+		fmt.Println("Trackers:")
+		for i, tier := range out.Trackers {
+			fmt.Printf("  tier %d: %s\n", i+1, strings.Join(tier, ", "))
+		}
+	}
+	if len(out.WebSeeds) > 0 {
+		fmt.Println("Web seeds:")
+		for _, ws := range out.WebSeeds {
+			fmt.Printf("  %s\n", ws)
+		}
+	}
+	if len(out.HTTPSeeds) > 0 {
+		fmt.Println("HTTP seeds:")
+		for _, hs := range out.HTTPSeeds {
+			fmt.Printf("  %s\n", hs)
+		}
+	}
+	fmt.Println("Files:")
+	for _, f := range out.Files {
+		fmt.Printf("  %4d  %10s  %s\n", f.Index, formatSize(f.Length), f.Path)
+	}
+	fmt.Printf("Magnet:        %s\n", out.Magnet)
+}
+
+//以二进制单位显示的大小
+func formatSize(n int) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	size, unit := float64(n)/1024, 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", size, units[unit])
+}
@@ -0,0 +1,144 @@
+package ipfilter
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"sort"
+	"sync"
+)
+
+//IP过滤：屏蔽列表中的地址段，在连接peer之前以及接受传入连接时检查
+
+// Range 一个被屏蔽的地址段，IPv4地址使用IPv4映射的16字节形式保存
+type Range struct {
+	Start       net.IP
+	End         net.IP
+	Description string
+}
+
+// Filter 按照起始地址排序并合并重叠部分的地址段，可以在使用过程中重新加载
+// nil 的 Filter 不屏蔽任何地址
+type Filter struct {
+	mu     sync.RWMutex
+	ranges []Range
+	path   string //LoadFile 使用的文件，Reload 时重新读取
+}
+
+// New 由地址段创建过滤器
+func New(ranges []Range) *Filter {
+	f := &Filter{}
+	f.Set(ranges)
+	return f
+}
+
+// LoadFile 读取屏蔽列表文件创建过滤器，支持eMule ipfilter.dat、PeerGuardian P2P 以及 CIDR 格式
+func LoadFile(path string) (*Filter, error) {
+	f := &Filter{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload 重新读取 LoadFile 时使用的文件，解析失败时保留原有的地址段
+func (f *Filter) Reload() error {
+	fd, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	ranges, err := Parse(fd)
+	if err != nil {
+		return err
+	}
+	f.Set(ranges)
+	return nil
+}
+
+// Set 替换全部地址段
+func (f *Filter) Set(ranges []Range) {
+	merged := normalize(ranges)
+	f.mu.Lock()
+	f.ranges = merged
+	f.mu.Unlock()
+}
+
+// Len 合并后的地址段数量
+func (f *Filter) Len() int {
+	if f == nil {
+		return 0
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.ranges)
+}
+
+// Blocked 返回该地址是否被屏蔽以及所在地址段
+func (f *Filter) Blocked(ip net.IP) (bool, *Range) {
+	if f == nil {
+		return false, nil
+	}
+	ip = ip.To16()
+	if ip == nil {
+		return false, nil
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	//第一个起始地址大于ip的地址段之前的那一个可能包含ip
+	i := sort.Search(len(f.ranges), func(i int) bool {
+		return bytes.Compare(f.ranges[i].Start, ip) > 0
+	})
+	if i == 0 {
+		return false, nil
+	}
+	r := f.ranges[i-1]
+	if bytes.Compare(ip, r.End) <= 0 {
+		return true, &r
+	}
+	return false, nil
+}
+
+//统一为16字节形式，排序并合并重叠或相邻的地址段
+func normalize(ranges []Range) []Range {
+	list := make([]Range, 0, len(ranges))
+	for _, r := range ranges {
+		start, end := r.Start.To16(), r.End.To16()
+		if start == nil || end == nil || bytes.Compare(start, end) > 0 {
+			continue
+		}
+		list = append(list, Range{Start: start, End: end, Description: r.Description})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return bytes.Compare(list[i].Start, list[j].Start) < 0
+	})
+
+	var merged []Range
+	for _, r := range list {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			next := increment(last.End)
+			if next == nil || bytes.Compare(r.Start, next) <= 0 {
+				if bytes.Compare(r.End, last.End) > 0 {
+					last.End = r.End
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+//地址加一，溢出时返回nil
+func increment(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package ipfilter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+//屏蔽列表的解析，每一行可以是以下任意一种格式：
+//  eMule ipfilter.dat:  001.002.003.000 - 001.002.003.255 , 100 , 描述
+//  PeerGuardian P2P:    描述:1.2.3.0-1.2.3.255
+//  CIDR 或单个地址:      10.0.0.0/8  2001:db8::/32  192.168.1.1
+//空行以及以 # 或 // 开头的行被忽略
+
+// eMuleAllowLevel eMule格式中访问级别大于等于该值的地址段不屏蔽
+const eMuleAllowLevel = 128
+
+// Parse 读取屏蔽列表，遇到无法识别的行时返回带有行号的错误
+func Parse(r io.Reader) ([]Range, error) {
+	var ranges []Range
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rng, blocked, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %w", lineNo, err)
+		}
+		if blocked {
+			ranges = append(ranges, rng)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
+
+//解析一行，返回的 blocked 为假时该地址段不屏蔽
+//按照每种格式的完整形状识别，P2P格式的描述中可以含有逗号、冒号以及斜杠
+func parseLine(line string) (Range, bool, error) {
+	//eMule格式：第一个逗号之前为地址段，之后为访问级别
+	if fields := strings.SplitN(line, ",", 3); len(fields) >= 2 {
+		if rng, err := parseRange(fields[0]); err == nil {
+			return parseEmule(rng, fields)
+		}
+	}
+	if _, ipnet, err := net.ParseCIDR(line); err == nil {
+		return cidrRange(ipnet), true, nil
+	}
+	if rng, err := parseRange(line); err == nil {
+		return rng, true, nil
+	}
+	//P2P格式：描述:地址段，描述以及IPv6地址段都可能含有冒号，
+	//使用第一个之后为有效地址段的冒号
+	for i := strings.IndexByte(line, ':'); i >= 0; {
+		if rng, err := parseRange(line[i+1:]); err == nil {
+			rng.Description = strings.TrimSpace(line[:i])
+			return rng, true, nil
+		}
+		next := strings.IndexByte(line[i+1:], ':')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	if ip := parseIP(line); ip != nil {
+		return Range{Start: ip, End: ip}, true, nil
+	}
+	switch {
+	case strings.Contains(line, "-"):
+		return Range{}, false, fmt.Errorf("Invalid range %q", line)
+	case strings.Contains(line, "/"):
+		return Range{}, false, fmt.Errorf("Invalid CIDR %q", line)
+	default:
+		return Range{}, false, fmt.Errorf("Invalid address %q", line)
+	}
+}
+
+//eMule格式：地址段 , 访问级别 , 描述
+func parseEmule(rng Range, fields []string) (Range, bool, error) {
+	level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return Range{}, false, fmt.Errorf("Invalid access level %q", fields[1])
+	}
+	if len(fields) > 2 {
+		rng.Description = strings.TrimSpace(fields[2])
+	}
+	return rng, level < eMuleAllowLevel, nil
+}
+
+//起始地址-结束地址，两侧可以有空格
+func parseRange(s string) (Range, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return Range{}, fmt.Errorf("Invalid range %q", s)
+	}
+	start, end := parseIP(parts[0]), parseIP(parts[1])
+	if start == nil || end == nil {
+		return Range{}, fmt.Errorf("Invalid range %q", s)
+	}
+	if (start.To4() == nil) != (end.To4() == nil) {
+		return Range{}, fmt.Errorf("Mixed address families in range %q", s)
+	}
+	return Range{Start: start, End: end}, nil
+}
+
+//解析地址，eMule格式的IPv4地址带有前导零，例如 001.002.003.000
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return nil
+	}
+	var b [4]byte
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		b[i] = byte(n)
+	}
+	return net.IPv4(b[0], b[1], b[2], b[3])
+}
+
+//CIDR对应的地址段
+func cidrRange(ipnet *net.IPNet) Range {
+	start := ipnet.IP.To16()
+	end := make(net.IP, len(start))
+	mask := ipnet.Mask
+	//IPv4的掩码只有4字节，对应16字节形式的最后4字节
+	offset := len(start) - len(mask)
+	copy(end, start)
+	for i := range mask {
+		end[offset+i] = start[offset+i] | ^mask[i]
+	}
+	return Range{Start: start, End: end, Description: ipnet.String()}
+}
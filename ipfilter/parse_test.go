@@ -0,0 +1,92 @@
+package ipfilter
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		start   string
+		end     string
+		desc    string
+		blocked bool
+	}{
+		{"001.002.003.000 - 001.002.003.255 , 100 , Some ISP", "1.2.3.0", "1.2.3.255", "Some ISP", true},
+		{"1.2.3.0 - 1.2.3.255 , 200 , Allowed, really", "1.2.3.0", "1.2.3.255", "Allowed, really", false},
+		{"1.2.3.0-1.2.3.255,000", "1.2.3.0", "1.2.3.255", "", true},
+		{"Bad peers:1.2.3.0-1.2.3.255", "1.2.3.0", "1.2.3.255", "Bad peers", true},
+		{"Acme, Inc:1.2.3.0-1.2.3.255", "1.2.3.0", "1.2.3.255", "Acme, Inc", true},
+		{"a:b/c, d:1.2.3.4-1.2.3.5", "1.2.3.4", "1.2.3.5", "a:b/c, d", true},
+		{"Bad peers:2001:db8::1-2001:db8::ff", "2001:db8::1", "2001:db8::ff", "Bad peers", true},
+		{"2001:db8::1-2001:db8::ff", "2001:db8::1", "2001:db8::ff", "", true},
+		{"10.0.0.0/8", "10.0.0.0", "10.255.255.255", "10.0.0.0/8", true},
+		{"2001:db8::/32", "2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", "2001:db8::/32", true},
+		{"192.168.1.1", "192.168.1.1", "192.168.1.1", "", true},
+		{"::1", "::1", "::1", "", true},
+	}
+	for _, tt := range tests {
+		rng, blocked, err := parseLine(tt.line)
+		if err != nil {
+			t.Errorf("parseLine(%q): %v", tt.line, err)
+			continue
+		}
+		if !rng.Start.Equal(net.ParseIP(tt.start)) || !rng.End.Equal(net.ParseIP(tt.end)) {
+			t.Errorf("parseLine(%q) = %s-%s, want %s-%s", tt.line, rng.Start, rng.End, tt.start, tt.end)
+		}
+		if rng.Description != tt.desc {
+			t.Errorf("parseLine(%q) description = %q, want %q", tt.line, rng.Description, tt.desc)
+		}
+		if blocked != tt.blocked {
+			t.Errorf("parseLine(%q) blocked = %v, want %v", tt.line, blocked, tt.blocked)
+		}
+	}
+}
+
+func TestParseLineErrors(t *testing.T) {
+	for _, line := range []string{
+		"1.2.3.0 - 1.2.3.255 , high , bad level",
+		"1.2.3.4-2001:db8::1",
+		"Bad peers:1.2.3.0-1.2.3.999",
+		"10.0.0.0/33",
+		"not an address",
+	} {
+		if _, _, err := parseLine(line); err == nil {
+			t.Errorf("parseLine(%q) succeeded, want error", line)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	list := `# comment
+// another comment
+
+001.002.003.000 - 001.002.003.255 , 100 , eMule
+Acme, Inc:5.6.7.0-5.6.7.255
+10.0.0.0/8
+`
+	ranges, err := Parse(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 3 {
+		t.Fatalf("got %d ranges, want 3", len(ranges))
+	}
+	if _, err := Parse(strings.NewReader("1.2.3.4\nbogus\n")); err == nil || !strings.Contains(err.Error(), "Line 2") {
+		t.Fatalf("error %v does not name line 2", err)
+	}
+
+	f := New(ranges)
+	for ip, want := range map[string]bool{
+		"1.2.3.4":  true,
+		"5.6.7.8":  true,
+		"10.1.2.3": true,
+		"11.0.0.1": false,
+	} {
+		if got, _ := f.Blocked(net.ParseIP(ip)); got != want {
+			t.Errorf("Blocked(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
@@ -2,25 +2,82 @@ package main
 
 import (
 	"bitDownloader/parser"
+	"context"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
+//子命令，args 不包含命令名称本身
+var commands = map[string]func(args []string) error{
+	"download": runDownload,
+	"verify":   runVerify,
+	"stream":   runStream,
+	"session":  runSession,
+	"create":   runCreate,
+	"info":     runInfo,
+	"edit":     runEdit,
+	"tracker":  runTracker,
+}
+
 func main() {
-	inpath, err := os.Open("testdata/test.torrent")
-	if err != nil {
-		panic(err)
+	//不带参数时保持原有行为，下载测试种子
+	if len(os.Args) < 2 {
+		err := runDownload([]string{"testdata/test.torrent", "result/test.mp4"})
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	tf, err := parser.Open(inpath)
-	tof, err := tf.ToTorrentFile()
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd(os.Args[2:]); err != nil {
+		log.Fatal(err)
+	}
+}
 
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage:")
+	fmt.Fprintln(os.Stderr, "  bitDownloader download [-only 0,2] [-priority 1=high,3=off] <torrent> <path>")
+	fmt.Fprintln(os.Stderr, "  bitDownloader verify [-v] <torrent> <path>")
+	fmt.Fprintln(os.Stderr, "  bitDownloader stream [-addr 127.0.0.1:8080] <torrent> <path>")
+	fmt.Fprintln(os.Stderr, "  bitDownloader session [-listen :6881] [-dir result] [-conns 50] [-downloads 3] [-seeds 3]")
+	fmt.Fprintln(os.Stderr, "                        [-ratio 2] [-seed-time 24h] [-seed-idle 1h]")
+	fmt.Fprintln(os.Stderr, "                        [-up KiB/s] [-down KiB/s] [-alt-up KiB/s] [-alt-down KiB/s] [-alt-time 08:00-18:00]")
+	fmt.Fprintln(os.Stderr, "                        [-ipfilter ipfilter.dat] [-proxy socks5://host:1080] [-proxy-only]")
+	fmt.Fprintln(os.Stderr, "                        [-transport prefer-tcp|prefer-utp|tcp|utp]")
+	fmt.Fprintln(os.Stderr, "                        <torrent|magnet>...")
+	fmt.Fprintln(os.Stderr, "  bitDownloader create [-t tracker[,tracker]]... [-w webseed]... [-o out.torrent] [-name name]")
+	fmt.Fprintln(os.Stderr, "                       [-piece-length KiB] [-comment text] [-private] [-source tag] <file|dir>")
+	fmt.Fprintln(os.Stderr, "  bitDownloader info [-json] <torrent>")
+	fmt.Fprintln(os.Stderr, "  bitDownloader edit [-announce url] [-t tracker[,tracker]]... [-replace old=new]... [-remove url]...")
+	fmt.Fprintln(os.Stderr, "                     [-w webseed]... [-comment text] [-created-by name] [-o out.torrent] <torrent|dir>...")
+	fmt.Fprintln(os.Stderr, "  bitDownloader tracker [-listen :6969] [-udp :6969] [-interval 30m] [-peer-timeout 1h] [-whitelist hashes.txt]")
+	fmt.Fprintln(os.Stderr, "                        [-real-ip-header X-Real-IP]")
+}
+
+//收到 Ctrl-C 或 SIGTERM 时取消，以便停止下载并保存已有数据
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+//读取并解析种子文件
+func loadTorrent(path string) (parser.TorrentFile, error) {
+	inpath, err := os.Open(path)
 	if err != nil {
-		log.Fatal(err)
+		return parser.TorrentFile{}, err
 	}
+	defer inpath.Close()
 
-	err = tof.DownloadToFile("result/test.mp4")
+	tf, err := parser.Open(inpath)
 	if err != nil {
-		log.Fatal(err)
+		return parser.TorrentFile{}, err
 	}
+	return tf.ToTorrentFile()
 }
@@ -0,0 +1,110 @@
+package merkle
+
+import (
+	"crypto/sha256"
+)
+
+//BitTorrent v2 (BEP 52) 使用的SHA-256 merkle树
+//叶子为文件中每个16KiB block的哈希，最后一个block不足16KiB时直接计算哈希
+//叶子数量不足2的幂时使用全零哈希补齐，更高层的补齐值为全零子树的哈希
+
+// BlockSize 叶子对应的block大小
+const BlockSize = 16384
+
+// BlockHashes 计算 data 中每个block的哈希
+func BlockHashes(data []byte) [][32]byte {
+	hashes := make([][32]byte, 0, (len(data)+BlockSize-1)/BlockSize)
+	for begin := 0; begin < len(data); begin += BlockSize {
+		end := begin + BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		hashes = append(hashes, sha256.Sum256(data[begin:end]))
+	}
+	return hashes
+}
+
+// Parent 两个子节点的父节点哈希
+func Parent(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// PadHash 由 leaves 个全零叶子组成的子树的根，leaves 需要为2的幂
+func PadHash(leaves int) [32]byte {
+	var h [32]byte
+	for ; leaves > 1; leaves /= 2 {
+		h = Parent(h, h)
+	}
+	return h
+}
+
+// NextPow2 不小于 n 的最小的2的幂
+func NextPow2(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
+
+// Log2 2的幂 n 的对数
+func Log2(n int) int {
+	l := 0
+	for n > 1 {
+		n /= 2
+		l++
+	}
+	return l
+}
+
+// Layers 由叶子构建整棵树，叶子使用 pad 补齐到 width 个，width 需要为2的幂
+// 返回值第0层为补齐后的叶子，最后一层只有根
+func Layers(leaves [][32]byte, width int, pad [32]byte) [][][32]byte {
+	layer := make([][32]byte, width)
+	copy(layer, leaves)
+	for i := len(leaves); i < width; i++ {
+		layer[i] = pad
+	}
+	layers := [][][32]byte{layer}
+	for len(layer) > 1 {
+		next := make([][32]byte, len(layer)/2)
+		for i := range next {
+			next[i] = Parent(layer[2*i], layer[2*i+1])
+		}
+		layers = append(layers, next)
+		layer = next
+	}
+	return layers
+}
+
+// Root 由叶子计算树根，参数与 Layers 相同
+func Root(leaves [][32]byte, width int, pad [32]byte) [32]byte {
+	layers := Layers(leaves, width, pad)
+	return layers[len(layers)-1][0]
+}
+
+// Proof 第0层第 index 个节点到根之间，从下至上每一层的兄弟节点，最多 n 层
+func Proof(layers [][][32]byte, index, n int) [][32]byte {
+	var uncles [][32]byte
+	for level := 0; level < len(layers)-1 && len(uncles) < n; level++ {
+		uncles = append(uncles, layers[level][index^1])
+		index /= 2
+	}
+	return uncles
+}
+
+// RootFromProof 由位于 index 处的节点以及 Proof 给出的兄弟节点计算根
+func RootFromProof(node [32]byte, index int, uncles [][32]byte) [32]byte {
+	for _, u := range uncles {
+		if index%2 == 0 {
+			node = Parent(node, u)
+		} else {
+			node = Parent(u, node)
+		}
+		index /= 2
+	}
+	return node
+}
@@ -0,0 +1,81 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestRoot(t *testing.T) {
+	data := bytes.Repeat([]byte{7}, 3*BlockSize+100)
+	leaves := BlockHashes(data)
+	if len(leaves) != 4 || leaves[3] != sha256.Sum256(data[3*BlockSize:]) {
+		t.Fatalf("got %d block hashes, last block hashed with padding", len(leaves))
+	}
+	want := Parent(Parent(leaves[0], leaves[1]), Parent(leaves[2], leaves[3]))
+	if got := Root(leaves, 4, [32]byte{}); got != want {
+		t.Errorf("Root = %x, want %x", got, want)
+	}
+
+	//补齐到8个叶子时右半边为全零子树
+	want = Parent(want, PadHash(4))
+	if got := Root(leaves, 8, [32]byte{}); got != want {
+		t.Errorf("padded Root = %x, want %x", got, want)
+	}
+	if PadHash(1) != ([32]byte{}) || PadHash(2) != Parent([32]byte{}, [32]byte{}) {
+		t.Error("PadHash of one or two leaves is wrong")
+	}
+}
+
+func TestProof(t *testing.T) {
+	var leaves [][32]byte
+	for i := 0; i < 5; i++ {
+		leaves = append(leaves, sha256.Sum256([]byte{byte(i)}))
+	}
+	layers := Layers(leaves, 8, [32]byte{})
+	root := layers[len(layers)-1][0]
+	for index := range layers[0] {
+		uncles := Proof(layers, index, len(layers))
+		if len(uncles) != 3 {
+			t.Fatalf("proof for leaf %d has %d uncles, want 3", index, len(uncles))
+		}
+		if got := RootFromProof(layers[0][index], index, uncles); got != root {
+			t.Errorf("leaf %d: root from proof %x, want %x", index, got, root)
+		}
+
+		//错误的节点、位置或者兄弟节点都不能得到根
+		if RootFromProof(sha256.Sum256([]byte("x")), index, uncles) == root {
+			t.Errorf("leaf %d: forged node verified", index)
+		}
+		//两个补齐叶子相同，交换位置不会改变根
+		if uncles[0] != layers[0][index] && RootFromProof(layers[0][index], index^1, uncles) == root {
+			t.Errorf("leaf %d: proof verified at the wrong index", index)
+		}
+		bad := append([][32]byte(nil), uncles...)
+		bad[1][0] ^= 1
+		if RootFromProof(layers[0][index], index, bad) == root {
+			t.Errorf("leaf %d: tampered proof verified", index)
+		}
+	}
+
+	//只取部分层时得到对应层的节点，例如piece层
+	uncles := Proof(layers, 5, 1)
+	if len(uncles) != 1 || RootFromProof(layers[0][5], 5, uncles) != layers[1][2] {
+		t.Error("partial proof does not reach the layer above")
+	}
+	//从较高的层开始证明
+	if RootFromProof(layers[1][1], 1, Proof(layers[1:], 1, 2)) != root {
+		t.Error("proof from layer 1 does not reach the root")
+	}
+}
+
+func TestPow2(t *testing.T) {
+	for _, tt := range []struct{ n, pow, log int }{{1, 1, 0}, {2, 2, 1}, {3, 4, 2}, {5, 8, 3}, {1024, 1024, 10}, {1025, 2048, 11}} {
+		if got := NextPow2(tt.n); got != tt.pow {
+			t.Errorf("NextPow2(%d) = %d, want %d", tt.n, got, tt.pow)
+		}
+		if got := Log2(tt.pow); got != tt.log {
+			t.Errorf("Log2(%d) = %d, want %d", tt.pow, got, tt.log)
+		}
+	}
+}
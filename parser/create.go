@@ -0,0 +1,296 @@
+package parser
+
+import (
+	"bitDownloader/bencode"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+//由本地的文件或目录创建种子
+
+// DefaultCreatedBy 创建种子时 created by 字段的默认值
+const DefaultCreatedBy = "bitDownloader"
+
+const (
+	minPieceLength = 16 << 10
+	maxPieceLength = 16 << 20
+	targetPieces   = 1500 //自动选择piece长度时期望的piece数量
+)
+
+// CreateOptions 创建种子的选项，零值表示不包含对应字段
+type CreateOptions struct {
+	Name        string //种子名称，为空时使用路径的最后一级
+	PieceLength int    //piece长度，需要为不小于16KiB的2的幂，0 表示根据总长度选择
+
+	Announce string //主tracker，为空时使用 AnnounceList 中的第一个
+	// AnnounceList 分层的tracker列表(BEP 12)，每一层内的tracker地位相同
+	AnnounceList [][]string
+	WebSeeds     []string //url-list(BEP 19)
+
+	Comment      string
+	CreatedBy    string    //为空时使用 DefaultCreatedBy
+	CreationDate time.Time //为零时使用当前时间
+	Private      bool      //私有种子(BEP 27)，只从tracker获取peers
+	Source       string    //写入info字典，使相同内容在不同站点发布时得到不同的infohash
+}
+
+//种子中的一个文件
+type sourceFile struct {
+	path   string   //磁盘上的路径
+	parts  []string //种子中的相对路径
+	length int
+}
+
+// Create 读取 path 指向的文件或目录，并行计算piece哈希，返回bencode编码的种子
+// 目录中的文件按照路径排序，只包含普通文件，符号链接被跳过
+func Create(path string, opts CreateOptions) ([]byte, error) {
+	files, single, err := collectFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	for _, f := range files {
+		total += f.length
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("No data to create a torrent from in %s", path)
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(total)
+	} else if pieceLength < minPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("Piece length %d is not a power of two of at least %d", pieceLength, minPieceLength)
+	}
+	pieces, err := hashPieces(files, total, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	name := opts.Name
+	if name == "" {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		name = filepath.Base(abs)
+	}
+	info := map[string]interface{}{
+		"name":         name,
+		"piece length": pieceLength,
+		"pieces":       string(pieces),
+	}
+	if single {
+		info["length"] = total
+	} else {
+		list := make([]interface{}, 0, len(files))
+		for _, f := range files {
+			list = append(list, map[string]interface{}{"length": f.length, "path": f.parts})
+		}
+		info["files"] = list
+	}
+	if opts.Private {
+		info["private"] = 1
+	}
+	if opts.Source != "" {
+		info["source"] = opts.Source
+	}
+
+	meta := map[string]interface{}{"info": info}
+	announce := opts.Announce
+	if announce == "" && len(opts.AnnounceList) > 0 && len(opts.AnnounceList[0]) > 0 {
+		announce = opts.AnnounceList[0][0]
+	}
+	if announce != "" {
+		meta["announce"] = announce
+	}
+	if len(opts.AnnounceList) > 0 {
+		tiers := make([]interface{}, 0, len(opts.AnnounceList))
+		for _, tier := range opts.AnnounceList {
+			if len(tier) > 0 {
+				tiers = append(tiers, tier)
+			}
+		}
+		meta["announce-list"] = tiers
+	}
+	if len(opts.WebSeeds) > 0 {
+		meta["url-list"] = opts.WebSeeds
+	}
+	if opts.Comment != "" {
+		meta["comment"] = opts.Comment
+	}
+	meta["created by"] = opts.CreatedBy
+	if opts.CreatedBy == "" {
+		meta["created by"] = DefaultCreatedBy
+	}
+	date := opts.CreationDate
+	if date.IsZero() {
+		date = time.Now()
+	}
+	meta["creation date"] = date.Unix()
+
+	return bencode.Marshal(meta)
+}
+
+//选择使piece数量接近 targetPieces 的piece长度
+func choosePieceLength(total int) int {
+	pieceLength := minPieceLength
+	for pieceLength < maxPieceLength && total/pieceLength > targetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+//列出种子包含的文件，single 表示 path 为单个文件
+func collectFiles(path string) (files []sourceFile, single bool, err error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if st.Mode().IsRegular() {
+		return []sourceFile{{path: path, parts: []string{st.Name()}, length: int(st.Size())}}, true, nil
+	}
+	if !st.IsDir() {
+		return nil, false, fmt.Errorf("%s is not a regular file or directory", path)
+	}
+	//WalkDir 按照字典序遍历，与按照路径分段排序相同
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, sourceFile{
+			path:   p,
+			parts:  strings.Split(filepath.ToSlash(rel), "/"),
+			length: int(info.Size()),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(files) == 0 {
+		return nil, false, fmt.Errorf("No files found in %s", path)
+	}
+	return files, false, nil
+}
+
+//按顺序读取全部文件并使用全部CPU核心计算每个piece的SHA-1
+func hashPieces(files []sourceFile, total, pieceLength int) ([]byte, error) {
+	numPieces := (total + pieceLength - 1) / pieceLength
+	hashes := make([]byte, numPieces*20)
+
+	type job struct {
+		index int
+		buf   []byte
+	}
+	workers := runtime.NumCPU()
+	jobs := make(chan job)
+	//复用piece缓冲，限制读取领先于哈希计算的数量
+	free := make(chan []byte, workers*2)
+	for i := 0; i < cap(free); i++ {
+		free <- make([]byte, pieceLength)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				hash := sha1.Sum(j.buf)
+				copy(hashes[j.index*20:], hash[:])
+				free <- j.buf[:pieceLength]
+			}
+		}()
+	}
+
+	r := &fileChain{files: files}
+	defer r.Close()
+	var err error
+	for index := 0; index < numPieces; index++ {
+		buf := <-free
+		size := pieceLength
+		if rest := total - index*pieceLength; rest < size {
+			size = rest
+		}
+		if _, err = io.ReadFull(r, buf[:size]); err != nil {
+			break
+		}
+		jobs <- job{index: index, buf: buf[:size]}
+	}
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+//按顺序读取多个文件的连续数据，同一时间只打开一个文件
+//每个文件只读取遍历时记录的长度，文件变短时返回错误
+type fileChain struct {
+	files []sourceFile
+	next  int
+	fd    *os.File
+	left  int //当前文件剩余的字节数
+}
+
+func (c *fileChain) Read(p []byte) (int, error) {
+	for c.fd == nil || c.left == 0 {
+		c.Close()
+		if c.next == len(c.files) {
+			return 0, io.EOF
+		}
+		f := c.files[c.next]
+		c.next++
+		if f.length == 0 {
+			continue
+		}
+		fd, err := os.Open(f.path)
+		if err != nil {
+			return 0, err
+		}
+		c.fd, c.left = fd, f.length
+	}
+	if len(p) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.fd.Read(p)
+	c.left -= n
+	if errors.Is(err, io.EOF) {
+		if c.left > 0 {
+			return n, fmt.Errorf("%s changed while hashing", c.fd.Name())
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// Close 关闭当前打开的文件
+func (c *fileChain) Close() error {
+	if c.fd == nil {
+		return nil
+	}
+	err := c.fd.Close()
+	c.fd = nil
+	return err
+}
@@ -0,0 +1,159 @@
+package parser
+
+import (
+	"bitDownloader/bencode"
+	"bytes"
+	"crypto/sha1"
+	"errors"
+)
+
+//修改种子外层字典中的tracker、注释以及web seed，info字典按原始字节保留，infohash不变
+
+// Editor 种子外层字典的编辑器，每个字段保存为原始编码，未修改的字段原样写回
+type Editor struct {
+	dict map[string]bencode.RawMessage
+}
+
+// NewEditor 解析种子文件的内容，外层字典的键可以没有排序，写回时会排序
+func NewEditor(data []byte) (*Editor, error) {
+	d := bencode.NewDecoder(bytes.NewReader(data))
+	d.AllowUnsortedKeys()
+	e := &Editor{}
+	if err := d.Decode(&e.dict); err != nil {
+		return nil, err
+	}
+	if d.InputOffset() != int64(len(data)) {
+		return nil, errors.New("Trailing data after torrent dictionary")
+	}
+	if e.dict["info"] == nil {
+		return nil, errors.New("Torrent has no info dictionary")
+	}
+	return e, nil
+}
+
+// InfoHash 原始info字典的SHA-1，编辑不会改变它
+func (e *Editor) InfoHash() [20]byte {
+	return sha1.Sum(e.dict["info"])
+}
+
+//读取字段，字段不存在或类型不符时保持 v 不变
+func (e *Editor) get(key string, v interface{}) {
+	if raw, ok := e.dict[key]; ok {
+		bencode.Unmarshal(raw, v)
+	}
+}
+
+//设置字段，empty 为真时删除该字段
+func (e *Editor) set(key string, v interface{}, empty bool) error {
+	if empty {
+		delete(e.dict, key)
+		return nil
+	}
+	raw, err := bencode.Marshal(v)
+	if err != nil {
+		return err
+	}
+	e.dict[key] = raw
+	return nil
+}
+
+// Announce 当前的主tracker
+func (e *Editor) Announce() string {
+	var announce string
+	e.get("announce", &announce)
+	return announce
+}
+
+// AnnounceList 当前分层的tracker列表
+func (e *Editor) AnnounceList() [][]string {
+	var v interface{}
+	e.get("announce-list", &v)
+	return parseAnnounceList(v)
+}
+
+// SetAnnounce 设置主tracker，为空时删除
+func (e *Editor) SetAnnounce(announce string) error {
+	return e.set("announce", announce, announce == "")
+}
+
+// SetAnnounceList 设置分层的tracker列表，忽略空的层，全部为空时删除
+func (e *Editor) SetAnnounceList(tiers [][]string) error {
+	var list [][]string
+	for _, tier := range tiers {
+		var urls []string
+		for _, tr := range tier {
+			if tr != "" {
+				urls = append(urls, tr)
+			}
+		}
+		if len(urls) > 0 {
+			list = append(list, urls)
+		}
+	}
+	return e.set("announce-list", list, len(list) == 0)
+}
+
+// ReplaceTracker 将 announce 以及 announce-list 中的 old 替换为 new，new 为空时删除 old
+// 主tracker被删除时使用列表中的第一个，返回替换的数量
+func (e *Editor) ReplaceTracker(old, new string) (int, error) {
+	n := 0
+	tiers := e.AnnounceList()
+	for i, tier := range tiers {
+		for j, tr := range tier {
+			if tr == old {
+				tiers[i][j] = new
+				n++
+			}
+		}
+	}
+	if n > 0 {
+		if err := e.SetAnnounceList(tiers); err != nil {
+			return n, err
+		}
+	}
+	if e.Announce() == old {
+		n++
+		if new == "" {
+			if list := e.AnnounceList(); len(list) > 0 {
+				new = list[0][0]
+			}
+		}
+		if err := e.SetAnnounce(new); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// SetComment 设置注释，为空时删除
+func (e *Editor) SetComment(comment string) error {
+	return e.set("comment", comment, comment == "")
+}
+
+// SetCreatedBy 设置 created by，为空时删除
+func (e *Editor) SetCreatedBy(createdBy string) error {
+	return e.set("created by", createdBy, createdBy == "")
+}
+
+// WebSeeds 当前的web seed地址
+func (e *Editor) WebSeeds() []string {
+	var v interface{}
+	e.get("url-list", &v)
+	return parseURLList(v)
+}
+
+// SetWebSeeds 设置 url-list，为空时删除
+func (e *Editor) SetWebSeeds(urls []string) error {
+	var list []string
+	for _, u := range urls {
+		if u != "" {
+			list = append(list, u)
+		}
+	}
+	return e.set("url-list", list, len(list) == 0)
+}
+
+// Bytes 返回编辑后的种子，外层字典的键按规范排序，info字典与原始字节相同
+func (e *Editor) Bytes() ([]byte, error) {
+	return bencode.Marshal(e.dict)
+}
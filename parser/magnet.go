@@ -0,0 +1,177 @@
+package parser
+
+import (
+	"bitDownloader/downloader"
+	"bitDownloader/ipfilter"
+	"bitDownloader/peer"
+	"bitDownloader/proxy"
+	"context"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+// Magnet 磁力链接，只包含infohash、名称以及tracker地址，info字典需要从peers处获取
+type Magnet struct {
+	InfoHash [20]byte //只有v2 infohash时为其前20字节
+	Name     string   //dn 参数，仅用于显示
+	Trackers []string //tr 参数
+	// InfoHashV2 urn:btmh 给出的SHA-256 infohash，没有时为零
+	InfoHashV2 [32]byte
+
+	// IPFilter 获取元数据时跳过被屏蔽的peer，为空时不过滤
+	IPFilter *ipfilter.Filter
+	// Proxy tracker请求以及获取元数据的连接经过该代理，为空时直接连接
+	Proxy *proxy.Proxy
+	// Dialer 获取元数据时连接peer使用的拨号器，为空时使用 Proxy
+	Dialer downloader.Dialer
+}
+
+// ParseMagnet 解析 magnet:?xt=urn:btih:<infohash>&dn=<name>&tr=<tracker> 形式的链接
+// infohash 可以是40位十六进制或32位base32编码
+// v2以及混合种子的链接使用 xt=urn:btmh:1220<64位十六进制> 给出v2 infohash
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("Not a magnet link: %s", uri)
+	}
+	q := u.Query()
+	m := &Magnet{Name: q.Get("dn"), Trackers: q["tr"]}
+	foundV1, foundV2 := false, false
+	for _, xt := range q["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:") && !foundV1:
+			m.InfoHash, err = decodeInfoHash(strings.TrimPrefix(xt, "urn:btih:"))
+			foundV1 = true
+		case strings.HasPrefix(xt, "urn:btmh:") && !foundV2:
+			m.InfoHashV2, err = decodeMultihash(strings.TrimPrefix(xt, "urn:btmh:"))
+			foundV2 = true
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !foundV1 && !foundV2 {
+		return nil, fmt.Errorf("Magnet link has no urn:btih or urn:btmh infohash")
+	}
+	//纯v2种子使用截断的v2 infohash连接peer以及tracker
+	if !foundV1 {
+		copy(m.InfoHash[:], m.InfoHashV2[:20])
+	}
+	return m, nil
+}
+
+//解析SHA-256 multihash：0x12 表示SHA-256，0x20 为摘要长度
+func decodeMultihash(s string) ([32]byte, error) {
+	var hash [32]byte
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		return hash, err
+	}
+	if len(buf) != 34 || buf[0] != 0x12 || buf[1] != 0x20 {
+		return hash, fmt.Errorf("Unsupported multihash %s", s)
+	}
+	copy(hash[:], buf[2:])
+	return hash, nil
+}
+
+func decodeInfoHash(s string) ([20]byte, error) {
+	var hash [20]byte
+	var buf []byte
+	var err error
+	switch len(s) {
+	case 40:
+		buf, err = hex.DecodeString(s)
+	case 32:
+		buf, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return hash, fmt.Errorf("Invalid infohash length %d", len(s))
+	}
+	if err != nil {
+		return hash, err
+	}
+	copy(hash[:], buf)
+	return hash, nil
+}
+
+// MagnetURI 生成种子的磁力链接，包含infohash、名称、全部tracker以及web seed
+// v2种子使用 urn:btmh，混合种子同时包含 urn:btih 以及 urn:btmh
+func (t *TorrentFile) MagnetURI() string {
+	var params []string
+	if t.MetaVersion == 1 || t.Hybrid() {
+		params = append(params, "xt=urn:btih:"+hex.EncodeToString(t.InfoHash[:]))
+	}
+	if t.MetaVersion == 2 {
+		params = append(params, "xt=urn:btmh:1220"+hex.EncodeToString(t.InfoHashV2[:]))
+	}
+	if t.Name != "" {
+		params = append(params, "dn="+url.QueryEscape(t.Name))
+	}
+	seen := make(map[string]bool)
+	for _, tier := range t.Trackers() {
+		for _, tr := range tier {
+			if !seen[tr] {
+				seen[tr] = true
+				params = append(params, "tr="+url.QueryEscape(tr))
+			}
+		}
+	}
+	for _, ws := range t.WebSeeds {
+		params = append(params, "ws="+url.QueryEscape(ws))
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
+
+// Resolve 向链接中的tracker获取peers，再通过 ut_metadata 从peers处获取info字典，返回完整的种子
+// 生成的种子使用第一个可用的tracker作为 Announce
+func (m *Magnet) Resolve(ctx context.Context, peerID [20]byte, port uint16) (TorrentFile, error) {
+	var peers []peer.Peer
+	announce := ""
+	for _, tr := range m.Trackers {
+		tracker := NewTracker(&TorrentFile{Announce: tr, InfoHash: m.InfoHash}, peerID, port, m.Proxy)
+		//此时还不知道种子的长度，left 只需要表明我们还不是做种者
+		found, err := tracker.Announce(ctx, downloader.EventNone, downloader.AnnounceStats{Left: 1})
+		if err != nil {
+			log.Printf("Could not announce to %s: %v\n", tr, err)
+			continue
+		}
+		if announce == "" {
+			announce = tr
+		}
+		for _, p := range found {
+			if blocked, _ := m.IPFilter.Blocked(p.Ip); !blocked {
+				peers = append(peers, p)
+			}
+		}
+	}
+	if len(peers) == 0 {
+		return TorrentFile{}, downloader.ErrNoPeers
+	}
+
+	dialer := m.Dialer
+	if dialer == nil && m.Proxy != nil {
+		dialer = m.Proxy
+	}
+	raw, err := downloader.FetchMetadata(ctx, dialer, peers, peerID, m.InfoHash)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	info, err := parseInfo(raw)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	t, err := newTorrentFile(announce, info, raw)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	if m.InfoHashV2 != [32]byte{} && t.InfoHashV2 != m.InfoHashV2 {
+		return TorrentFile{}, fmt.Errorf("Metadata does not match v2 infohash %x", m.InfoHashV2)
+	}
+	return t, nil
+}
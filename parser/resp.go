@@ -1,12 +1,16 @@
 package parser
 
 import (
+	"bitDownloader/bencode"
+	"bitDownloader/downloader"
 	"bitDownloader/peer"
+	"bitDownloader/proxy"
+	"context"
 	"encoding/binary"
 	"fmt"
-	"github.com/jackpal/bencode-go"
 	"net"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -23,7 +27,7 @@ func Unmarshal(peersBin []byte) ([]peer.Peer, error) {
 	peers := make([]peer.Peer, numPeers)
 	for i := 0; i < numPeers; i++ {
 		var peer peer.Peer
-		var tmp []byte
+		tmp := make([]byte, peerSize)
 		copy(tmp, peersBin[i*peerSize:(i+1)*peerSize])
 		ip := net.IP(tmp[0:4])
 		port := binary.BigEndian.Uint16(tmp[4:6])
@@ -35,26 +39,60 @@ func Unmarshal(peersBin []byte) ([]peer.Peer, error) {
 
 }
 
-//获取到url之后，发起get请求并解析列表
-func (t *TorrentFile) requestPeers(peerID [20]byte, port uint16) ([]peer.Peer, error) {
-	trackerURL, err := t.buildTrackerURL(peerID, port)
+//tracker响应的最大长度，避免恶意tracker返回过大的数据
+const maxResponseSize = 4 << 20
+
+// NewTracker 根据announce地址的协议创建HTTP或UDP tracker，p 不为空时全部请求经过代理
+func NewTracker(t *TorrentFile, peerID [20]byte, port uint16, p *proxy.Proxy) downloader.Tracker {
+	if u, err := url.Parse(t.Announce); err == nil && u.Scheme == "udp" {
+		return &udpTracker{t: t, peerID: peerID, port: port, proxy: p}
+	}
+	return &httpTracker{t: t, peerID: peerID, port: port, client: p.HTTPClient(10 * time.Second)}
+}
+
+// httpTracker 通过种子的announce地址汇报下载状态，实现 downloader.Tracker
+type httpTracker struct {
+	t      *TorrentFile
+	peerID [20]byte
+	port   uint16
+	client *http.Client
+}
+
+// Announce 向tracker汇报事件并获取peers
+func (h *httpTracker) Announce(ctx context.Context, event string, stats downloader.AnnounceStats) ([]peer.Peer, error) {
+	trackerURL, err := h.t.buildTrackerURL(h.peerID, h.port, event, stats)
 	if err != nil {
 		return nil, err
 	}
+	return requestPeers(ctx, h.client, trackerURL)
+}
 
-	fmt.Println(trackerURL)
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(trackerURL)
+//获取到url之后，发起get请求并解析列表
+func requestPeers(ctx context.Context, client *http.Client, trackerURL string) ([]peer.Peer, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, trackerURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	} //尝试获取信息
 	defer resp.Body.Close()
 
-	result := make(map[string]interface{})
-	err = bencode.Unmarshal(resp.Body, result)
-	if err != nil {
+	//部分tracker输出的字典没有排序
+	d := bencode.NewDecoder(resp.Body)
+	d.AllowUnsortedKeys()
+	d.MaxSize = maxResponseSize
+	var result map[string]interface{}
+	if err := d.Decode(&result); err != nil {
 		return nil, err
 	}
-	return Unmarshal([]byte(result["peers"].(string)))
+	if reason, ok := result["failure reason"].(string); ok {
+		return nil, fmt.Errorf("Tracker failure: %s", reason)
+	}
+	peers, ok := result["peers"].(string)
+	if !ok {
+		return nil, fmt.Errorf("Tracker response has no compact peers")
+	}
+	return Unmarshal([]byte(peers))
 }
@@ -1,16 +1,22 @@
 package parser
 
 import (
+	"bitDownloader/bencode"
 	"bitDownloader/downloader"
+	"bitDownloader/peer"
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
 	"fmt"
-	"github.com/jackpal/bencode-go"
 	"io"
+	"log"
 	"math/rand"
 	"net/url"
-	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 //提供种子文件的解析工作
@@ -18,21 +24,24 @@ import (
 // BencodeInfo 解析结构体
 type BencodeInfo struct {
 	//各个种子信息字段
-	Pieces      string `bencode:"pieces"`      //binary blob of the hashes of each piece
-	PieceLength int    `bencode:"pieceLength"` //分片长度
-	Length      int    `bencode:"length"`      //总长度
-	Name        string `bencode:"mame"`
+	Pieces      string        `bencode:"pieces"`           //binary blob of the hashes of each piece
+	PieceLength int           `bencode:"piece length"`     //分片长度
+	Length      int           `bencode:"length,omitempty"` //总长度，仅单文件种子
+	Name        string        `bencode:"name"`
+	Files       []BencodeFile `bencode:"files,omitempty"`        //文件列表，仅多文件种子
+	MetaVersion int           `bencode:"meta version,omitempty"` //2 表示v2或混合种子
+	//可选字段类型错误时忽略，不影响打开种子
+	Private interface{} `bencode:"private,omitempty"` //1 表示私有种子(BEP 27)
+	Source  interface{} `bencode:"source,omitempty"`
+
+	fileTree []v2File //由 file tree 展开的v2文件列表，v1种子为空
 }
 
-//使用sha1 获取编码
-func (i *BencodeInfo) hash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, *i)
-	if err != nil {
-		//返回空
-		return [20]byte{}, err
-	}
-	return sha1.Sum(buf.Bytes()), nil
+// BencodeFile 多文件种子中的单个文件
+type BencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+	Attr   string   `bencode:"attr,omitempty"` //包含 p 时为用于对齐的padding文件(BEP 47)
 }
 
 func (i *BencodeInfo) splitPieceHashes() ([][20]byte, error) {
@@ -56,69 +65,256 @@ func (i *BencodeInfo) splitPieceHashes() ([][20]byte, error) {
 
 // BencodeTorrent 解析种子
 type BencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     BencodeInfo `bencode:"info"`
+	Announce string `bencode:"announce,omitempty"`
+	//以下可选字段按照原样解析，格式错误的值被忽略，不影响打开种子
+	AnnounceList interface{} `bencode:"announce-list,omitempty"` //分层的tracker列表(BEP 12)
+	URLList      interface{} `bencode:"url-list,omitempty"`      //web seed(BEP 19)，单个地址或地址列表
+	HTTPSeeds    interface{} `bencode:"httpseeds,omitempty"`     //按piece提供数据的HTTP seed(BEP 17)
+	Comment      interface{} `bencode:"comment,omitempty"`
+	CreatedBy    interface{} `bencode:"created by,omitempty"`
+	CreationDate interface{} `bencode:"creation date,omitempty"` //Unix时间
+	// RawInfo info字典的原始bencode编码，用于计算infohash
+	RawInfo bencode.RawMessage `bencode:"info"`
+	// PieceLayers v2种子的 piece layers，键为文件的pieces root
+	PieceLayers map[string]string `bencode:"piece layers,omitempty"`
+
+	Info BencodeInfo `bencode:"-"` //由 RawInfo 解析
 }
 
 // TorrentFile 标识结构体
 type TorrentFile struct {
 	Announce    string     //发布者
-	InfoHash    [20]byte   //当前info的哈希
-	PieceHashes [][20]byte //全部的哈希
+	InfoHash    [20]byte   //当前info的哈希，纯v2种子为截断的v2 infohash
+	PieceHashes [][20]byte //全部的哈希，纯v2种子全部为零
 	PieceLength int        //某块长度
 	Length      int        //完整长度
 	Name        string     //资源名称
+	Files       []File     //多文件种子的文件列表，单文件种子为空
+
+	AnnounceList [][]string //分层的tracker列表，为空时只使用 Announce
+	WebSeeds     []string   //url-list 中的web seed地址
+	HTTPSeeds    []string   //httpseeds 中的HTTP seed地址
+	Private      bool       //私有种子(BEP 27)，peers本来就只来自tracker，下载时不需要额外限制
+	Source       string
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time //种子中没有时为零
+
+	MetaVersion int      //1 为v1种子，2 为v2或混合种子
+	InfoHashV2  [32]byte //v2以及混合种子info字典的SHA-256，v1种子为零
+	PiecesRoot  [32]byte //单文件v2种子的merkle树根
+	// PieceLayers 由pieces root索引的piece layer，只包含超过一个piece的文件，缺失的在下载时获取
+	PieceLayers map[[32]byte][][32]byte
+}
+
+// File 多文件种子中的单个文件
+type File struct {
+	Path       []string            //相对路径的各级目录以及文件名
+	Length     int                 //文件长度
+	Priority   downloader.Priority //下载优先级，PriorityOff 表示跳过该文件
+	PiecesRoot [32]byte            //v2文件的merkle树根，v1种子以及空文件为零
+	Padding    bool                //用于对齐piece边界的padding文件，不会写入磁盘
+}
+
+// Hybrid 是否为同时包含v1以及v2元数据的混合种子
+func (t *TorrentFile) Hybrid() bool {
+	return t.MetaVersion == 2 && !bytes.Equal(t.InfoHash[:], t.InfoHashV2[:20])
 }
 
 // Open 由输入流中读取输入
 func Open(r io.Reader) (*BencodeTorrent, error) {
 	b := &BencodeTorrent{}
-	err := bencode.Unmarshal(r, b)
+	//许多种子外层字典的键没有排序，infohash由原始的info编码计算，外层字典不需要是规范形式
+	//info字典仍然由 parseInfo 严格解析
+	d := bencode.NewDecoder(r)
+	d.AllowUnsortedKeys()
+	if err := d.Decode(b); err != nil {
+		return nil, err
+	}
+	//info字典中可能包含结构体以外的字段，infohash需要由原始编码计算
+	if b.RawInfo == nil {
+		return nil, errors.New("Torrent has no info dictionary")
+	}
+	info, err := parseInfo(b.RawInfo)
 	if err != nil {
 		return nil, err
 	}
+	b.Info = info
 	return b, nil
 }
 
+//由info字典的bencode编码解析，用于磁力链接获取到的元数据
+func parseInfo(raw []byte) (BencodeInfo, error) {
+	info := BencodeInfo{}
+	if err := bencode.Unmarshal(raw, &info); err != nil {
+		return info, err
+	}
+	var tree struct {
+		FileTree map[string]interface{} `bencode:"file tree"`
+	}
+	if err := bencode.Unmarshal(raw, &tree); err != nil {
+		return info, err
+	}
+	var err error
+	info.fileTree, err = parseFileTree(tree.FileTree)
+	return info, err
+}
+
 //转化方法
 func (bto BencodeTorrent) ToTorrentFile() (TorrentFile, error) {
-
-	hash, err := bto.Info.hash()
+	raw := []byte(bto.RawInfo)
+	if raw == nil {
+		//未经 Open 解析时由结构体重新编码，只适用于v1种子
+		var err error
+		if raw, err = bencode.Marshal(bto.Info); err != nil {
+			return TorrentFile{}, err
+		}
+	}
+	t, err := newTorrentFile(bto.Announce, bto.Info, raw)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	//接下来进行分割
-	pieceHashes, err := bto.Info.splitPieceHashes()
+	if t.MetaVersion == 2 {
+		t.PieceLayers, err = parsePieceLayers(bto.PieceLayers, bto.Info.fileTree, t.PieceLength)
+		if err != nil {
+			return TorrentFile{}, err
+		}
+	}
+	t.AnnounceList = parseAnnounceList(bto.AnnounceList)
+	t.WebSeeds = parseURLList(bto.URLList)
+	t.HTTPSeeds = parseURLList(bto.HTTPSeeds)
+	t.Comment, _ = bto.Comment.(string)
+	t.CreatedBy, _ = bto.CreatedBy.(string)
+	if date, ok := bto.CreationDate.(int64); ok && date > 0 {
+		t.CreationDate = time.Unix(date, 0)
+	}
+	return t, nil
+}
 
-	if err != nil {
-		return TorrentFile{}, err
+//分层的tracker列表，忽略非字符串的地址以及空的层
+//部分种子的 announce-list 没有分层，此时每个地址作为单独的一层
+func parseAnnounceList(v interface{}) [][]string {
+	list, _ := v.([]interface{})
+	var tiers [][]string
+	for _, item := range list {
+		var tier []string
+		switch item := item.(type) {
+		case string:
+			if item != "" {
+				tier = []string{item}
+			}
+		case []interface{}:
+			tier = parseURLList(item)
+		}
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
 	}
+	return tiers
+}
 
-	t := TorrentFile{
-		Announce:    bto.Announce,
-		InfoHash:    hash,
-		PieceHashes: pieceHashes,
-		PieceLength: bto.Info.PieceLength,
-		Length:      bto.Info.Length,
-		Name:        bto.Info.Name,
+//url-list 以及 httpseeds 可以是单个地址或者地址列表，忽略空地址以及非字符串的值
+func parseURLList(v interface{}) []string {
+	switch list := v.(type) {
+	case string:
+		if list != "" {
+			return []string{list}
+		}
+	case []interface{}:
+		var urls []string
+		for _, u := range list {
+			if s, ok := u.(string); ok && s != "" {
+				urls = append(urls, s)
+			}
+		}
+		return urls
 	}
-	return t, nil
+	return nil
 }
 
-// DownloadToFile downloads a torrent and writes it to a file
-func (t *TorrentFile) DownloadToFile(path string) error {
-	var peerID [20]byte
-	_, err := rand.Read(peerID[:])
-	if err != nil {
-		return err
+// Trackers 按层返回全部tracker地址，没有 announce-list 时只有 Announce 一层
+func (t *TorrentFile) Trackers() [][]string {
+	if len(t.AnnounceList) > 0 {
+		return t.AnnounceList
 	}
+	if t.Announce != "" {
+		return [][]string{{t.Announce}}
+	}
+	return nil
+}
+
+//private 字段为1时是私有种子，同时接受字符串形式的 "1"
+func isPrivate(v interface{}) bool {
+	switch v := v.(type) {
+	case int64:
+		return v == 1
+	case int:
+		return v == 1
+	case string:
+		return v == "1"
+	}
+	return false
+}
+
+//由info字典以及其bencode编码构建种子，infohash由编码计算
+func newTorrentFile(announce string, info BencodeInfo, raw []byte) (TorrentFile, error) {
+	t := TorrentFile{
+		Announce:    announce,
+		InfoHash:    sha1.Sum(raw),
+		PieceLength: info.PieceLength,
+		Length:      info.Length,
+		Name:        info.Name,
+		MetaVersion: 1,
+		Private:     isPrivate(info.Private),
+	}
+	t.Source, _ = info.Source.(string)
+	if t.PieceLength <= 0 {
+		return TorrentFile{}, fmt.Errorf("Invalid piece length %d", t.PieceLength)
+	}
+	switch info.MetaVersion {
+	case 0, 1:
+	case 2:
+		if err := checkPieceLengthV2(info.PieceLength); err != nil {
+			return TorrentFile{}, err
+		}
+		if info.fileTree == nil {
+			return TorrentFile{}, errors.New("v2 torrent has no file tree")
+		}
+		t.MetaVersion = 2
+		t.InfoHashV2 = sha256.Sum256(raw)
+		//纯v2种子没有v1哈希，握手以及tracker使用截断的v2 infohash
+		if info.Pieces == "" {
+			copy(t.InfoHash[:], t.InfoHashV2[:20])
+			t.layoutV2(info.fileTree)
+			return t, nil
+		}
+	default:
+		return TorrentFile{}, fmt.Errorf("Unsupported meta version %d", info.MetaVersion)
+	}
+
+	//接下来进行分割
+	pieceHashes, err := info.splitPieceHashes()
 
-	peers, err := t.requestPeers(peerID, 6881)
 	if err != nil {
-		return err
+		return TorrentFile{}, err
+	}
+	t.PieceHashes = pieceHashes
+	//多文件种子的总长度为全部文件长度之和
+	for _, f := range info.Files {
+		t.Files = append(t.Files, File{Path: f.Path, Length: f.Length, Padding: strings.Contains(f.Attr, "p")})
+		t.Length += f.Length
 	}
+	if t.MetaVersion == 2 {
+		if err := t.attachRoots(info.fileTree); err != nil {
+			return TorrentFile{}, err
+		}
+	}
+	return t, nil
+}
 
-	torrent := downloader.Torrent{
+//构建下载器使用的种子描述
+func (t *TorrentFile) toTorrent(peers []peer.Peer, peerID [20]byte) *downloader.Torrent {
+	torrent := &downloader.Torrent{
 		Peers:       peers,
 		PeerID:      peerID,
 		InfoHash:    t.InfoHash,
@@ -126,27 +322,98 @@ func (t *TorrentFile) DownloadToFile(path string) error {
 		PieceLength: t.PieceLength,
 		Length:      t.Length,
 		Name:        t.Name,
+		InfoHashV2:  t.InfoHashV2,
+		PiecesRoot:  t.PiecesRoot,
+		WebSeeds:    t.WebSeeds,
+		HTTPSeeds:   t.HTTPSeeds,
+	}
+	//下载过程中获取到的piece layer会写入该map，不能与 TorrentFile 共享
+	if len(t.PieceLayers) > 0 {
+		torrent.PieceLayers = make(map[[32]byte][][32]byte, len(t.PieceLayers))
+		for root, layer := range t.PieceLayers {
+			torrent.PieceLayers[root] = layer
+		}
+	}
+	for _, f := range t.Files {
+		torrent.Files = append(torrent.Files, downloader.File{
+			Path:       f.Path,
+			Length:     f.Length,
+			Priority:   f.Priority,
+			PiecesRoot: f.PiecesRoot,
+			Padding:    f.Padding,
+		})
 	}
-	buf, err := torrent.Download()
+	return torrent
+}
+
+// Verify 校验 path 中已有的数据，单文件种子的 path 为文件路径，多文件种子的 path 为目录
+// 种子文件没有通过 Validate 时不打开任何文件，直接返回错误
+func (t *TorrentFile) Verify(path string) (*downloader.VerifyResult, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	torrent := t.toTorrent(nil, [20]byte{})
+	storage := torrent.OpenStorage(path)
+	defer storage.Close()
+	return torrent.Verify(storage), nil
+}
+
+// NewTorrent 生成随机的peer ID并向tracker汇报 started 获取peers，返回可以开始下载的种子
+func (t *TorrentFile) NewTorrent(ctx context.Context) (*downloader.Torrent, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	var peerID [20]byte
+	_, err := rand.Read(peerID[:])
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	outFile, err := os.Create(path)
+	torrent := t.Torrent(peerID, 6881)
+	peers, err := torrent.Tracker.Announce(ctx, downloader.EventStarted, downloader.AnnounceStats{Left: int64(t.Length)})
 	if err != nil {
-		return err
+		//有web seed时没有peers也可以下载
+		if len(t.WebSeeds) == 0 && len(t.HTTPSeeds) == 0 {
+			return nil, err
+		}
+		log.Printf("Could not announce, downloading from web seeds only: %v\n", err)
 	}
-	defer outFile.Close()
-	_, err = outFile.Write(buf)
+	torrent.Peers = peers
+	return torrent, nil
+}
+
+// Torrent 使用给定的peer ID以及监听端口构建种子，尚未向tracker汇报，Peers 为空
+// 可以之后调用 Announce 获取peers
+func (t *TorrentFile) Torrent(peerID [20]byte, port uint16) *downloader.Torrent {
+	torrent := t.toTorrent(nil, peerID)
+	torrent.Tracker = NewTracker(t, peerID, port, nil)
+	return torrent
+}
+
+// DownloadToFile downloads a torrent and writes it to a file
+// 下载前会先校验 path 中已有的数据，只下载缺失或损坏的piece
+func (t *TorrentFile) DownloadToFile(path string) error {
+	return t.DownloadToFileContext(context.Background(), path)
+}
+
+// DownloadToFileContext 与 DownloadToFile 相同，ctx 取消时停止下载，已经下载的数据会保留在磁盘上
+func (t *TorrentFile) DownloadToFileContext(ctx context.Context, path string) error {
+	torrent, err := t.NewTorrent(ctx)
 	if err != nil {
 		return err
 	}
-	return nil
+	storage := torrent.OpenStorage(path)
+	defer storage.Close()
+
+	res := torrent.Verify(storage)
+	log.Printf("Verified %d of %d pieces already on disk\n", res.Verified, len(t.PieceHashes))
+
+	return torrent.DownloadToContext(ctx, storage)
 }
 
 //接下来需要向服务器声明作为一个种子接收者，并且需要发送get请求，携带相关参数
 //peerID 随机生成的20字节 port端口，填充参数
-func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, error) {
+func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16, event string, stats downloader.AnnounceStats) (string, error) {
 	base, err := url.Parse(t.Announce)
 	if err != nil {
 		return "", err
@@ -157,10 +424,13 @@ func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, err
 		"info_hash":  []string{string(t.InfoHash[:])},
 		"peer_id":    []string{string(peerID[:])},
 		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
+		"uploaded":   []string{strconv.FormatInt(stats.Uploaded, 10)},
+		"downloaded": []string{strconv.FormatInt(stats.Downloaded, 10)},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(t.Length)},
+		"left":       []string{strconv.FormatInt(stats.Left, 10)},
+	}
+	if event != downloader.EventNone {
+		paras.Set("event", event)
 	}
 	base.RawQuery = paras.Encode()
 
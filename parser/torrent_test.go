@@ -0,0 +1,100 @@
+package parser
+
+import (
+	"bitDownloader/bencode"
+	"bytes"
+	"crypto/sha1"
+	"strings"
+	"testing"
+)
+
+//最小的单文件info字典
+func testInfo(t *testing.T) []byte {
+	t.Helper()
+	info, err := bencode.Marshal(map[string]interface{}{
+		"name":         "a.bin",
+		"length":       3,
+		"piece length": 16384,
+		"pieces":       strings.Repeat("x", 20),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestOpenUnsortedTopLevelKeys(t *testing.T) {
+	info := testInfo(t)
+	data := append(append([]byte("d4:info"), info...), "8:announce3:urle"...)
+
+	bto, err := Open(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := bto.ToTorrentFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tf.Announce != "url" {
+		t.Errorf("Announce = %q", tf.Announce)
+	}
+	if tf.InfoHash != sha1.Sum(info) {
+		t.Errorf("infohash %x does not match raw info", tf.InfoHash)
+	}
+	e, err := NewEditor(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.InfoHash() != tf.InfoHash {
+		t.Errorf("editor infohash %x, torrent infohash %x", e.InfoHash(), tf.InfoHash)
+	}
+}
+
+func TestOpenRejectsNonCanonicalInfo(t *testing.T) {
+	//info字典的键没有排序
+	info := "d6:lengthi3e4:name5:a.bin6:pieces20:" + strings.Repeat("x", 20) + "12:piece lengthi16384ee"
+	if _, err := Open(strings.NewReader("d4:info" + info + "e")); err == nil {
+		t.Fatal("non-canonical info dictionary was accepted")
+	}
+}
+
+func TestOpenDropsMalformedOptionalFields(t *testing.T) {
+	info := string(testInfo(t))
+	tests := []struct {
+		name     string
+		extra    string //按键排序插入 info 之前的字段
+		trackers [][]string
+	}{
+		{"flat announce-list", "13:announce-listl3:url4:url2e", [][]string{{"url"}, {"url2"}}},
+		{"mixed announce-list", "13:announce-listll3:urli1eei5ee", [][]string{{"url"}}},
+		{"announce-list string", "13:announce-list3:url", nil},
+		{"comment integer", "7:commenti1e", nil},
+		{"creation date string", "13:creation date4:todo", nil},
+		{"url-list integer", "8:url-listi1e", nil},
+	}
+	for _, tt := range tests {
+		data := "d" + tt.extra + "4:info" + info + "e"
+		bto, err := Open(strings.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		tf, err := bto.ToTorrentFile()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(tf.AnnounceList) != len(tt.trackers) {
+			t.Errorf("%s: announce list %q, want %q", tt.name, tf.AnnounceList, tt.trackers)
+			continue
+		}
+		for i := range tt.trackers {
+			if strings.Join(tf.AnnounceList[i], ",") != strings.Join(tt.trackers[i], ",") {
+				t.Errorf("%s: announce list %q, want %q", tt.name, tf.AnnounceList, tt.trackers)
+			}
+		}
+		if tf.Comment != "" || !tf.CreationDate.IsZero() || tf.WebSeeds != nil {
+			t.Errorf("%s: malformed value kept", tt.name)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package parser
+
+import (
+	"bitDownloader/downloader"
+	"bitDownloader/peer"
+	"bitDownloader/proxy"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+)
+
+//UDP tracker 协议 (BEP 15)，经过SOCKS5代理时使用 UDP ASSOCIATE
+
+const (
+	udpProtocolID     = 0x41727101980
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionError    = 3
+	udpRetries        = 3               //每个请求的发送次数
+	udpTimeout        = 5 * time.Second //第一次等待回复的时间，之后每次翻倍
+)
+
+// udpTracker 通过 udp:// 形式的announce地址汇报，实现 downloader.Tracker
+type udpTracker struct {
+	t      *TorrentFile
+	peerID [20]byte
+	port   uint16
+	proxy  *proxy.Proxy
+}
+
+//BEP 15 中的事件编号
+func udpEvent(event string) uint32 {
+	switch event {
+	case downloader.EventCompleted:
+		return 1
+	case downloader.EventStarted:
+		return 2
+	case downloader.EventStopped:
+		return 3
+	}
+	return 0
+}
+
+// Announce 先获取connection id，再汇报事件并获取peers
+func (u *udpTracker) Announce(ctx context.Context, event string, stats downloader.AnnounceStats) ([]peer.Peer, error) {
+	base, err := url.Parse(u.t.Announce)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if u.proxy != nil {
+		conn, err = u.proxy.DialContext(ctx, "udp", base.Host)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "udp", base.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+	resp, err := udpRoundTrip(ctx, conn, req, udpActionConnect, 16)
+	if err != nil {
+		return nil, err
+	}
+	connID := binary.BigEndian.Uint64(resp[8:16])
+
+	req = make([]byte, 98)
+	binary.BigEndian.PutUint64(req[0:8], connID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionAnnounce)
+	copy(req[16:36], u.t.InfoHash[:])
+	copy(req[36:56], u.peerID[:])
+	binary.BigEndian.PutUint64(req[56:64], uint64(stats.Downloaded))
+	binary.BigEndian.PutUint64(req[64:72], uint64(stats.Left))
+	binary.BigEndian.PutUint64(req[72:80], uint64(stats.Uploaded))
+	binary.BigEndian.PutUint32(req[80:84], udpEvent(event))
+	//IP 填0由tracker使用来源地址
+	binary.BigEndian.PutUint32(req[88:92], rand.Uint32()) //key
+	binary.BigEndian.PutUint32(req[92:96], ^uint32(0))    //num_want -1 使用tracker的默认值
+	binary.BigEndian.PutUint16(req[96:98], u.port)
+	resp, err = udpRoundTrip(ctx, conn, req, udpActionAnnounce, 20)
+	if err != nil {
+		return nil, err
+	}
+	return Unmarshal(resp[20:])
+}
+
+//发送请求并等待transaction id相同的回复，超时后重发
+func udpRoundTrip(ctx context.Context, conn net.Conn, req []byte, action uint32, minSize int) ([]byte, error) {
+	tid := rand.Uint32()
+	binary.BigEndian.PutUint32(req[12:16], tid)
+	//ctx 取消时打断阻塞的读取
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	buf := make([]byte, 2048)
+	timeout := udpTimeout
+	for attempt := 0; attempt < udpRetries; attempt++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		timeout *= 2
+		for {
+			n, err := conn.Read(buf)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != tid {
+				continue
+			}
+			switch got := binary.BigEndian.Uint32(buf[0:4]); {
+			case got == udpActionError:
+				return nil, fmt.Errorf("Tracker failure: %s", buf[8:n])
+			case got != action || n < minSize:
+				return nil, fmt.Errorf("Malformed UDP tracker response (action %d, %d bytes)", got, n)
+			}
+			resp := make([]byte, n)
+			copy(resp, buf[:n])
+			return resp, nil
+		}
+	}
+	return nil, errors.New("UDP tracker did not respond")
+}
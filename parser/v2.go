@@ -0,0 +1,173 @@
+package parser
+
+import (
+	"bitDownloader/merkle"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//BitTorrent v2(BEP 52)种子的 file tree 以及 piece layers
+
+//v2种子 file tree 中的单个文件
+type v2File struct {
+	path       []string
+	length     int
+	piecesRoot [32]byte //空文件为零
+}
+
+//由info字典中的 file tree 得到文件列表，v1种子没有 file tree，返回nil
+func parseFileTree(tree map[string]interface{}) ([]v2File, error) {
+	if tree == nil {
+		return nil, nil
+	}
+	files, err := walkFileTree(tree, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("File tree is empty")
+	}
+	return files, nil
+}
+
+//按照键的顺序深度优先展开目录，只有一个空字符串键的字典描述文件本身
+func walkFileTree(tree map[string]interface{}, prefix []string) ([]v2File, error) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var files []v2File
+	for _, name := range names {
+		path := append(append([]string(nil), prefix...), name)
+		node, ok := tree[name].(map[string]interface{})
+		if name == "" || !ok {
+			return nil, fmt.Errorf("Malformed file tree entry %q", strings.Join(path, "/"))
+		}
+		if leaf, ok := node[""].(map[string]interface{}); ok && len(node) == 1 {
+			f, err := parseFileEntry(leaf, path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, f)
+			continue
+		}
+		sub, err := walkFileTree(node, path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sub...)
+	}
+	return files, nil
+}
+
+func parseFileEntry(leaf map[string]interface{}, path []string) (v2File, error) {
+	f := v2File{path: path}
+	length, ok := leaf["length"].(int64)
+	if !ok || length < 0 {
+		return f, fmt.Errorf("File %s has invalid length", strings.Join(path, "/"))
+	}
+	f.length = int(length)
+	if f.length == 0 {
+		return f, nil
+	}
+	root, ok := leaf["pieces root"].(string)
+	if !ok || len(root) != 32 {
+		return f, fmt.Errorf("File %s has no pieces root", strings.Join(path, "/"))
+	}
+	copy(f.piecesRoot[:], root)
+	return f, nil
+}
+
+//v2要求piece长度为不小于16KiB的2的幂
+func checkPieceLengthV2(pieceLength int) error {
+	if pieceLength < merkle.BlockSize || pieceLength != merkle.NextPow2(pieceLength) {
+		return fmt.Errorf("Invalid v2 piece length %d", pieceLength)
+	}
+	return nil
+}
+
+//解析种子顶层的 piece layers，校验每个piece layer的merkle根与文件的pieces root一致
+//缺失的piece layer可以在下载时通过hash request获取
+func parsePieceLayers(raw map[string]string, files []v2File, pieceLength int) (map[[32]byte][][32]byte, error) {
+	layers := make(map[[32]byte][][32]byte)
+	pad := merkle.PadHash(pieceLength / merkle.BlockSize)
+	for _, f := range files {
+		if f.length <= pieceLength {
+			continue
+		}
+		s, ok := raw[string(f.piecesRoot[:])]
+		if !ok {
+			continue
+		}
+		pieces := (f.length + pieceLength - 1) / pieceLength
+		if len(s) != pieces*32 {
+			return nil, fmt.Errorf("Piece layer of %s has length %d, expected %d", strings.Join(f.path, "/"), len(s), pieces*32)
+		}
+		layer := make([][32]byte, pieces)
+		for i := range layer {
+			copy(layer[i][:], s[i*32:])
+		}
+		if merkle.Root(layer, merkle.NextPow2(pieces), pad) != f.piecesRoot {
+			return nil, fmt.Errorf("Piece layer of %s does not match its pieces root", strings.Join(f.path, "/"))
+		}
+		layers[f.piecesRoot] = layer
+	}
+	return layers, nil
+}
+
+//纯v2种子的文件布局：每个非空文件对齐到piece边界，对齐使用的padding文件不会写入磁盘
+//只有一个与种子同名的文件时视为单文件种子
+func (t *TorrentFile) layoutV2(files []v2File) {
+	if len(files) == 1 && len(files[0].path) == 1 && files[0].path[0] == t.Name {
+		t.Length = files[0].length
+		t.PiecesRoot = files[0].piecesRoot
+	} else {
+		offset := 0
+		for _, f := range files {
+			if f.length > 0 && offset%t.PieceLength != 0 {
+				pad := t.PieceLength - offset%t.PieceLength
+				t.Files = append(t.Files, File{Path: []string{".pad", strconv.Itoa(pad)}, Length: pad, Padding: true})
+				offset += pad
+			}
+			t.Files = append(t.Files, File{Path: f.path, Length: f.length, PiecesRoot: f.piecesRoot})
+			offset += f.length
+		}
+		t.Length = offset
+	}
+	t.PieceHashes = make([][20]byte, (t.Length+t.PieceLength-1)/t.PieceLength)
+}
+
+//混合种子的v1文件列表中包含padding文件，其余文件与 file tree 一一对应
+func (t *TorrentFile) attachRoots(files []v2File) error {
+	byPath := make(map[string]v2File, len(files))
+	for _, f := range files {
+		byPath[strings.Join(f.path, "/")] = f
+	}
+	match := func(path []string, length int) ([32]byte, error) {
+		f, ok := byPath[strings.Join(path, "/")]
+		if !ok || f.length != length {
+			return [32]byte{}, fmt.Errorf("File %s differs between v1 and v2 metadata", strings.Join(path, "/"))
+		}
+		return f.piecesRoot, nil
+	}
+	if len(t.Files) == 0 {
+		root, err := match([]string{t.Name}, t.Length)
+		t.PiecesRoot = root
+		return err
+	}
+	for i, f := range t.Files {
+		if f.Padding {
+			continue
+		}
+		root, err := match(f.Path, f.Length)
+		if err != nil {
+			return err
+		}
+		t.Files[i].PiecesRoot = root
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package parser
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+//下载前对种子元数据的完整性检查，避免畸形的种子写出目录之外或者无法完成下载
+
+// Problem 元数据中的一个问题
+type Problem struct {
+	Field string //出问题的字段，例如 files[3].path
+	Msg   string
+}
+
+func (p Problem) String() string {
+	return p.Field + ": " + p.Msg
+}
+
+// ValidationError 校验发现的全部问题
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = p.String()
+	}
+	return fmt.Sprintf("Invalid torrent, %d problem(s): %s", len(e.Problems), strings.Join(msgs, "; "))
+}
+
+//Windows上不能作为文件名的设备名，带扩展名时同样保留
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Validate 检查piece数量与长度是否一致、长度是否合法、路径是否会逃出下载目录或使用保留文件名、
+// 文件路径是否重复以及tracker和web seed地址的协议，返回包含全部问题的 *ValidationError
+func (t *TorrentFile) Validate() error {
+	var problems []Problem
+	add := func(field, format string, args ...interface{}) {
+		problems = append(problems, Problem{Field: field, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if msg := checkPathComponent(t.Name); msg != "" {
+		add("name", "%s", msg)
+	}
+	if t.Length <= 0 {
+		add("length", "total length %d is not positive", t.Length)
+	}
+	if t.PieceLength <= 0 {
+		add("piece length", "piece length %d is not positive", t.PieceLength)
+	} else {
+		if t.MetaVersion == 2 {
+			if err := checkPieceLengthV2(t.PieceLength); err != nil {
+				add("piece length", "%v", err)
+			}
+		}
+		if t.Length > 0 {
+			if want := (t.Length + t.PieceLength - 1) / t.PieceLength; len(t.PieceHashes) != want {
+				add("pieces", "%d piece hashes for %d bytes, expected %d", len(t.PieceHashes), t.Length, want)
+			}
+		}
+	}
+
+	problems = append(problems, t.validateFiles()...)
+
+	if t.Announce != "" {
+		if msg := checkURL(t.Announce, "http", "https", "udp"); msg != "" {
+			add("announce", "%s", msg)
+		}
+	}
+	for i, tier := range t.AnnounceList {
+		for j, tr := range tier {
+			if msg := checkURL(tr, "http", "https", "udp"); msg != "" {
+				add(fmt.Sprintf("announce-list[%d][%d]", i, j), "%s", msg)
+			}
+		}
+	}
+	for i, ws := range t.WebSeeds {
+		if msg := checkURL(ws, "http", "https"); msg != "" {
+			add(fmt.Sprintf("url-list[%d]", i), "%s", msg)
+		}
+	}
+	for i, hs := range t.HTTPSeeds {
+		if msg := checkURL(hs, "http", "https"); msg != "" {
+			add(fmt.Sprintf("httpseeds[%d]", i), "%s", msg)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+//检查多文件种子的文件列表
+func (t *TorrentFile) validateFiles() []Problem {
+	var problems []Problem
+	add := func(i int, format string, args ...interface{}) {
+		problems = append(problems, Problem{Field: fmt.Sprintf("files[%d]", i), Msg: fmt.Sprintf(format, args...)})
+	}
+
+	total := 0
+	seen := make(map[string]int) //路径 -> 文件编号
+	dirs := make(map[string]bool)
+	for i, f := range t.Files {
+		total += f.Length
+		if f.Length < 0 {
+			add(i, "length %d is negative", f.Length)
+		}
+		if len(f.Path) == 0 {
+			add(i, "path is empty")
+			continue
+		}
+		for _, part := range f.Path {
+			if msg := checkPathComponent(part); msg != "" {
+				add(i, "%s", msg)
+			}
+		}
+		//混合种子中的padding文件可以有相同的路径，它们不会写入磁盘
+		if f.Padding {
+			continue
+		}
+		path := strings.Join(f.Path, "/")
+		if j, ok := seen[path]; ok {
+			add(i, "path %q duplicates files[%d]", path, j)
+			continue
+		}
+		seen[path] = i
+		for k := 1; k < len(f.Path); k++ {
+			dirs[strings.Join(f.Path[:k], "/")] = true
+		}
+	}
+	for i, f := range t.Files {
+		path := strings.Join(f.Path, "/")
+		if j, ok := seen[path]; ok && j == i && dirs[path] {
+			add(i, "path %q is both a file and a directory", path)
+		}
+	}
+	if len(t.Files) > 0 && total != t.Length {
+		problems = append(problems, Problem{Field: "files", Msg: fmt.Sprintf("file lengths add up to %d, expected %d", total, t.Length)})
+	}
+	return problems
+}
+
+//返回路径中单级名称的问题，没有问题时为空
+func checkPathComponent(name string) string {
+	switch {
+	case name == "":
+		return "empty name"
+	case name == "." || name == "..":
+		return fmt.Sprintf("name %q escapes the download directory", name)
+	case strings.ContainsAny(name, "/\\"):
+		return fmt.Sprintf("name %q contains a path separator", name)
+	case strings.IndexByte(name, 0) >= 0:
+		return fmt.Sprintf("name %q contains a NUL byte", name)
+	}
+	base := strings.ToUpper(name)
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if reservedNames[strings.TrimRight(base, " ")] {
+		return fmt.Sprintf("name %q is reserved on Windows", name)
+	}
+	return ""
+}
+
+//返回地址的问题，协议需要为 schemes 之一
+func checkURL(raw string, schemes ...string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Sprintf("malformed URL %q", raw)
+	}
+	for _, s := range schemes {
+		if strings.EqualFold(u.Scheme, s) {
+			if u.Host == "" {
+				return fmt.Sprintf("URL %q has no host", raw)
+			}
+			return ""
+		}
+	}
+	return fmt.Sprintf("URL %q has unsupported scheme, expected %s", raw, strings.Join(schemes, " or "))
+}
@@ -0,0 +1,124 @@
+package parser
+
+import (
+	"crypto/sha1"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckPathComponent(t *testing.T) {
+	tests := []struct {
+		name string
+		bad  bool
+	}{
+		{"a.bin", false},
+		{"...", false},
+		{".hidden", false},
+		{"CONSOLE", false},
+		{"COM10", false},
+		{"", true},
+		{".", true},
+		{"..", true},
+		{"a/b", true},
+		{"..\\evil", true},
+		{"a\x00b", true},
+		{"CON", true},
+		{"con", true},
+		{"nul.txt", true},
+		{"Com1.tar.gz", true},
+		{"LPT9 ", true},
+		{"aux .log", true},
+	}
+	for _, tt := range tests {
+		if msg := checkPathComponent(tt.name); (msg != "") != tt.bad {
+			t.Errorf("checkPathComponent(%q) = %q, want problem %v", tt.name, msg, tt.bad)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *TorrentFile {
+		return &TorrentFile{
+			Name:        "dir",
+			Length:      30000,
+			PieceLength: 16384,
+			PieceHashes: make([][20]byte, 2),
+			Files: []File{
+				{Path: []string{"a.bin"}, Length: 10000},
+				{Path: []string{"sub", "b.bin"}, Length: 20000},
+			},
+			Announce: "udp://tracker.example:6969",
+			WebSeeds: []string{"https://example.com/files/"},
+		}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("valid torrent: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(tf *TorrentFile)
+		fields []string
+	}{
+		{"name traversal", func(tf *TorrentFile) { tf.Name = ".." }, []string{"name"}},
+		{"path traversal", func(tf *TorrentFile) { tf.Files[1].Path = []string{"..", "..", "etc", "passwd"} }, []string{"files[1]", "files[1]"}},
+		{"path separator", func(tf *TorrentFile) { tf.Files[0].Path = []string{"../a.bin"} }, []string{"files[0]"}},
+		{"reserved name", func(tf *TorrentFile) { tf.Files[1].Path = []string{"aux", "b.bin"} }, []string{"files[1]"}},
+		{"reserved torrent name", func(tf *TorrentFile) { tf.Name = "PRN.txt" }, []string{"name"}},
+		{"empty path", func(tf *TorrentFile) { tf.Files[0].Path = nil }, []string{"files[0]"}},
+		{"duplicate path", func(tf *TorrentFile) { tf.Files[1].Path = []string{"a.bin"} }, []string{"files[1]"}},
+		{"file and directory", func(tf *TorrentFile) { tf.Files[0].Path = []string{"sub"} }, []string{"files[0]"}},
+		{"lengths", func(tf *TorrentFile) { tf.Files[0].Length = 1 }, []string{"files"}},
+		{"piece count", func(tf *TorrentFile) { tf.PieceHashes = tf.PieceHashes[:1] }, []string{"pieces"}},
+		{"tracker scheme", func(tf *TorrentFile) { tf.AnnounceList = [][]string{{"wss://x"}} }, []string{"announce-list[0][0]"}},
+		{"web seed host", func(tf *TorrentFile) { tf.WebSeeds = []string{"http:///x"} }, []string{"url-list[0]"}},
+	}
+	for _, tt := range tests {
+		tf := valid()
+		tt.modify(tf)
+		var ve *ValidationError
+		if err := tf.Validate(); !errors.As(err, &ve) {
+			t.Errorf("%s: Validate() = %v, want *ValidationError", tt.name, err)
+			continue
+		}
+		var fields []string
+		for _, p := range ve.Problems {
+			fields = append(fields, p.Field)
+		}
+		if strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+			t.Errorf("%s: problems %v, want fields %v", tt.name, ve.Problems, tt.fields)
+		}
+	}
+}
+
+func TestVerifyValidates(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("hello")
+	tf := &TorrentFile{
+		Name:        "dir",
+		Length:      len(data),
+		PieceLength: 16384,
+		PieceHashes: [][20]byte{sha1.Sum(data)},
+		Files:       []File{{Path: []string{"a.bin"}, Length: len(data)}},
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := tf.Verify(dir)
+	if err != nil || res.Verified != 1 {
+		t.Fatalf("Verify valid torrent: %+v, %v", res, err)
+	}
+
+	//路径越界的种子文件不会打开 dir 之外的文件
+	tf.Files[0].Path = []string{"..", "escape.bin"}
+	var ve *ValidationError
+	if res, err := tf.Verify(dir); !errors.As(err, &ve) || res != nil {
+		t.Fatalf("Verify invalid torrent: %+v, %v, want *ValidationError", res, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "..", "escape.bin")); !os.IsNotExist(err) {
+		t.Errorf("file outside the download directory: %v", err)
+	}
+}
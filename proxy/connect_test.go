@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDialHTTPConnect(t *testing.T) {
+	type request struct {
+		method, host, auth string
+	}
+	requests := make(chan request, 10)
+	addr := fakeProxy(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		requests <- request{req.Method, req.Host, req.Header.Get("Proxy-Authorization")}
+		switch req.Host {
+		case "denied.example:6881":
+			io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+		case "auth.example:6881":
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+		case "garbage.example:6881":
+			io.WriteString(conn, "SSH-2.0-OpenSSH\r\n")
+		default:
+			//回复之后紧接着隧道中的数据
+			io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\nhello")
+			io.Copy(conn, br)
+		}
+	})
+
+	p := &Proxy{Type: HTTP, Addr: addr, Username: "user", Password: "secret"}
+	conn, err := p.DialContext(context.Background(), "tcp", "peer.example:6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := <-requests
+	wantAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	if req.method != http.MethodConnect || req.host != "peer.example:6881" || req.auth != wantAuth {
+		t.Errorf("proxy received %+v", req)
+	}
+	if got := readN(conn, 5); string(got) != "hello" {
+		t.Fatalf("read %q buffered after the reply", got)
+	}
+	conn.Write([]byte("echo"))
+	if got := readN(conn, 4); string(got) != "echo" {
+		t.Errorf("read %q through tunnel", got)
+	}
+
+	tests := []struct {
+		host string
+		err  string
+	}{
+		{"denied.example:6881", "403 Forbidden"},
+		{"auth.example:6881", "407 Proxy Authentication Required"},
+		{"garbage.example:6881", "malformed HTTP"},
+	}
+	for _, tt := range tests {
+		_, err := p.DialContext(context.Background(), "tcp", tt.host)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("CONNECT %s = %v, want %q", tt.host, err, tt.err)
+		}
+		<-requests
+	}
+
+	//没有用户名时不发送认证
+	p.Username = ""
+	conn, err = p.DialContext(context.Background(), "tcp", "peer.example:6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if req := <-requests; req.auth != "" {
+		t.Errorf("Proxy-Authorization %q without username", req.auth)
+	}
+}
@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+//SOCKS5 (RFC 1928) 以及用户名密码认证 (RFC 1929)
+
+const (
+	socksVersion  = 5
+	authNone      = 0x00
+	authPassword  = 0x02
+	authNoAccept  = 0xff
+	cmdConnect    = 0x01
+	cmdAssociate  = 0x03
+	atypIPv4      = 0x01
+	atypDomain    = 0x03
+	atypIPv6      = 0x04
+	maxDatagram   = 65535
+	passwordAuthV = 0x01
+)
+
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+//协商认证方式，有用户名时同时提供用户名密码认证
+func (p *Proxy) socksAuth(conn net.Conn) error {
+	methods := []byte{authNone}
+	if p.Username != "" {
+		methods = append(methods, authPassword)
+	}
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != socksVersion {
+		return fmt.Errorf("Unexpected SOCKS version %d", resp[0])
+	}
+	switch resp[1] {
+	case authNone:
+		return nil
+	case authPassword:
+		if p.Username == "" {
+			return errors.New("SOCKS server requires authentication")
+		}
+		if len(p.Username) > 255 || len(p.Password) > 255 {
+			return errors.New("SOCKS username or password too long")
+		}
+		buf := []byte{passwordAuthV, byte(len(p.Username))}
+		buf = append(buf, p.Username...)
+		buf = append(buf, byte(len(p.Password)))
+		buf = append(buf, p.Password...)
+		if _, err := conn.Write(buf); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			return err
+		}
+		if resp[1] != 0 {
+			return errors.New("SOCKS authentication failed")
+		}
+		return nil
+	case authNoAccept:
+		return errors.New("SOCKS server accepted none of our authentication methods")
+	}
+	return fmt.Errorf("Unsupported SOCKS authentication method %d", resp[1])
+}
+
+//编码地址，域名交给代理解析
+func appendAddr(buf []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port in %q", addr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, atypIPv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, atypIPv6)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("Host name too long: %q", host)
+		}
+		buf = append(buf, atypDomain, byte(len(host)))
+		buf = append(buf, host...)
+	}
+	return append(buf, byte(port>>8), byte(port)), nil
+}
+
+//读取地址，返回 host:port
+func readAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		size := net.IPv4len
+		if atyp[0] == atypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("Unsupported SOCKS address type %d", atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+//发送请求并读取回复，返回代理绑定的地址
+func socksRequest(conn net.Conn, cmd byte, addr string) (string, error) {
+	req, err := appendAddr([]byte{socksVersion, cmd, 0}, addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return "", err
+	}
+	var head [3]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return "", err
+	}
+	if head[0] != socksVersion {
+		return "", fmt.Errorf("Unexpected SOCKS version %d", head[0])
+	}
+	if head[1] != 0 {
+		reason, ok := socksReplies[head[1]]
+		if !ok {
+			reason = fmt.Sprintf("error %d", head[1])
+		}
+		return "", fmt.Errorf("SOCKS request to %s failed: %s", addr, reason)
+	}
+	return readAddr(conn)
+}
+
+//通过 UDP ASSOCIATE 建立经过代理的UDP连接
+func (p *Proxy) dialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	header, err := appendAddr([]byte{0, 0, 0}, addr)
+	if err != nil {
+		return nil, err
+	}
+	ctrl, err := p.dialServer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var relay string
+	err = handshake(ctx, ctrl, func() error {
+		if err := p.socksAuth(ctrl); err != nil {
+			return err
+		}
+		//我们的UDP源地址事先未知，按照RFC填写全零地址
+		relay, err = socksRequest(ctrl, cmdAssociate, "0.0.0.0:0")
+		return err
+	})
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("Proxy %s: %w", p, err)
+	}
+	//代理返回未指定的地址时使用代理服务器本身的地址
+	host, port, _ := net.SplitHostPort(relay)
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		if server, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			relay = net.JoinHostPort(server.IP.String(), port)
+		}
+	}
+	var dialer net.Dialer
+	udp, err := dialer.DialContext(ctx, "udp", relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	c := &udpConn{Conn: udp, ctrl: ctrl, header: header}
+	//控制连接断开时UDP关联失效
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		c.Close()
+	}()
+	return c, nil
+}
+
+//经过SOCKS5代理转发的UDP连接，每次读写一个数据报
+type udpConn struct {
+	net.Conn
+	ctrl   net.Conn //UDP关联的生命周期与控制连接相同
+	header []byte   //RSV FRAG 以及目标地址
+	once   sync.Once
+}
+
+func (c *udpConn) Write(b []byte) (int, error) {
+	buf := make([]byte, 0, len(c.header)+len(b))
+	buf = append(append(buf, c.header...), b...)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+//读取一个数据报并去掉代理的头部，分片的数据报直接丢弃
+func (c *udpConn) Read(b []byte) (int, error) {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		if _, err := readAddr(r); err != nil {
+			continue
+		}
+		return copy(b, buf[n-r.Len():n]), nil
+	}
+}
+
+func (c *udpConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.ctrl.Close()
+		err = c.Conn.Close()
+	})
+	return err
+}
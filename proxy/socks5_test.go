@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+//在回环地址上运行的代理服务器，每个连接由 handle 处理
+func fakeProxy(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func readN(r io.Reader, n int) []byte {
+	buf := make([]byte, n)
+	io.ReadFull(r, buf)
+	return buf
+}
+
+//读取客户端的问候，返回客户端提供的认证方式
+func readGreeting(r io.Reader) []byte {
+	head := readN(r, 2)
+	return readN(r, int(head[1]))
+}
+
+func TestSocksAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		methods  []byte //客户端应当提供的认证方式
+		reply    []byte //服务器选择的认证方式
+		auth     []byte //用户名密码认证的回复，nil 表示不进行认证
+		err      string
+	}{
+		{"no auth", "", []byte{authNone}, []byte{5, authNone}, nil, ""},
+		{"password", "user", []byte{authNone, authPassword}, []byte{5, authPassword}, []byte{1, 0}, ""},
+		{"password rejected", "user", []byte{authNone, authPassword}, []byte{5, authPassword}, []byte{1, 1}, "authentication failed"},
+		{"password required", "", []byte{authNone}, []byte{5, authPassword}, nil, "requires authentication"},
+		{"no acceptable method", "", []byte{authNone}, []byte{5, authNoAccept}, nil, "accepted none"},
+		{"wrong version", "", []byte{authNone}, []byte{4, authNone}, nil, "SOCKS version 4"},
+		{"unknown method", "user", []byte{authNone, authPassword}, []byte{5, 0x80}, nil, "method 128"},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		var methods, cred []byte
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer server.Close()
+			methods = readGreeting(server)
+			server.Write(tt.reply)
+			if tt.auth != nil {
+				head := readN(server, 2)
+				user := readN(server, int(head[1]))
+				n := readN(server, 1)
+				pass := readN(server, int(n[0]))
+				cred = append(append(append(head, user...), n...), pass...)
+				server.Write(tt.auth)
+			}
+		}()
+		p := &Proxy{Type: SOCKS5, Username: tt.username, Password: "secret"}
+		err := p.socksAuth(client)
+		client.Close()
+		<-done
+		if !bytes.Equal(methods, tt.methods) {
+			t.Errorf("%s: offered methods %v, want %v", tt.name, methods, tt.methods)
+		}
+		if tt.auth != nil && string(cred) != "\x01\x04user\x06secret" {
+			t.Errorf("%s: credentials %q", tt.name, cred)
+		}
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: socksAuth() = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestSocksRequest(t *testing.T) {
+	port := []byte{0x1a, 0xe1} //6881
+	tests := []struct {
+		name  string
+		addr  string
+		req   []byte //目标地址的编码
+		reply []byte //回复中 VER REP RSV 之后的部分，或者错误回复的 REP
+		bound string
+		err   string
+	}{
+		{"IPv4", "10.1.2.3:6881", append([]byte{atypIPv4, 10, 1, 2, 3}, port...),
+			append([]byte{5, 0, 0, atypIPv4, 1, 2, 3, 4}, port...), "1.2.3.4:6881", ""},
+		{"IPv6", "[2001:db8::1]:6881", append(append([]byte{atypIPv6}, net.ParseIP("2001:db8::1")...), port...),
+			append(append([]byte{5, 0, 0, atypIPv6}, net.ParseIP("2001:db8::2")...), port...), "[2001:db8::2]:6881", ""},
+		{"domain", "tracker.example:6881", append([]byte{atypDomain, 15}, append([]byte("tracker.example"), port...)...),
+			append([]byte{5, 0, 0, atypDomain, 7, 'b', 'o', 'u', 'n', 'd', '.', 'x'}, port...), "bound.x:6881", ""},
+		{"refused", "10.1.2.3:6881", append([]byte{atypIPv4, 10, 1, 2, 3}, port...),
+			[]byte{5, 5, 0}, "", "connection refused"},
+		{"unknown reply", "10.1.2.3:6881", append([]byte{atypIPv4, 10, 1, 2, 3}, port...),
+			[]byte{5, 42, 0}, "", "error 42"},
+		{"bad address type", "10.1.2.3:6881", append([]byte{atypIPv4, 10, 1, 2, 3}, port...),
+			[]byte{5, 0, 0, 9}, "", "address type 9"},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		var req []byte
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer server.Close()
+			req = readN(server, 3+len(tt.req))
+			server.Write(tt.reply)
+		}()
+		bound, err := socksRequest(client, cmdConnect, tt.addr)
+		client.Close()
+		<-done
+		if want := append([]byte{5, cmdConnect, 0}, tt.req...); !bytes.Equal(req, want) {
+			t.Errorf("%s: request %v, want %v", tt.name, req, want)
+		}
+		if bound != tt.bound {
+			t.Errorf("%s: bound address %q, want %q", tt.name, bound, tt.bound)
+		}
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: socksRequest() = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+
+	if _, err := socksRequest(nil, cmdConnect, "no-port"); err == nil {
+		t.Error("address without port accepted")
+	}
+}
+
+func TestDialSOCKS5(t *testing.T) {
+	addr := fakeProxy(t, func(conn net.Conn) {
+		readGreeting(conn)
+		conn.Write([]byte{5, authNone})
+		head := readN(conn, 5)
+		host := readN(conn, int(head[4])+2)
+		if string(host[:len(host)-2]) != "peer.example" {
+			conn.Write([]byte{5, 4, 0})
+			return
+		}
+		conn.Write([]byte{5, 0, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+		io.Copy(conn, conn)
+	})
+	p := &Proxy{Type: SOCKS5, Addr: addr}
+	conn, err := p.DialContext(context.Background(), "tcp", "peer.example:6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("echo"))
+	if got := readN(conn, 4); string(got) != "echo" {
+		t.Errorf("read %q through tunnel", got)
+	}
+
+	//代理拒绝请求时返回包含原因的错误
+	if _, err := p.DialContext(context.Background(), "tcp", "other.example:6881"); err == nil || !strings.Contains(err.Error(), "host unreachable") {
+		t.Errorf("refused CONNECT = %v", err)
+	}
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	relayPort := relay.LocalAddr().(*net.UDPAddr).Port
+	closeCtrl := make(chan struct{})
+	addr := fakeProxy(t, func(conn net.Conn) {
+		readGreeting(conn)
+		conn.Write([]byte{5, authNone})
+		req := readN(conn, 10)
+		if !bytes.Equal(req, []byte{5, cmdAssociate, 0, atypIPv4, 0, 0, 0, 0, 0, 0}) {
+			conn.Write([]byte{5, 7, 0})
+			return
+		}
+		//未指定的中继地址，客户端应当使用代理服务器的地址
+		conn.Write([]byte{5, 0, 0, atypIPv4, 0, 0, 0, 0, byte(relayPort >> 8), byte(relayPort)})
+		<-closeCtrl
+	})
+	p := &Proxy{Type: SOCKS5, Addr: addr}
+	conn, err := p.DialContext(context.Background(), "udp", "10.9.8.7:6969")
+	if err != nil {
+		close(closeCtrl)
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	relay.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := relay.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []byte{0, 0, 0, atypIPv4, 10, 9, 8, 7, 0x1b, 0x39}
+	if want := append(header, "ping"...); !bytes.Equal(buf[:n], want) {
+		t.Fatalf("relay received %v, want %v", buf[:n], want)
+	}
+	//分片的数据报被丢弃，之后的数据报去掉头部后返回
+	relay.WriteTo(append([]byte{0, 0, 1, atypIPv4, 10, 9, 8, 7, 0x1b, 0x39}, "frag"...), from)
+	relay.WriteTo(append([]byte{0, 0, 0, atypDomain, 1, 'x', 0, 1}, "pong"...), from)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err = conn.Read(buf)
+	if err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+
+	//控制连接断开后UDP连接随之关闭
+	close(closeCtrl)
+	n, err = conn.Read(buf)
+	var ne net.Error
+	if err == nil || errors.As(err, &ne) && ne.Timeout() {
+		t.Errorf("Read after control connection closed = %q, %v", buf[:n], err)
+	}
+}
+
+func TestUDPThroughHTTPProxy(t *testing.T) {
+	p := &Proxy{Type: HTTP, Addr: "127.0.0.1:1", Force: true}
+	if _, err := p.DialContext(context.Background(), "udp", "10.0.0.1:6969"); !errors.Is(err, ErrUnproxied) {
+		t.Errorf("forced UDP through HTTP proxy = %v, want ErrUnproxied", err)
+	}
+}
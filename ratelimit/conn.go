@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+//单次读写的最大长度，避免一次大的写入长时间独占带宽
+const chunkSize = 16 * 1024
+
+// Conn 对读写限速的连接，关闭后正在等待令牌的读写立即返回
+type Conn struct {
+	net.Conn
+	read  []*Limiter
+	write []*Limiter
+
+	wmu    sync.Mutex //一次 Write 的全部分块连续写出，避免不同消息交错
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewConn 包装连接，读取受 read 中全部限速器限制，写入受 write 中全部限速器限制
+func NewConn(conn net.Conn, read, write []*Limiter) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Conn{Conn: conn, read: read, write: write, ctx: ctx, cancel: cancel}
+}
+
+// Read 读取后扣除令牌，令牌不足时延迟下一次读取，由TCP流控限制对方的发送速度
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if werr := WaitAll(c.ctx, c.read, n); werr != nil && err == nil {
+			err = net.ErrClosed
+		}
+	}
+	return n, err
+}
+
+// Write 按照分块等待令牌后写出
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	written := 0
+	for written < len(p) {
+		end := written + chunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := WaitAll(c.ctx, c.write, end-written); err != nil {
+			return written, net.ErrClosed
+		}
+		n, err := c.Conn.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close 关闭连接并唤醒等待令牌的读写
+func (c *Conn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
@@ -0,0 +1,157 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+//令牌桶限速，用于限制上传以及下载速度
+
+//等待令牌时的最长单次休眠，限速被修改后最迟在这之后生效
+const maxWait = 100 * time.Millisecond
+
+// Limiter 令牌桶限速器，速率为每秒字节数，0 表示不限制
+// 允许一次取出超过桶容量的令牌，此时之后的调用者需要等待欠下的令牌补足
+// nil 的 Limiter 不做任何限制
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	clock  clock
+}
+
+//时钟，测试时替换为手动推进的时钟
+type clock interface {
+	Now() time.Time
+	//休眠 d，ctx 取消时提前返回错误
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// NewLimiter 创建每秒 rate 字节的限速器
+func NewLimiter(rate int) *Limiter {
+	l := &Limiter{clock: realClock{}}
+	l.SetLimit(rate)
+	return l
+}
+
+// SetLimit 修改速率，可以在使用过程中调用
+func (l *Limiter) SetLimit(rate int) {
+	if rate < 0 {
+		rate = 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(l.clock.Now())
+	l.rate = float64(rate)
+	if l.rate == 0 {
+		l.tokens = 0
+	}
+}
+
+// Limit 当前速率，0 表示不限制
+func (l *Limiter) Limit() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.rate)
+}
+
+//按照经过的时间补充令牌，最多积累一秒的令牌，调用者需持有锁
+func (l *Limiter) refill(now time.Time) {
+	if !l.last.IsZero() && l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+}
+
+// WaitN 取出 n 个令牌，令牌不足时阻塞直到补足或 ctx 取消，取消时归还取出的令牌
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.refill(l.clock.Now())
+	l.tokens -= float64(n)
+	l.mu.Unlock()
+
+	for {
+		l.mu.Lock()
+		if l.rate == 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		l.refill(l.clock.Now())
+		if l.tokens >= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		//向上取整，欠下的令牌不足1纳秒时也需要等待
+		wait := time.Duration(math.Ceil(-l.tokens / l.rate * float64(time.Second)))
+		l.mu.Unlock()
+		if wait > maxWait {
+			wait = maxWait
+		}
+		if err := l.clock.Sleep(ctx, wait); err != nil {
+			l.refund(n)
+			return err
+		}
+	}
+}
+
+//归还没有使用的令牌，最多积累一秒的令牌
+func (l *Limiter) refund(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return
+	}
+	l.refill(l.clock.Now())
+	l.tokens += float64(n)
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+}
+
+// WaitAll 依次从每个限速器取出 n 个令牌，用于同时受peer、种子以及会话限速的流量
+// ctx 取消时归还已经从前面的限速器取出的令牌
+func WaitAll(ctx context.Context, limiters []*Limiter, n int) error {
+	for i, l := range limiters {
+		if err := l.WaitN(ctx, n); err != nil {
+			for _, taken := range limiters[:i] {
+				taken.refund(n)
+			}
+			return err
+		}
+	}
+	return nil
+}
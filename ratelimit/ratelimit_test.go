@@ -0,0 +1,234 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRefill(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	l := testLimiter(1000, clock)
+	start := clock.Now()
+	l.tokens = -500
+	tests := []struct {
+		after  time.Duration
+		tokens float64
+	}{
+		{0, -500},
+		{250 * time.Millisecond, -250},
+		{time.Second, 500},
+		{5 * time.Second, 1000}, //最多积累一秒的令牌
+	}
+	for _, tt := range tests {
+		l.refill(start.Add(tt.after))
+		if !near(l.tokens, tt.tokens) {
+			t.Errorf("after %v: tokens = %v, want %v", tt.after, l.tokens, tt.tokens)
+		}
+	}
+
+	//改为不限制时清空令牌
+	l.SetLimit(0)
+	if l.tokens != 0 || l.Limit() != 0 {
+		t.Errorf("unlimited: tokens = %v, limit = %d", l.tokens, l.Limit())
+	}
+	l.SetLimit(-1)
+	if l.Limit() != 0 {
+		t.Errorf("negative limit stored as %d", l.Limit())
+	}
+}
+
+//手动推进的时钟，Sleep 直接把时间向后推进并累计休眠时长
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	slept time.Duration
+	//非nil时 Sleep 开始时调用，用于在等待中修改限速或取消 ctx
+	onSleep func()
+	//为true时 Sleep 阻塞到 ctx 取消
+	block bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if c.onSleep != nil {
+		c.onSleep()
+	}
+	if c.block {
+		<-ctx.Done()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.advance(d)
+	c.mu.Lock()
+	c.slept += d
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func (c *fakeClock) sleptTotal() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.slept
+}
+
+//使用 clock 的限速器，令牌桶初始为空
+func testLimiter(rate int, clock *fakeClock) *Limiter {
+	l := &Limiter{clock: clock}
+	l.SetLimit(rate)
+	return l
+}
+
+func (l *Limiter) available() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.tokens
+}
+
+func near(a, b float64) bool {
+	return a > b-1e-6 && a < b+1e-6
+}
+
+//休眠时长只会因为浮点误差比 want 多出几纳秒
+func sleptAbout(got, want time.Duration) bool {
+	return got >= want && got < want+time.Microsecond
+}
+
+func TestWaitN(t *testing.T) {
+	ctx := context.Background()
+	var nilLimiter *Limiter
+	if err := nilLimiter.WaitN(ctx, 1<<30); err != nil || nilLimiter.Limit() != 0 {
+		t.Fatalf("nil limiter: %v", err)
+	}
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	if err := testLimiter(0, clock).WaitN(ctx, 1<<30); err != nil || clock.sleptTotal() != 0 {
+		t.Fatalf("unlimited limiter slept %v, %v", clock.sleptTotal(), err)
+	}
+
+	//桶中有足够的令牌时不等待
+	l := testLimiter(1000, clock)
+	clock.advance(time.Second)
+	if err := l.WaitN(ctx, 400); err != nil || clock.sleptTotal() != 0 || !near(l.available(), 600) {
+		t.Fatalf("WaitN with full bucket: slept %v, tokens %v, %v", clock.sleptTotal(), l.available(), err)
+	}
+
+	//令牌不足时等待欠下的令牌补足，单次休眠不超过 maxWait
+	if err := l.WaitN(ctx, 800); err != nil {
+		t.Fatal(err)
+	}
+	if got := clock.sleptTotal(); !sleptAbout(got, 200*time.Millisecond) {
+		t.Errorf("WaitN owing 200 tokens at 1000/s slept %v", got)
+	}
+	if tokens := l.available(); tokens < 0 || tokens > 1e-3 {
+		t.Errorf("tokens = %v after wait, want 0", tokens)
+	}
+
+	//超过桶容量的请求一次取出，之后的调用者等待欠下的令牌
+	clock = &fakeClock{now: time.Unix(1000, 0)}
+	l = testLimiter(1000, clock)
+	if err := l.WaitN(ctx, 3000); err != nil || !sleptAbout(clock.sleptTotal(), 3*time.Second) {
+		t.Fatalf("WaitN of 3s worth of tokens slept %v, %v", clock.sleptTotal(), err)
+	}
+}
+
+func TestWaitNCancelRefunds(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	l := testLimiter(1000, clock)
+	clock.advance(300 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	clock.onSleep = cancel
+	if err := l.WaitN(ctx, 500); !errors.Is(err, context.Canceled) {
+		t.Fatalf("WaitN after cancel = %v", err)
+	}
+	//取消的请求归还令牌，之后的调用者不需要为它等待
+	if tokens := l.available(); !near(tokens, 300) {
+		t.Errorf("tokens = %v after cancelled WaitN, want 300", tokens)
+	}
+	clock.onSleep = nil
+	if err := l.WaitN(context.Background(), 300); err != nil || clock.sleptTotal() != 0 {
+		t.Errorf("WaitN after refund slept %v, %v", clock.sleptTotal(), err)
+	}
+
+	//WaitAll 归还已经从前面的限速器取出的令牌
+	clock = &fakeClock{now: time.Unix(1000, 0)}
+	full := testLimiter(1000, clock)
+	slow := testLimiter(1, clock)
+	clock.advance(time.Second)
+	ctx, cancel = context.WithCancel(context.Background())
+	clock.onSleep = cancel
+	if err := WaitAll(ctx, []*Limiter{full, nil, slow}, 400); !errors.Is(err, context.Canceled) {
+		t.Fatalf("WaitAll after cancel = %v", err)
+	}
+	if !near(full.available(), 1000) || !near(slow.available(), 1) {
+		t.Errorf("tokens after cancelled WaitAll = %v, %v, want 1000, 1", full.available(), slow.available())
+	}
+}
+
+func TestWaitNLimitRemoved(t *testing.T) {
+	//等待中解除限速时立即返回
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	l := testLimiter(1, clock)
+	clock.onSleep = func() { l.SetLimit(0) }
+	if err := l.WaitN(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	if got := clock.sleptTotal(); got != maxWait {
+		t.Errorf("slept %v after the limit was removed, want one maxWait", got)
+	}
+}
+
+func TestReader(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 3*chunkSize)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	l := testLimiter(len(data)*4, clock)
+	got, err := io.ReadAll(NewReader(context.Background(), bytes.NewReader(data), nil, l))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+	//空桶中读取 0.25 秒的数据
+	if d := clock.sleptTotal(); !sleptAbout(d, 250*time.Millisecond) {
+		t.Errorf("reading 0.25s worth of data slept %v", d)
+	}
+}
+
+func TestConnCloseWakesWriter(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(io.Discard, b)
+	waiting := make(chan struct{}, 1)
+	clock := &fakeClock{now: time.Unix(1000, 0), block: true}
+	clock.onSleep = func() {
+		select {
+		case waiting <- struct{}{}:
+		default:
+		}
+	}
+	c := NewConn(a, nil, []*Limiter{testLimiter(1, clock)})
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Write(make([]byte, 1000))
+		done <- err
+	}()
+	<-waiting
+	c.Close()
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write after Close = %v, want net.ErrClosed", err)
+	}
+}
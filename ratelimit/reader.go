@@ -0,0 +1,32 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+)
+
+// Reader 对读取限速，例如HTTP响应的body
+type Reader struct {
+	r        io.Reader
+	ctx      context.Context
+	limiters []*Limiter
+}
+
+// NewReader 包装 r，读取受 limiters 中全部限速器限制，ctx 取消时等待中的读取立即返回
+func NewReader(ctx context.Context, r io.Reader, limiters ...*Limiter) *Reader {
+	return &Reader{r: r, ctx: ctx, limiters: limiters}
+}
+
+// Read 读取后扣除令牌，令牌不足时延迟下一次读取
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := WaitAll(r.ctx, r.limiters, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
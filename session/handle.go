@@ -0,0 +1,282 @@
+package session
+
+import (
+	"bitDownloader/downloader"
+	"bitDownloader/parser"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// State 会话中种子的状态
+type State int
+
+const (
+	StateFetchingMetadata State = iota //磁力链接正在获取info字典
+	StateChecking                      //正在校验已有数据
+	StateDownloading
+	StatePaused
+	StateSeeding
+	StateError    //出错停止，Status().Err 为错误原因
+	StateQueued   //等待下载或做种名额
+	StateFinished //下载完成并达到做种停止条件
+)
+
+func (s State) String() string {
+	switch s {
+	case StateFetchingMetadata:
+		return "fetching metadata"
+	case StateChecking:
+		return "checking"
+	case StateDownloading:
+		return "downloading"
+	case StatePaused:
+		return "paused"
+	case StateSeeding:
+		return "seeding"
+	case StateError:
+		return "error"
+	case StateQueued:
+		return "queued"
+	case StateFinished:
+		return "finished"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// Status 种子的当前状态
+type Status struct {
+	InfoHash   [20]byte
+	Name       string
+	State      State
+	Err        error
+	Length     int //获取到info字典之前为0
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Peers      int //当前连接的peer数量
+	Queue      int //队列中的位置，从0开始
+
+	HashFailures int                     //校验失败的piece数量
+	Banned       []downloader.BannedPeer //因发送错误数据被封禁的peer
+}
+
+// Handle 会话中的一个种子
+type Handle struct {
+	s        *Session
+	infoHash [20]byte
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{} //run 返回时关闭
+	wake     chan struct{} //名额发生变化
+
+	//由 s.mu 保护
+	want    slotKind //正在等待或占用的名额
+	granted bool
+	aliases [][20]byte //同样指向该种子的其他infohash
+
+	mu      sync.Mutex
+	name    string
+	state   State
+	err     error
+	paused  bool
+	limits  RateLimits          //种子级别的限速
+	torrent *downloader.Torrent //获取到info字典之前为空
+	storage *downloader.Storage
+}
+
+// InfoHash 种子的infohash
+func (h *Handle) InfoHash() [20]byte {
+	return h.infoHash
+}
+
+// Torrent 返回下载使用的种子，磁力链接获取到info字典之前返回nil
+func (h *Handle) Torrent() *downloader.Torrent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.torrent
+}
+
+// Status 返回种子的当前状态
+func (h *Handle) Status() Status {
+	h.s.mu.Lock()
+	queue := h.s.position(h)
+	queued := h.want != slotNone && !h.granted
+	h.s.mu.Unlock()
+
+	h.mu.Lock()
+	st := Status{
+		InfoHash: h.infoHash,
+		Name:     h.name,
+		State:    h.state,
+		Err:      h.err,
+		Queue:    queue,
+	}
+	t, paused := h.torrent, h.paused
+	h.mu.Unlock()
+
+	if st.State == StateDownloading || st.State == StateSeeding {
+		switch {
+		case paused:
+			st.State = StatePaused
+		case queued:
+			st.State = StateQueued
+		}
+	}
+	if t != nil {
+		stats := t.Stats()
+		st.Length = t.Length
+		st.Uploaded = stats.Uploaded
+		st.Downloaded = stats.Downloaded
+		st.Left = stats.Left
+		st.Peers = t.NumPeers()
+		st.HashFailures = t.HashFailures()
+		st.Banned = t.BannedPeers()
+	}
+	return st
+}
+
+// Pause 暂停种子并让出名额，获取info字典期间调用时在开始下载后生效
+func (h *Handle) Pause() {
+	h.mu.Lock()
+	h.paused = true
+	t := h.torrent
+	h.mu.Unlock()
+	if t != nil {
+		t.Pause()
+	}
+	h.s.schedule()
+}
+
+// Resume 恢复种子，没有空闲名额时重新排队，获得名额后继续下载或做种
+func (h *Handle) Resume() {
+	h.mu.Lock()
+	h.paused = false
+	h.mu.Unlock()
+	h.s.schedule()
+}
+
+//调用者可以持有 s.mu
+func (h *Handle) isPaused() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.paused
+}
+
+func (h *Handle) setState(state State) {
+	h.mu.Lock()
+	h.state = state
+	h.mu.Unlock()
+}
+
+//获取info字典、校验，排队获得名额后下载，完成后排队做种直到达到停止条件、种子被移除或会话关闭
+func (h *Handle) run(tf *parser.TorrentFile, m *parser.Magnet) {
+	defer close(h.done)
+	defer h.release()
+	err := h.start(tf, m)
+	if err != nil && h.ctx.Err() == nil {
+		log.Printf("Torrent %x stopped: %v\n", h.infoHash, err)
+		h.mu.Lock()
+		h.state = StateError
+		h.err = err
+		h.mu.Unlock()
+	}
+}
+
+func (h *Handle) start(tf *parser.TorrentFile, m *parser.Magnet) error {
+	s := h.s
+	if tf == nil {
+		h.setState(StateFetchingMetadata)
+		resolved, err := m.Resolve(h.ctx, s.peerID, s.port)
+		if err != nil {
+			return err
+		}
+		if err := resolved.Validate(); err != nil {
+			return err
+		}
+		tf = &resolved
+	}
+	s.addAliases(h, tf)
+
+	t := tf.Torrent(s.peerID, s.port)
+	t.ConnLimit = s.connLimit
+	t.MaxConns = s.cfg.MaxConnsPerTorrent
+	t.UploadLimiter, t.DownloadLimiter = s.upload, s.download
+	t.IPFilter = s.ipfilter
+	t.Dialer = s.dialer()
+	if s.cfg.Proxy != nil {
+		t.Tracker = parser.NewTracker(tf, s.peerID, s.port, s.cfg.Proxy)
+		t.WebSeedClient = s.cfg.Proxy.HTTPClient(0)
+	}
+	s.mu.Lock()
+	peerLimits := s.cfg.PeerRateLimits
+	s.mu.Unlock()
+	t.SetPeerRateLimit(peerLimits.Upload, peerLimits.Download)
+	storage := t.OpenStorage(s.dataPath(tf.Name, tf.InfoHash))
+	h.mu.Lock()
+	t.SetRateLimit(h.limits.Upload, h.limits.Download)
+	h.name = tf.Name
+	h.torrent = t
+	h.storage = storage
+	h.state = StateChecking
+	h.mu.Unlock()
+
+	res := t.Verify(storage)
+	log.Printf("Verified %d of %d pieces already on disk for %s\n", res.Verified, len(tf.PieceHashes), tf.Name)
+
+	//获得名额后才向tracker汇报 started，排队中的种子不会获取peers
+	announced := false
+	announce := func() {
+		if announced {
+			return
+		}
+		announced = true
+		//没有获取到peers时仍然继续，已经完成的种子可以直接做种
+		if _, err := t.Announce(h.ctx, downloader.EventStarted); err != nil {
+			log.Printf("Could not announce %s: %v\n", downloader.EventStarted, err)
+		}
+	}
+	h.setState(StateDownloading)
+	if t.Stats().Left > 0 {
+		if err := h.acquire(slotDownload); err != nil {
+			return err
+		}
+		announce()
+		if err := t.DownloadToContext(h.ctx, storage); err != nil {
+			return err
+		}
+	}
+
+	h.setState(StateSeeding)
+	if err := h.acquire(slotSeed); err != nil {
+		return err
+	}
+	announce()
+	reached, err := h.seed(h.ctx)
+	if err != nil {
+		return err
+	}
+	if reached {
+		log.Printf("Stopped seeding %s\n", tf.Name)
+		h.setState(StateFinished)
+	}
+	return nil
+}
+
+//停止种子并关闭存储，deleteData 为真时删除数据
+func (h *Handle) stop(deleteData bool) error {
+	h.cancel()
+	<-h.done
+	h.mu.Lock()
+	storage := h.storage
+	h.mu.Unlock()
+	if storage == nil {
+		return nil
+	}
+	if deleteData {
+		return storage.Remove()
+	}
+	return storage.Close()
+}
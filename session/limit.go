@@ -0,0 +1,121 @@
+package session
+
+import "time"
+
+//会话级别的限速以及按时间段切换的备用限速
+
+// RateLimits 上传以及下载速度限制，单位为字节每秒，0 表示不限制
+type RateLimits struct {
+	Upload   int
+	Download int
+}
+
+// Schedule 每天的一个时间段，Start 以及 End 为距离零点的时长，End 小于 Start 时跨越零点
+type Schedule struct {
+	Start time.Duration
+	End   time.Duration
+	Days  []time.Weekday //生效的日期，为空时每天生效，跨越零点时以时间段开始的日期为准
+}
+
+// Active now 是否处于该时间段内
+func (s *Schedule) Active(now time.Time) bool {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+	day := now.Weekday()
+	if s.End < s.Start {
+		//跨越零点，零点之后的部分属于前一天开始的时间段
+		if offset < s.End {
+			return s.onDay((day + 6) % 7)
+		}
+		return offset >= s.Start && s.onDay(day)
+	}
+	return offset >= s.Start && offset < s.End && s.onDay(day)
+}
+
+func (s *Schedule) onDay(day time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, d := range s.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+//检查备用限速时间段的间隔
+const scheduleInterval = time.Minute
+
+//定期根据时间段切换限速
+func (s *Session) runSchedule() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.applyLimits()
+		}
+	}
+}
+
+//根据当前时间应用普通或备用限速
+func (s *Session) applyLimits() {
+	s.mu.Lock()
+	limits := s.cfg.RateLimits
+	if s.cfg.AltSchedule != nil && s.cfg.AltSchedule.Active(time.Now()) {
+		limits = s.cfg.AltRateLimits
+	}
+	s.mu.Unlock()
+	s.upload.SetLimit(limits.Upload)
+	s.download.SetLimit(limits.Download)
+}
+
+// SetRateLimits 修改会话的限速，全部种子共享
+func (s *Session) SetRateLimits(limits RateLimits) {
+	s.mu.Lock()
+	s.cfg.RateLimits = limits
+	s.mu.Unlock()
+	s.applyLimits()
+}
+
+// SetAltRateLimits 修改备用限速以及生效的时间段，schedule 为空时不再使用备用限速
+func (s *Session) SetAltRateLimits(limits RateLimits, schedule *Schedule) {
+	s.mu.Lock()
+	s.cfg.AltRateLimits = limits
+	s.cfg.AltSchedule = schedule
+	s.mu.Unlock()
+	s.applyLimits()
+}
+
+// SetPeerRateLimits 修改每个peer的限速，已经连接的peer同样生效
+func (s *Session) SetPeerRateLimits(limits RateLimits) {
+	s.mu.Lock()
+	s.cfg.PeerRateLimits = limits
+	handles := append([]*Handle(nil), s.order...)
+	s.mu.Unlock()
+	for _, h := range handles {
+		if t := h.Torrent(); t != nil {
+			t.SetPeerRateLimit(limits.Upload, limits.Download)
+		}
+	}
+}
+
+// RateLimits 当前生效的会话限速
+func (s *Session) RateLimits() RateLimits {
+	return RateLimits{Upload: s.upload.Limit(), Download: s.download.Limit()}
+}
+
+// SetRateLimits 修改单个种子的限速，在会话限速之内生效
+func (h *Handle) SetRateLimits(limits RateLimits) {
+	h.mu.Lock()
+	h.limits = limits
+	t := h.torrent
+	h.mu.Unlock()
+	if t != nil {
+		t.SetRateLimit(limits.Upload, limits.Download)
+	}
+}
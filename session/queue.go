@@ -0,0 +1,208 @@
+package session
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+//下载队列：限制同时下载以及做种的种子数量，按照队列顺序分配名额
+
+//种子正在等待的名额类型
+type slotKind int
+
+const (
+	slotNone slotKind = iota
+	slotDownload
+	slotSeed
+)
+
+//检查做种停止条件的间隔
+const seedCheckInterval = time.Second
+
+//名额上限，0 表示不限制
+func (s *Session) limit(kind slotKind) int {
+	switch kind {
+	case slotDownload:
+		return s.cfg.MaxActiveDownloads
+	case slotSeed:
+		return s.cfg.MaxActiveSeeds
+	}
+	return 0
+}
+
+// schedule 按照队列顺序重新分配名额，暂停的种子会让出名额
+// 已经运行的种子不会被队列中靠前的种子抢占，只影响之后由谁先开始
+func (s *Session) schedule() {
+	s.mu.Lock()
+	var changed []*Handle
+	active := make(map[slotKind]int)
+	for _, h := range s.order {
+		if h.granted && (h.want == slotNone || h.isPaused()) {
+			h.granted = false
+			changed = append(changed, h)
+		}
+		if h.granted {
+			active[h.want]++
+		}
+	}
+	for _, h := range s.order {
+		if h.granted || h.want == slotNone || h.isPaused() {
+			continue
+		}
+		if limit := s.limit(h.want); limit > 0 && active[h.want] >= limit {
+			continue
+		}
+		h.granted = true
+		active[h.want]++
+		changed = append(changed, h)
+	}
+	s.mu.Unlock()
+
+	for _, h := range changed {
+		h.notify()
+	}
+}
+
+//名额发生变化，唤醒等待名额的 run，因排队而暂停的种子获得名额后恢复
+func (h *Handle) notify() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+	h.s.mu.Lock()
+	granted := h.granted
+	h.s.mu.Unlock()
+	h.mu.Lock()
+	t, paused := h.torrent, h.paused
+	h.mu.Unlock()
+	if granted && !paused && t != nil && t.Paused() {
+		go func() {
+			if err := t.Resume(h.ctx); err != nil {
+				log.Printf("Could not announce %s after resume: %v\n", t.Name, err)
+			}
+		}()
+	}
+}
+
+//等待指定类型的名额，种子被移除时返回错误
+func (h *Handle) acquire(kind slotKind) error {
+	s := h.s
+	s.mu.Lock()
+	h.want = kind
+	h.granted = false
+	s.mu.Unlock()
+	s.schedule()
+	for {
+		s.mu.Lock()
+		granted := h.granted
+		s.mu.Unlock()
+		if granted {
+			return nil
+		}
+		select {
+		case <-h.wake:
+		case <-h.ctx.Done():
+			return h.ctx.Err()
+		}
+	}
+}
+
+//归还名额，队列中的下一个种子随之开始
+func (h *Handle) release() {
+	s := h.s
+	s.mu.Lock()
+	h.want = slotNone
+	h.granted = false
+	s.mu.Unlock()
+	s.schedule()
+}
+
+// QueuePosition 种子在队列中的位置，从0开始，已经移除的种子返回-1
+func (h *Handle) QueuePosition() int {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	return h.s.position(h)
+}
+
+//调用者需持有 s.mu
+func (s *Session) position(h *Handle) int {
+	for i, o := range s.order {
+		if o == h {
+			return i
+		}
+	}
+	return -1
+}
+
+// SetQueuePosition 移动种子在队列中的位置，超出范围时移动到队首或队尾
+// 空出的名额将按照新的顺序分配
+func (h *Handle) SetQueuePosition(pos int) {
+	s := h.s
+	s.mu.Lock()
+	cur := s.position(h)
+	if cur < 0 {
+		s.mu.Unlock()
+		return
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	if pos >= len(s.order) {
+		pos = len(s.order) - 1
+	}
+	s.order = append(s.order[:cur], s.order[cur+1:]...)
+	s.order = append(s.order[:pos], append([]*Handle{h}, s.order[pos:]...)...)
+	s.mu.Unlock()
+	s.schedule()
+}
+
+//做种直到达到任意一个停止条件，返回是否因为停止条件而结束
+func (h *Handle) seed(ctx context.Context) (bool, error) {
+	cfg := h.s.cfg
+	h.mu.Lock()
+	t := h.torrent
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	reached := make(chan bool, 1)
+	go func() {
+		ticker := time.NewTicker(seedCheckInterval)
+		defer ticker.Stop()
+		start := time.Now()
+		lastUpload, lastUploaded := start, t.Stats().Uploaded
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				uploaded := t.Stats().Uploaded
+				if uploaded != lastUploaded {
+					lastUpload, lastUploaded = now, uploaded
+				}
+				ratio := float64(uploaded) / float64(t.Length)
+				if cfg.seedStop(ratio, now.Sub(start), now.Sub(lastUpload)) {
+					reached <- true
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	err := t.Seed(ctx)
+	select {
+	case <-reached:
+		return true, err
+	default:
+		return false, err
+	}
+}
+
+//是否达到任意一个做种停止条件，seeded 为做种时长，idle 为持续没有上传的时长
+func (cfg *Config) seedStop(ratio float64, seeded, idle time.Duration) bool {
+	return cfg.SeedRatio > 0 && ratio >= cfg.SeedRatio ||
+		cfg.SeedTime > 0 && seeded >= cfg.SeedTime ||
+		cfg.SeedIdleTime > 0 && idle >= cfg.SeedIdleTime
+}
@@ -0,0 +1,184 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+//不监听端口、只用于排队的会话
+func testSession(cfg Config, n int) (*Session, []*Handle) {
+	s := &Session{cfg: cfg}
+	handles := make([]*Handle, n)
+	for i := range handles {
+		ctx, cancel := context.WithCancel(context.Background())
+		handles[i] = &Handle{s: s, ctx: ctx, cancel: cancel, wake: make(chan struct{}, 1)}
+		s.order = append(s.order, handles[i])
+	}
+	return s, handles
+}
+
+//返回获得名额的种子下标
+func granted(s *Session, handles []*Handle) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var got []int
+	for i, h := range handles {
+		if h.granted {
+			got = append(got, i)
+		}
+	}
+	return got
+}
+
+//与 acquire 相同地开始等待名额，但不阻塞
+func want(s *Session, kind slotKind, handles ...*Handle) {
+	s.mu.Lock()
+	for _, h := range handles {
+		h.want = kind
+		h.granted = false
+	}
+	s.mu.Unlock()
+	s.schedule()
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestScheduleSlots(t *testing.T) {
+	s, h := testSession(Config{MaxActiveDownloads: 2, MaxActiveSeeds: 1}, 5)
+
+	//按照队列顺序分配下载名额
+	want(s, slotDownload, h[0], h[1], h[2], h[3])
+	if got := granted(s, h); !equal(got, []int{0, 1}) {
+		t.Fatalf("granted %v, want [0 1]", got)
+	}
+	//做种名额单独计算
+	want(s, slotSeed, h[4])
+	if got := granted(s, h); !equal(got, []int{0, 1, 4}) {
+		t.Fatalf("granted %v, want [0 1 4]", got)
+	}
+
+	//移到队首的种子不会抢占正在运行的种子，但在空出名额时优先
+	h[3].SetQueuePosition(0)
+	if got := granted(s, h); !equal(got, []int{0, 1, 4}) {
+		t.Fatalf("granted %v after moving 3 to the front", got)
+	}
+	h[0].release()
+	if got := granted(s, h); !equal(got, []int{1, 3, 4}) {
+		t.Fatalf("granted %v after release, want [1 3 4]", got)
+	}
+
+	//暂停的种子让出名额，恢复后重新排队
+	h[1].mu.Lock()
+	h[1].paused = true
+	h[1].mu.Unlock()
+	s.schedule()
+	if got := granted(s, h); !equal(got, []int{2, 3, 4}) {
+		t.Fatalf("granted %v after pausing 1, want [2 3 4]", got)
+	}
+	h[1].mu.Lock()
+	h[1].paused = false
+	h[1].mu.Unlock()
+	s.schedule()
+	if got := granted(s, h); !equal(got, []int{2, 3, 4}) {
+		t.Fatalf("granted %v after resuming 1", got)
+	}
+
+	//由下载转为做种时排在已有的做种种子之后
+	want(s, slotSeed, h[3])
+	if got := granted(s, h); !equal(got, []int{1, 2, 4}) {
+		t.Fatalf("granted %v after 3 finished downloading, want [1 2 4]", got)
+	}
+	h[4].release()
+	if got := granted(s, h); !equal(got, []int{1, 2, 3}) {
+		t.Fatalf("granted %v after 4 stopped seeding, want [1 2 3]", got)
+	}
+
+	//不限制时全部获得名额
+	s, h = testSession(Config{}, 3)
+	want(s, slotDownload, h...)
+	if got := granted(s, h); !equal(got, []int{0, 1, 2}) {
+		t.Errorf("unlimited: granted %v", got)
+	}
+}
+
+func TestQueuePosition(t *testing.T) {
+	s, h := testSession(Config{}, 4)
+	h[0].SetQueuePosition(2)
+	h[3].SetQueuePosition(-5)
+	h[1].SetQueuePosition(100)
+	//队列为 3 2 0 1
+	for i, wantPos := range []int{2, 3, 1, 0} {
+		if pos := h[i].QueuePosition(); pos != wantPos {
+			t.Errorf("handle %d at %d, want %d", i, pos, wantPos)
+		}
+	}
+	removed := &Handle{s: s}
+	removed.SetQueuePosition(0)
+	if pos := removed.QueuePosition(); pos != -1 || len(s.order) != 4 {
+		t.Errorf("removed handle at %d", pos)
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	s, h := testSession(Config{MaxActiveDownloads: 1}, 2)
+	if err := h[0].acquire(slotDownload); err != nil {
+		t.Fatal(err)
+	}
+	//等待名额，前一个种子归还后获得
+	done := make(chan error, 1)
+	go func() { done <- h[1].acquire(slotDownload) }()
+	select {
+	case err := <-done:
+		t.Fatalf("acquire returned %v while the slot was taken", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	h[0].release()
+	if err := <-done; err != nil || !equal(granted(s, h), []int{1}) {
+		t.Fatalf("acquire = %v, granted %v", err, granted(s, h))
+	}
+
+	//种子被移除时停止等待
+	go func() { done <- h[0].acquire(slotDownload) }()
+	h[0].cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire after cancel = %v", err)
+	}
+}
+
+func TestSeedStop(t *testing.T) {
+	tests := []struct {
+		cfg    Config
+		ratio  float64
+		seeded time.Duration
+		idle   time.Duration
+		stop   bool
+	}{
+		{Config{}, 100, 1000 * time.Hour, 1000 * time.Hour, false},
+		{Config{SeedRatio: 2}, 1.99, 0, 0, false},
+		{Config{SeedRatio: 2}, 2, 0, 0, true},
+		{Config{SeedTime: time.Hour}, 0, 59 * time.Minute, 0, false},
+		{Config{SeedTime: time.Hour}, 0, time.Hour, 0, true},
+		{Config{SeedIdleTime: 10 * time.Minute}, 0, time.Hour, 9 * time.Minute, false},
+		{Config{SeedIdleTime: 10 * time.Minute}, 0, time.Hour, 10 * time.Minute, true},
+		//达到任意一个条件即停止
+		{Config{SeedRatio: 2, SeedTime: time.Hour}, 0.5, 2 * time.Hour, 0, true},
+		{Config{SeedRatio: 2, SeedTime: time.Hour}, 3, time.Minute, 0, true},
+	}
+	for _, tt := range tests {
+		if got := tt.cfg.seedStop(tt.ratio, tt.seeded, tt.idle); got != tt.stop {
+			t.Errorf("%+v seedStop(%v, %v, %v) = %v, want %v", tt.cfg, tt.ratio, tt.seeded, tt.idle, got, tt.stop)
+		}
+	}
+}
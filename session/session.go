@@ -0,0 +1,388 @@
+package session
+
+import (
+	"bitDownloader/downloader"
+	"bitDownloader/handshake"
+	"bitDownloader/ipfilter"
+	"bitDownloader/parser"
+	"bitDownloader/proxy"
+	"bitDownloader/ratelimit"
+	"bitDownloader/utp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//同时管理多个种子的下载与做种
+
+// PeerIDPrefix 会话生成的peer ID前缀，其余12字节随机
+const PeerIDPrefix = "-BD0001-"
+
+// Config 会话配置
+type Config struct {
+	ListenAddr string //接受传入连接的地址，为空时使用 ":6881"
+	DataDir    string //下载目录，每个种子的数据保存在 DataDir/Name
+	MaxConns   int    //全部种子共享的最大连接数，0 表示不限制
+	// MaxConnsPerTorrent 每个种子主动维持的连接数，0 时使用 downloader.DefaultMaxConns
+	MaxConnsPerTorrent int
+
+	MaxActiveDownloads int //同时下载的种子数量，其余排队等待，0 表示不限制
+	MaxActiveSeeds     int //同时做种的种子数量，0 表示不限制
+
+	//做种停止条件，达到任意一个即停止做种并让出名额，0 表示不启用
+	SeedRatio    float64       //上传量与种子大小之比
+	SeedTime     time.Duration //做种时长
+	SeedIdleTime time.Duration //持续没有上传的时长
+
+	RateLimits     RateLimits //全部种子共享的限速
+	PeerRateLimits RateLimits //每个peer的限速
+	AltRateLimits  RateLimits //AltSchedule 时间段内代替 RateLimits 的备用限速
+	AltSchedule    *Schedule  //为空时不使用备用限速
+
+	// IPFilter 屏蔽列表文件，eMule ipfilter.dat、PeerGuardian P2P 或 CIDR 格式，为空时不过滤
+	IPFilter string
+
+	// Proxy tracker请求、UDP tracker以及peer连接经过该代理，为空时直接连接
+	// Proxy.Force 时同时拒绝全部传入连接；使用代理时只通过代理的TCP连接peer，不使用uTP
+	Proxy *proxy.Proxy
+
+	// Transport 连接peer时TCP以及uTP的偏好，默认先尝试TCP
+	Transport Transport
+}
+
+// Session 管理多个种子，全部种子共享同一个peer ID、监听端口以及连接数限制
+type Session struct {
+	cfg       Config
+	peerID    [20]byte
+	port      uint16
+	listener  net.Listener
+	utp       *utp.Socket //与TCP使用相同端口号的UDP端口，供uTP以及DHT共享，不使用uTP时为空
+	connLimit chan struct{}
+	upload    *ratelimit.Limiter
+	download  *ratelimit.Limiter
+	ipfilter  *ipfilter.Filter //全部种子共享，重新加载时立即生效
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Handle //混合种子的v1以及v2 infohash指向同一个种子
+	order    []*Handle            //按照添加顺序排列
+	closed   bool
+}
+
+// New 创建会话并开始监听传入连接
+func New(cfg Config) (*Session, error) {
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = ":6881"
+	}
+	filter := ipfilter.New(nil)
+	if cfg.IPFilter != "" {
+		var err error
+		if filter, err = ipfilter.LoadFile(cfg.IPFilter); err != nil {
+			return nil, fmt.Errorf("Could not load IP filter: %w", err)
+		}
+	}
+	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		cfg:      cfg,
+		listener: ln,
+		torrents: make(map[[20]byte]*Handle),
+		upload:   ratelimit.NewLimiter(0),
+		download: ratelimit.NewLimiter(0),
+		ipfilter: filter,
+	}
+	copy(s.peerID[:], PeerIDPrefix)
+	if _, err := rand.Read(s.peerID[len(PeerIDPrefix):]); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+		s.port = uint16(addr.Port)
+	}
+	if cfg.Transport != TCPOnly && cfg.Proxy == nil {
+		host, _, _ := net.SplitHostPort(cfg.ListenAddr)
+		s.utp, err = utp.Listen("udp", net.JoinHostPort(host, strconv.Itoa(int(s.port))))
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	if cfg.MaxConns > 0 {
+		s.connLimit = make(chan struct{}, cfg.MaxConns)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.applyLimits()
+
+	s.wg.Add(2)
+	go s.accept(ln)
+	go s.runSchedule()
+	if s.utp != nil {
+		s.wg.Add(1)
+		go s.accept(s.utp)
+	}
+	return s, nil
+}
+
+// PeerID 会话中全部种子使用的peer ID
+func (s *Session) PeerID() [20]byte {
+	return s.peerID
+}
+
+// Addr 实际监听的地址
+func (s *Session) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// UDPSocket 与TCP监听相同端口号的UDP端口，非uTP的数据报（例如DHT消息）可以通过它收发
+// 不使用uTP时为空
+func (s *Session) UDPSocket() *utp.Socket {
+	return s.utp
+}
+
+//接受TCP或uTP传入连接，直到监听关闭
+func (s *Session) accept(ln net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Could not accept connection: %v\n", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+//读取对方的握手消息，根据infohash交给对应的种子
+func (s *Session) handleConn(conn net.Conn) {
+	if s.cfg.Proxy != nil && s.cfg.Proxy.Force {
+		conn.Close()
+		return
+	}
+	if blocked, _ := s.ipfilter.Blocked(remoteIP(conn.RemoteAddr())); blocked {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	h, err := handshake.Read(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	s.mu.Lock()
+	handle := s.torrents[h.InfoHash]
+	s.mu.Unlock()
+	var t *downloader.Torrent
+	if handle != nil {
+		t = handle.Torrent()
+	}
+	if t == nil {
+		conn.Close()
+		return
+	}
+	if err := t.AddConn(conn, h); err != nil {
+		log.Printf("Rejected connection from %s: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+	}
+}
+
+// AddTorrentFile 读取并添加种子文件
+func (s *Session) AddTorrentFile(path string) (*Handle, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	bto, err := parser.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	tf, err := bto.ToTorrentFile()
+	if err != nil {
+		return nil, err
+	}
+	return s.AddTorrent(tf)
+}
+
+// AddTorrent 添加种子，立即开始校验已有数据并下载
+func (s *Session) AddTorrent(tf parser.TorrentFile) (*Handle, error) {
+	if err := tf.Validate(); err != nil {
+		return nil, err
+	}
+	return s.add(tf.InfoHash, tf.Name, &tf, nil)
+}
+
+// AddMagnet 添加磁力链接，获取到info字典后开始下载
+func (s *Session) AddMagnet(uri string) (*Handle, error) {
+	m, err := parser.ParseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+	m.IPFilter = s.ipfilter
+	m.Proxy = s.cfg.Proxy
+	m.Dialer = s.dialer()
+	return s.add(m.InfoHash, m.Name, nil, m)
+}
+
+// IPFilter 会话使用的屏蔽列表
+func (s *Session) IPFilter() *ipfilter.Filter {
+	return s.ipfilter
+}
+
+// ReloadIPFilter 重新读取 Config.IPFilter 指定的屏蔽列表文件并断开新屏蔽的peer，
+// 读取失败时继续使用原有的列表
+func (s *Session) ReloadIPFilter() error {
+	if s.cfg.IPFilter == "" {
+		return errors.New("No IP filter file configured")
+	}
+	if err := s.ipfilter.Reload(); err != nil {
+		return err
+	}
+	for _, h := range s.Torrents() {
+		if t := h.Torrent(); t != nil {
+			t.DisconnectBlocked()
+		}
+	}
+	return nil
+}
+
+func (s *Session) add(infoHash [20]byte, name string, tf *parser.TorrentFile, m *parser.Magnet) (*Handle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errors.New("Session is closed")
+	}
+	if _, ok := s.torrents[infoHash]; ok {
+		return nil, fmt.Errorf("Torrent %x already added", infoHash)
+	}
+	h := &Handle{
+		s:        s,
+		infoHash: infoHash,
+		name:     name,
+		done:     make(chan struct{}),
+		wake:     make(chan struct{}, 1),
+	}
+	h.ctx, h.cancel = context.WithCancel(s.ctx)
+	s.torrents[infoHash] = h
+	s.order = append(s.order, h)
+	go h.run(tf, m)
+	return h, nil
+}
+
+// Get 根据infohash查找种子
+func (s *Session) Get(infoHash [20]byte) (*Handle, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.torrents[infoHash]
+	return h, ok
+}
+
+// Torrents 按照添加顺序返回全部种子
+func (s *Session) Torrents() []*Handle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Handle(nil), s.order...)
+}
+
+// Remove 停止并移除种子，deleteData 为真时同时删除已经下载的数据
+func (s *Session) Remove(infoHash [20]byte, deleteData bool) error {
+	s.mu.Lock()
+	h, ok := s.torrents[infoHash]
+	if ok {
+		delete(s.torrents, h.infoHash)
+		for _, alias := range h.aliases {
+			delete(s.torrents, alias)
+		}
+		for i, o := range s.order {
+			if o == h {
+				s.order = append(s.order[:i], s.order[i+1:]...)
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("Torrent %x not found", infoHash)
+	}
+	err := h.stop(deleteData)
+	s.schedule()
+	return err
+}
+
+//获取到info字典后，将种子的其他infohash也指向该种子
+//混合种子的peer可以使用v1或截断的v2 infohash握手，磁力链接只给出了其中一个
+func (s *Session) addAliases(h *Handle, tf *parser.TorrentFile) {
+	hashes := [][20]byte{tf.InfoHash}
+	if tf.InfoHashV2 != [32]byte{} {
+		var v2 [20]byte
+		copy(v2[:], tf.InfoHashV2[:20])
+		hashes = append(hashes, v2)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	//种子已经被移除
+	if s.torrents[h.infoHash] != h {
+		return
+	}
+	for _, hash := range hashes {
+		if _, ok := s.torrents[hash]; ok {
+			continue
+		}
+		s.torrents[hash] = h
+		h.aliases = append(h.aliases, hash)
+	}
+}
+
+// Close 停止全部种子并关闭监听，已经下载的数据会保留在磁盘上
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	handles := s.order
+	s.order = nil
+	s.torrents = make(map[[20]byte]*Handle)
+	s.mu.Unlock()
+
+	err := s.listener.Close()
+	if s.utp != nil {
+		s.utp.Close()
+	}
+	s.cancel()
+	for _, h := range handles {
+		if serr := h.stop(false); err == nil {
+			err = serr
+		}
+	}
+	s.wg.Wait()
+	return err
+}
+
+//种子数据保存的位置，名称不是单级路径时使用infohash，避免写到下载目录之外
+func (s *Session) dataPath(name string, infoHash [20]byte) string {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		name = fmt.Sprintf("%x", infoHash)
+	}
+	return filepath.Join(s.cfg.DataDir, name)
+}
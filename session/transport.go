@@ -0,0 +1,113 @@
+package session
+
+import (
+	"bitDownloader/downloader"
+	"bitDownloader/utp"
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+//连接peer使用的传输协议，TCP以及uTP共用同一个端口号
+
+// Transport 连接peer时使用的传输协议，除 TCPOnly 外同时接受TCP以及uTP传入连接
+type Transport int
+
+const (
+	PreferTCP Transport = iota //先尝试TCP，失败时尝试uTP
+	PreferUTP                  //先尝试uTP，失败时尝试TCP
+	TCPOnly                    //只使用TCP，不打开uTP端口
+	UTPOnly                    //只使用uTP
+)
+
+func (t Transport) String() string {
+	switch t {
+	case PreferTCP:
+		return "prefer-tcp"
+	case PreferUTP:
+		return "prefer-utp"
+	case TCPOnly:
+		return "tcp"
+	case UTPOnly:
+		return "utp"
+	}
+	return fmt.Sprintf("Transport(%d)", int(t))
+}
+
+// ParseTransport 解析 prefer-tcp、prefer-utp、tcp 或 utp
+func ParseTransport(s string) (Transport, error) {
+	for _, t := range []Transport{PreferTCP, PreferUTP, TCPOnly, UTPOnly} {
+		if t.String() == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown transport %q", s)
+}
+
+//每种协议尝试连接的超时时间
+const transportDialTimeout = 3 * time.Second
+
+//按照偏好依次尝试TCP以及uTP，实现 downloader.Dialer
+type peerDialer struct {
+	transport Transport
+	utp       *utp.Socket
+}
+
+func (d *peerDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	overTCP := func(ctx context.Context) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	overUTP := func(ctx context.Context) (net.Conn, error) {
+		return d.utp.DialContext(ctx, "utp", addr)
+	}
+	var order []func(context.Context) (net.Conn, error)
+	switch d.transport {
+	case PreferUTP:
+		order = append(order, overUTP, overTCP)
+	case UTPOnly:
+		order = append(order, overUTP)
+	default:
+		order = append(order, overTCP, overUTP)
+	}
+
+	var firstErr error
+	for _, dial := range order {
+		attempt, cancel := context.WithTimeout(ctx, transportDialTimeout)
+		conn, err := dial(attempt)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+//连接peer使用的拨号器：使用代理时经过代理，否则按照 Config.Transport 选择TCP或uTP
+func (s *Session) dialer() downloader.Dialer {
+	if s.cfg.Proxy != nil {
+		return s.cfg.Proxy
+	}
+	if s.utp != nil {
+		return &peerDialer{transport: s.cfg.Transport, utp: s.utp}
+	}
+	return nil
+}
+
+//传入连接对端的IP，TCP以及uTP连接分别使用 *net.TCPAddr 以及 *net.UDPAddr
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+)
+
+//边下边播：按顺序下载并通过HTTP提供文件，支持Range请求
+func runStream(args []string) error {
+	fs := flag.NewFlagSet("stream", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "HTTP listen address")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	tof, err := loadTorrent(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	torrent, err := tof.NewTorrent(ctx)
+	if err != nil {
+		return err
+	}
+	torrent.Sequential = true
+	storage := torrent.OpenStorage(fs.Arg(1))
+	defer storage.Close()
+
+	res := torrent.Verify(storage)
+	log.Printf("Verified %d of %d pieces already on disk\n", res.Verified, len(tof.PieceHashes))
+
+	downloaded := make(chan struct{})
+	go func() {
+		defer close(downloaded)
+		if err := torrent.DownloadToContext(ctx, storage); err != nil {
+			log.Println("Download stopped:", err)
+			return
+		}
+		log.Println("Download complete, still serving")
+	}()
+
+	server := &http.Server{Addr: *addr, Handler: torrent.Handler()}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Printf("Serving %s on http://%s/\n", tof.Name, *addr)
+	err = server.ListenAndServe()
+	//等待下载停止，确保数据落盘并向tracker汇报
+	stop()
+	<-downloaded
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
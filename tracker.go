@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bitDownloader/tracker"
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//运行HTTP以及UDP tracker，两者共享同一个swarm存储，收到 SIGHUP 时重新读取白名单
+func runTracker(args []string) error {
+	fs := flag.NewFlagSet("tracker", flag.ExitOnError)
+	listen := fs.String("listen", ":6969", "HTTP listen address, announce URL is http://host:port/announce, empty to disable")
+	udpListen := fs.String("udp", "", "UDP listen address, announce URL is udp://host:port, empty to disable")
+	interval := fs.Duration("interval", tracker.DefaultInterval, "announce interval sent to clients")
+	peerTimeout := fs.Duration("peer-timeout", 0, "forget peers that have not announced for this long, defaults to twice the interval")
+	whitelist := fs.String("whitelist", "", "file of allowed infohashes, one hex infohash per line, reloaded on SIGHUP")
+	realIP := fs.String("real-ip-header", "", "take the client address from this header when behind a reverse proxy, e.g. X-Real-IP")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		usage()
+		os.Exit(2)
+	}
+	if *listen == "" && *udpListen == "" {
+		return fmt.Errorf("Nothing to serve, both -listen and -udp are empty")
+	}
+
+	cfg := tracker.Config{Interval: *interval, PeerTimeout: *peerTimeout}
+	if *whitelist != "" {
+		hashes, err := loadWhitelist(*whitelist)
+		if err != nil {
+			return err
+		}
+		cfg.Whitelist = hashes
+		log.Printf("Loaded %d whitelisted infohashes\n", len(hashes))
+	}
+	store := tracker.NewStore(cfg)
+	ctx, stop := signalContext()
+	defer stop()
+	go store.Run(ctx)
+
+	//任意一个服务出错时停止全部服务
+	errs := make(chan error, 2)
+	running := 0
+	if *listen != "" {
+		handler := tracker.NewHTTPHandler(store)
+		handler.RealIPHeader = *realIP
+		server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+		ln, err := net.Listen("tcp", *listen)
+		if err != nil {
+			return err
+		}
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+		running++
+		go func() {
+			if err := server.Serve(ln); err != http.ErrServerClosed {
+				errs <- err
+				return
+			}
+			errs <- nil
+		}()
+		log.Printf("HTTP tracker listening on %s\n", ln.Addr())
+	}
+	if *udpListen != "" {
+		conn, err := net.ListenPacket("udp", *udpListen)
+		if err != nil {
+			return err
+		}
+		server, err := tracker.NewUDPServer(store, conn)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+		running++
+		go func() { errs <- server.Serve() }()
+		log.Printf("UDP tracker listening on %s\n", conn.LocalAddr())
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			if *whitelist == "" {
+				continue
+			}
+			hashes, err := loadWhitelist(*whitelist)
+			if err != nil {
+				log.Printf("Could not reload whitelist: %v\n", err)
+				continue
+			}
+			store.SetWhitelist(hashes)
+			log.Printf("Reloaded whitelist: %d infohashes\n", len(hashes))
+		}
+	}()
+
+	var first error
+	for ; running > 0; running-- {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+			stop()
+		}
+	}
+	return first
+}
+
+//读取白名单，每行一个40位十六进制infohash，忽略空行以及 # 开头的注释
+func loadWhitelist(path string) ([][20]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var hashes [][20]byte
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		buf, err := hex.DecodeString(text)
+		if err != nil || len(buf) != 20 {
+			return nil, fmt.Errorf("%s:%d: invalid infohash %q", path, line, text)
+		}
+		var hash [20]byte
+		copy(hash[:], buf)
+		hashes = append(hashes, hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(hashes) == 0 {
+		return nil, fmt.Errorf("%s has no infohashes", path)
+	}
+	return hashes, nil
+}
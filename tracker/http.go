@@ -0,0 +1,241 @@
+package tracker
+
+import (
+	"bitDownloader/bencode"
+	"bitDownloader/downloader"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+//HTTP tracker：/announce 以及 /scrape，响应为bencode字典，出错时返回 failure reason
+
+// HTTPHandler HTTP tracker的请求处理，路径以 /announce 或 /scrape 结尾
+type HTTPHandler struct {
+	Store *Store
+	// RealIPHeader 位于反向代理之后时读取客户端地址的请求头，例如 X-Real-IP，为空时使用连接的地址
+	RealIPHeader string
+}
+
+// NewHTTPHandler 创建使用 store 的HTTP tracker
+func NewHTTPHandler(store *Store) *HTTPHandler {
+	return &HTTPHandler{Store: store}
+}
+
+type announceResponse struct {
+	Interval    int64       `bencode:"interval"`
+	MinInterval int64       `bencode:"min interval,omitempty"`
+	Complete    int         `bencode:"complete"`
+	Incomplete  int         `bencode:"incomplete"`
+	Peers       interface{} `bencode:"peers"`            //compact时为字符串，否则为字典列表
+	Peers6      string      `bencode:"peers6,omitempty"` //compact时的IPv6 peers(BEP 7)
+}
+
+type dictPeer struct {
+	ID   string `bencode:"peer id,omitempty"`
+	IP   string `bencode:"ip"`
+	Port uint16 `bencode:"port"`
+}
+
+type scrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+type scrapeResponse struct {
+	Files map[string]scrapeFile `bencode:"files"`
+}
+
+type failureResponse struct {
+	Reason string `bencode:"failure reason"`
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/announce"):
+		h.announce(w, r)
+	case strings.HasSuffix(r.URL.Path, "/scrape"):
+		h.scrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *HTTPHandler) announce(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	req, err := h.parseAnnounce(r, q)
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+	resp, err := h.Store.Announce(req)
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+	out := announceResponse{
+		Interval:    int64(resp.Interval.Seconds()),
+		MinInterval: int64(resp.MinInterval.Seconds()),
+		Complete:    resp.Complete,
+		Incomplete:  resp.Incomplete,
+	}
+	if q.Get("compact") == "1" {
+		var peers, peers6 []byte
+		for _, p := range resp.Peers {
+			if ip4 := p.IP.To4(); ip4 != nil {
+				peers = appendCompact(peers, ip4, p.Port)
+			} else {
+				peers6 = appendCompact(peers6, p.IP.To16(), p.Port)
+			}
+		}
+		out.Peers, out.Peers6 = string(peers), string(peers6)
+	} else {
+		//条目由peer ID以及来源地址共同标识，公开peer ID不能用来替换或删除其他peer
+		noID := q.Get("no_peer_id") == "1"
+		peers := make([]dictPeer, 0, len(resp.Peers))
+		for _, p := range resp.Peers {
+			dp := dictPeer{IP: p.IP.String(), Port: p.Port}
+			if !noID {
+				dp.ID = string(p.ID[:])
+			}
+			peers = append(peers, dp)
+		}
+		out.Peers = peers
+	}
+	writeBencode(w, out)
+}
+
+//解析announce参数，info_hash 以及 peer_id 为URL编码的20字节
+func (h *HTTPHandler) parseAnnounce(r *http.Request, q url.Values) (*AnnounceRequest, error) {
+	req := &AnnounceRequest{NumWant: -1}
+	if err := parseHash(q, "info_hash", &req.InfoHash); err != nil {
+		return nil, err
+	}
+	if err := parseHash(q, "peer_id", &req.PeerID); err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("Invalid port %q", q.Get("port"))
+	}
+	req.Port = uint16(port)
+	for _, f := range []struct {
+		name     string
+		dst      *int64
+		required bool
+	}{
+		{"uploaded", &req.Uploaded, false},
+		{"downloaded", &req.Downloaded, false},
+		{"left", &req.Left, true},
+	} {
+		v := q.Get(f.name)
+		if v == "" && !f.required {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid %s %q", f.name, v)
+		}
+		*f.dst = n
+	}
+	if v := q.Get("numwant"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid numwant %q", v)
+		}
+		req.NumWant = n
+	}
+	switch event := q.Get("event"); event {
+	case downloader.EventNone, downloader.EventStarted, downloader.EventCompleted, downloader.EventStopped:
+		req.Event = event
+	case "empty":
+		req.Event = downloader.EventNone
+	default:
+		return nil, fmt.Errorf("Invalid event %q", event)
+	}
+	if req.IP = h.remoteIP(r); req.IP == nil {
+		return nil, fmt.Errorf("Could not determine client address")
+	}
+	return req, nil
+}
+
+func (h *HTTPHandler) scrape(w http.ResponseWriter, r *http.Request) {
+	var hashes [][20]byte
+	for _, v := range r.URL.Query()["info_hash"] {
+		if len(v) != 20 {
+			writeFailure(w, fmt.Sprintf("Invalid info_hash of length %d", len(v)))
+			return
+		}
+		var hash [20]byte
+		copy(hash[:], v)
+		hashes = append(hashes, hash)
+	}
+	out := scrapeResponse{Files: make(map[string]scrapeFile)}
+	for hash, st := range h.Store.Scrape(hashes) {
+		out.Files[string(hash[:])] = scrapeFile{
+			Complete:   st.Complete,
+			Downloaded: st.Downloaded,
+			Incomplete: st.Incomplete,
+		}
+	}
+	writeBencode(w, out)
+}
+
+//客户端地址，IPv4映射的IPv6地址转换为IPv4
+func (h *HTTPHandler) remoteIP(r *http.Request) net.IP {
+	var ip net.IP
+	if h.RealIPHeader != "" {
+		//X-Forwarded-For 可能包含多个地址，第一个为客户端
+		v := r.Header.Get(h.RealIPHeader)
+		if i := strings.IndexByte(v, ','); i >= 0 {
+			v = v[:i]
+		}
+		ip = net.ParseIP(strings.TrimSpace(v))
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = net.ParseIP(host)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func parseHash(q url.Values, name string, dst *[20]byte) error {
+	v := q.Get(name)
+	if len(v) != 20 {
+		return fmt.Errorf("Invalid %s of length %d", name, len(v))
+	}
+	copy(dst[:], v)
+	return nil
+}
+
+//紧凑格式：IP地址后跟大端序的端口
+func appendCompact(buf []byte, ip net.IP, port uint16) []byte {
+	buf = append(buf, ip...)
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], port)
+	return append(buf, b[:]...)
+}
+
+//按照惯例失败时同样返回200，由 failure reason 说明原因
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeBencode(w, failureResponse{Reason: reason})
+}
+
+func writeBencode(w http.ResponseWriter, v interface{}) {
+	data, err := bencode.Marshal(v)
+	if err != nil {
+		log.Printf("Could not encode tracker response: %v\n", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
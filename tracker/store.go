@@ -0,0 +1,303 @@
+package tracker
+
+import (
+	"bitDownloader/downloader"
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+//内存中的swarm存储：记录每个种子的peers，按照汇报间隔删除过期的peer，HTTP以及UDP tracker共享
+
+// DefaultInterval Config.Interval 为0时客户端汇报的间隔
+const DefaultInterval = 30 * time.Minute
+
+// DefaultNumWant 客户端没有给出 numwant 时返回的peer数量
+const DefaultNumWant = 50
+
+// MaxNumWant 一次返回的peer数量上限
+const MaxNumWant = 200
+
+// ErrNotRegistered 种子不在白名单中
+var ErrNotRegistered = errors.New("Torrent is not registered with this tracker")
+
+// Config tracker的配置
+type Config struct {
+	// Interval 客户端汇报的间隔，0 时使用 DefaultInterval
+	Interval time.Duration
+	// MinInterval 客户端两次汇报之间的最短间隔，0 时为 Interval 的一半
+	MinInterval time.Duration
+	// PeerTimeout 超过该时间没有汇报的peer被删除，0 时为 Interval 的两倍
+	PeerTimeout time.Duration
+	// Whitelist 允许的infohash，为空时接受任意种子
+	Whitelist [][20]byte
+}
+
+// Peer swarm中的一个peer
+type Peer struct {
+	ID   [20]byte
+	IP   net.IP
+	Port uint16
+}
+
+// AnnounceRequest 客户端的一次汇报
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	IP         net.IP
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      string //downloader.EventStarted 等
+	NumWant    int    //小于0时使用 DefaultNumWant
+}
+
+// AnnounceResponse 汇报的结果
+type AnnounceResponse struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	Complete    int //做种者数量
+	Incomplete  int //下载者数量
+	Peers       []Peer
+}
+
+// ScrapeStats 一个种子的统计
+type ScrapeStats struct {
+	Complete   int
+	Downloaded int //汇报过 completed 的次数
+	Incomplete int
+}
+
+type peerEntry struct {
+	Peer
+	left int64
+	seen time.Time
+}
+
+//peer由peer ID以及地址共同标识，地址总是来自请求的来源，
+//其他客户端即使知道peer ID也无法替换或删除该peer
+type peerKey struct {
+	id   [20]byte
+	ip   [16]byte
+	port uint16
+}
+
+func keyOf(id [20]byte, ip net.IP, port uint16) peerKey {
+	k := peerKey{id: id, port: port}
+	copy(k.ip[:], ip.To16())
+	return k
+}
+
+type swarm struct {
+	peers      map[peerKey]*peerEntry
+	seeders    int
+	downloaded int
+}
+
+// Store 内存中的swarm存储，可以被多个tracker服务共享
+type Store struct {
+	cfg Config
+
+	mu        sync.Mutex
+	swarms    map[[20]byte]*swarm
+	whitelist map[[20]byte]bool //为空时接受任意种子
+}
+
+// NewStore 按照配置创建存储，需要调用 Run 定期删除过期的peer
+func NewStore(cfg Config) *Store {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.MinInterval <= 0 {
+		cfg.MinInterval = cfg.Interval / 2
+	}
+	if cfg.PeerTimeout <= 0 {
+		cfg.PeerTimeout = 2 * cfg.Interval
+	}
+	s := &Store{cfg: cfg, swarms: make(map[[20]byte]*swarm)}
+	s.SetWhitelist(cfg.Whitelist)
+	return s
+}
+
+// SetWhitelist 替换白名单，为空时接受任意种子，不在新名单中的swarm被删除
+func (s *Store) SetWhitelist(hashes [][20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(hashes) == 0 {
+		s.whitelist = nil
+		return
+	}
+	s.whitelist = make(map[[20]byte]bool, len(hashes))
+	for _, h := range hashes {
+		s.whitelist[h] = true
+	}
+	for h := range s.swarms {
+		if !s.whitelist[h] {
+			delete(s.swarms, h)
+		}
+	}
+}
+
+// Announce 记录汇报并返回该种子的其他peers，stopped 事件删除同一地址上的该peer
+func (s *Store) Announce(req *AnnounceRequest) (*AnnounceResponse, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.whitelist != nil && !s.whitelist[req.InfoHash] {
+		return nil, ErrNotRegistered
+	}
+	sw := s.swarms[req.InfoHash]
+	if sw == nil {
+		if req.Event == downloader.EventStopped {
+			return &AnnounceResponse{Interval: s.cfg.Interval, MinInterval: s.cfg.MinInterval}, nil
+		}
+		sw = &swarm{peers: make(map[peerKey]*peerEntry)}
+		s.swarms[req.InfoHash] = sw
+	}
+	sw.expire(now.Add(-s.cfg.PeerTimeout))
+
+	key := keyOf(req.PeerID, req.IP, req.Port)
+	if req.Event == downloader.EventStopped {
+		sw.remove(key)
+		if len(sw.peers) == 0 && sw.downloaded == 0 {
+			delete(s.swarms, req.InfoHash)
+		}
+		return &AnnounceResponse{
+			Interval:    s.cfg.Interval,
+			MinInterval: s.cfg.MinInterval,
+			Complete:    sw.seeders,
+			Incomplete:  len(sw.peers) - sw.seeders,
+		}, nil
+	}
+	//只有从未完成变为完成时计数，重复发送的 completed 不重复计入
+	if req.Event == downloader.EventCompleted && req.Left == 0 {
+		if prev := sw.peers[key]; prev == nil || prev.left > 0 {
+			sw.downloaded++
+		}
+	}
+	sw.remove(key)
+	sw.peers[key] = &peerEntry{
+		Peer: Peer{ID: req.PeerID, IP: req.IP, Port: req.Port},
+		left: req.Left,
+		seen: now,
+	}
+	if req.Left == 0 {
+		sw.seeders++
+	}
+
+	numWant := req.NumWant
+	if numWant < 0 {
+		numWant = DefaultNumWant
+	}
+	if numWant > MaxNumWant {
+		numWant = MaxNumWant
+	}
+	return &AnnounceResponse{
+		Interval:    s.cfg.Interval,
+		MinInterval: s.cfg.MinInterval,
+		Complete:    sw.seeders,
+		Incomplete:  len(sw.peers) - sw.seeders,
+		Peers:       sw.pick(req.PeerID, req.Left == 0, numWant),
+	}, nil
+}
+
+// Scrape 返回种子的统计，没有peer的种子统计为零，不在白名单中的种子被忽略，hashes 为空时返回全部种子
+func (s *Store) Scrape(hashes [][20]byte) map[[20]byte]ScrapeStats {
+	cutoff := time.Now().Add(-s.cfg.PeerTimeout)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(hashes) == 0 {
+		for h := range s.swarms {
+			hashes = append(hashes, h)
+		}
+	}
+	stats := make(map[[20]byte]ScrapeStats, len(hashes))
+	for _, h := range hashes {
+		if s.whitelist != nil && !s.whitelist[h] {
+			continue
+		}
+		sw := s.swarms[h]
+		if sw == nil {
+			stats[h] = ScrapeStats{}
+			continue
+		}
+		sw.expire(cutoff)
+		stats[h] = ScrapeStats{
+			Complete:   sw.seeders,
+			Downloaded: sw.downloaded,
+			Incomplete: len(sw.peers) - sw.seeders,
+		}
+	}
+	return stats
+}
+
+// Run 定期删除过期的peer以及空的swarm，直到 ctx 取消
+func (s *Store) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PeerTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.sweep(now)
+		}
+	}
+}
+
+func (s *Store) sweep(now time.Time) {
+	cutoff := now.Add(-s.cfg.PeerTimeout)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, sw := range s.swarms {
+		sw.expire(cutoff)
+		//保留已经有过完成记录的swarm，scrape仍然可以得到 downloaded
+		if len(sw.peers) == 0 && sw.downloaded == 0 {
+			delete(s.swarms, h)
+		}
+	}
+}
+
+//删除 cutoff 之前最后一次汇报的peer
+func (sw *swarm) expire(cutoff time.Time) {
+	for key, p := range sw.peers {
+		if p.seen.Before(cutoff) {
+			sw.remove(key)
+		}
+	}
+}
+
+func (sw *swarm) remove(key peerKey) {
+	if p, ok := sw.peers[key]; ok {
+		if p.left == 0 {
+			sw.seeders--
+		}
+		delete(sw.peers, key)
+	}
+}
+
+//随机挑选至多 n 个其他peer，跳过使用相同peer ID的条目，做种者只需要下载者
+func (sw *swarm) pick(self [20]byte, seeding bool, n int) []Peer {
+	candidates := make([]*peerEntry, 0, len(sw.peers))
+	for key, p := range sw.peers {
+		if key.id == self || (seeding && p.left == 0) {
+			continue
+		}
+		candidates = append(candidates, p)
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	peers := make([]Peer, len(candidates))
+	for i, p := range candidates {
+		peers[i] = p.Peer
+	}
+	return peers
+}
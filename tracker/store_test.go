@@ -0,0 +1,98 @@
+package tracker
+
+import (
+	"bitDownloader/downloader"
+	"net"
+	"testing"
+)
+
+func TestStoreIgnoresSpoofedPeerID(t *testing.T) {
+	store := NewStore(Config{})
+	hash := [20]byte{1}
+	victim := [20]byte{'v'}
+	announce := func(id [20]byte, ip string, port uint16, event string) *AnnounceResponse {
+		t.Helper()
+		resp, err := store.Announce(&AnnounceRequest{
+			InfoHash: hash,
+			PeerID:   id,
+			IP:       net.ParseIP(ip).To4(),
+			Port:     port,
+			Left:     1,
+			Event:    event,
+			NumWant:  -1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	announce(victim, "10.0.0.1", 6881, downloader.EventStarted)
+
+	//使用相同peer ID从其他地址发送 stopped 以及重新汇报
+	announce(victim, "6.6.6.6", 6881, downloader.EventStopped)
+	announce(victim, "6.6.6.6", 1234, downloader.EventNone)
+
+	resp := announce([20]byte{'o'}, "10.0.0.2", 6881, downloader.EventStarted)
+	found := false
+	for _, p := range resp.Peers {
+		if p.IP.Equal(net.ParseIP("10.0.0.1")) && p.Port == 6881 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("victim was evicted or moved, peers %v", resp.Peers)
+	}
+
+	//同一地址的 stopped 删除该peer
+	announce(victim, "10.0.0.1", 6881, downloader.EventStopped)
+	resp = announce([20]byte{'o'}, "10.0.0.2", 6881, downloader.EventNone)
+	for _, p := range resp.Peers {
+		if p.IP.Equal(net.ParseIP("10.0.0.1")) {
+			t.Fatalf("stopped peer still returned: %v", resp.Peers)
+		}
+	}
+}
+
+func TestStoreCountsCompletedOnce(t *testing.T) {
+	store := NewStore(Config{})
+	hash := [20]byte{2}
+	announce := func(id byte, port uint16, left int64, event string) {
+		t.Helper()
+		_, err := store.Announce(&AnnounceRequest{
+			InfoHash: hash,
+			PeerID:   [20]byte{id},
+			IP:       net.ParseIP("10.0.0.1").To4(),
+			Port:     port,
+			Left:     left,
+			Event:    event,
+			NumWant:  -1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	downloaded := func() int {
+		return store.Scrape([][20]byte{hash})[hash].Downloaded
+	}
+
+	announce('a', 1, 100, downloader.EventStarted)
+	announce('a', 1, 0, downloader.EventCompleted)
+	if n := downloaded(); n != 1 {
+		t.Fatalf("downloaded = %d after completed, want 1", n)
+	}
+	//重复发送 completed，例如重试的请求
+	announce('a', 1, 0, downloader.EventCompleted)
+	if n := downloaded(); n != 1 {
+		t.Fatalf("downloaded = %d after repeated completed, want 1", n)
+	}
+	//仍然报告剩余数据的 completed 不计入
+	announce('b', 2, 50, downloader.EventCompleted)
+	if n := downloaded(); n != 1 {
+		t.Fatalf("downloaded = %d after completed with data left, want 1", n)
+	}
+	//之前没有记录的peer直接汇报完成
+	announce('c', 3, 0, downloader.EventCompleted)
+	if n := downloaded(); n != 2 {
+		t.Fatalf("downloaded = %d, want 2", n)
+	}
+}
@@ -0,0 +1,215 @@
+package tracker
+
+import (
+	"bitDownloader/downloader"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+//UDP tracker (BEP 15)：connect 获取connection id 之后才能 announce 以及 scrape
+//connection id 为客户端地址以及时间窗口的HMAC，不需要保存状态，在1到2个时间窗口内有效
+
+const (
+	udpProtocolID     = 0x41727101980
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	connIDWindow    = time.Minute //connection id 的时间窗口，客户端应该在两分钟内使用
+	maxScrapeHashes = 74          //一个scrape请求最多的infohash数量
+	maxUDPPacket    = 2048
+)
+
+// UDPServer UDP tracker，与HTTP tracker可以共享同一个 Store
+type UDPServer struct {
+	Store *Store
+
+	conn   net.PacketConn
+	secret []byte //生成connection id的HMAC密钥，每次启动随机生成
+}
+
+// NewUDPServer 创建在 conn 上提供服务的UDP tracker，调用 Serve 开始处理请求
+func NewUDPServer(store *Store, conn net.PacketConn) (*UDPServer, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &UDPServer{Store: store, conn: conn, secret: secret}, nil
+}
+
+// Serve 处理请求直到 conn 被关闭
+func (s *UDPServer) Serve() error {
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || n < 16 {
+			continue
+		}
+		if resp := s.handle(buf[:n], udpAddr); resp != nil {
+			if _, err := s.conn.WriteTo(resp, addr); err != nil {
+				log.Printf("Could not reply to %s: %v\n", addr, err)
+			}
+		}
+	}
+}
+
+// Close 关闭连接，Serve 随后返回
+func (s *UDPServer) Close() error {
+	return s.conn.Close()
+}
+
+//处理一个请求，返回回复，不需要回复时返回nil
+func (s *UDPServer) handle(req []byte, addr *net.UDPAddr) []byte {
+	ip := addr.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	action := binary.BigEndian.Uint32(req[8:12])
+	tid := binary.BigEndian.Uint32(req[12:16])
+	if action == udpActionConnect {
+		if binary.BigEndian.Uint64(req[0:8]) != udpProtocolID {
+			return nil
+		}
+		resp := make([]byte, 16)
+		binary.BigEndian.PutUint32(resp[0:4], udpActionConnect)
+		binary.BigEndian.PutUint32(resp[4:8], tid)
+		binary.BigEndian.PutUint64(resp[8:16], s.connID(ip, time.Now()))
+		return resp
+	}
+	if !s.validConnID(binary.BigEndian.Uint64(req[0:8]), ip, time.Now()) {
+		return udpError(tid, "Invalid connection ID")
+	}
+	switch action {
+	case udpActionAnnounce:
+		return s.announce(req, tid, ip)
+	case udpActionScrape:
+		return s.scrape(req, tid)
+	}
+	return udpError(tid, "Unknown action")
+}
+
+//客户端地址以及时间窗口的HMAC，取前8字节
+func (s *UDPServer) connID(ip net.IP, now time.Time) uint64 {
+	mac := hmac.New(sha256.New, s.secret)
+	var window [8]byte
+	binary.BigEndian.PutUint64(window[:], uint64(now.Unix()/int64(connIDWindow/time.Second)))
+	mac.Write(window[:])
+	mac.Write(ip.To16())
+	return binary.BigEndian.Uint64(mac.Sum(nil)[:8])
+}
+
+//接受当前以及上一个时间窗口的connection id
+func (s *UDPServer) validConnID(id uint64, ip net.IP, now time.Time) bool {
+	for _, t := range []time.Time{now, now.Add(-connIDWindow)} {
+		var a, b [8]byte
+		binary.BigEndian.PutUint64(a[:], id)
+		binary.BigEndian.PutUint64(b[:], s.connID(ip, t))
+		if hmac.Equal(a[:], b[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+//announce请求为98字节，请求中的IP地址被忽略，总是使用来源地址
+func (s *UDPServer) announce(req []byte, tid uint32, ip net.IP) []byte {
+	if len(req) < 98 {
+		return udpError(tid, "Malformed announce request")
+	}
+	ar := &AnnounceRequest{
+		IP:         ip,
+		Downloaded: int64(binary.BigEndian.Uint64(req[56:64])),
+		Left:       int64(binary.BigEndian.Uint64(req[64:72])),
+		Uploaded:   int64(binary.BigEndian.Uint64(req[72:80])),
+		NumWant:    int(int32(binary.BigEndian.Uint32(req[92:96]))),
+		Port:       binary.BigEndian.Uint16(req[96:98]),
+	}
+	copy(ar.InfoHash[:], req[16:36])
+	copy(ar.PeerID[:], req[36:56])
+	switch binary.BigEndian.Uint32(req[80:84]) {
+	case 0:
+		ar.Event = downloader.EventNone
+	case 1:
+		ar.Event = downloader.EventCompleted
+	case 2:
+		ar.Event = downloader.EventStarted
+	case 3:
+		ar.Event = downloader.EventStopped
+	default:
+		return udpError(tid, "Invalid event")
+	}
+	if ar.Port == 0 {
+		return udpError(tid, "Invalid port 0")
+	}
+	if ar.Left < 0 || ar.Downloaded < 0 || ar.Uploaded < 0 {
+		return udpError(tid, "Invalid transfer statistics")
+	}
+	resp, err := s.Store.Announce(ar)
+	if err != nil {
+		return udpError(tid, err.Error())
+	}
+
+	out := make([]byte, 20, 20+len(resp.Peers)*18)
+	binary.BigEndian.PutUint32(out[0:4], udpActionAnnounce)
+	binary.BigEndian.PutUint32(out[4:8], tid)
+	binary.BigEndian.PutUint32(out[8:12], uint32(resp.Interval/time.Second))
+	binary.BigEndian.PutUint32(out[12:16], uint32(resp.Incomplete))
+	binary.BigEndian.PutUint32(out[16:20], uint32(resp.Complete))
+	//只返回与请求相同地址族的peers，IPv6请求的peers为18字节
+	v4 := ip.To4() != nil
+	for _, p := range resp.Peers {
+		if p4 := p.IP.To4(); v4 && p4 != nil {
+			out = appendCompact(out, p4, p.Port)
+		} else if !v4 && p4 == nil {
+			out = appendCompact(out, p.IP.To16(), p.Port)
+		}
+	}
+	return out
+}
+
+//scrape请求在头部之后为若干个infohash，回复中每个种子依次为 seeders、completed、leechers
+func (s *UDPServer) scrape(req []byte, tid uint32) []byte {
+	body := req[16:]
+	if len(body) == 0 || len(body)%20 != 0 || len(body)/20 > maxScrapeHashes {
+		return udpError(tid, "Malformed scrape request")
+	}
+	hashes := make([][20]byte, len(body)/20)
+	for i := range hashes {
+		copy(hashes[i][:], body[i*20:(i+1)*20])
+	}
+	stats := s.Store.Scrape(hashes)
+	out := make([]byte, 8, 8+len(hashes)*12)
+	binary.BigEndian.PutUint32(out[0:4], udpActionScrape)
+	binary.BigEndian.PutUint32(out[4:8], tid)
+	for _, h := range hashes {
+		//不在白名单中的种子统计为零
+		st := stats[h]
+		var entry [12]byte
+		binary.BigEndian.PutUint32(entry[0:4], uint32(st.Complete))
+		binary.BigEndian.PutUint32(entry[4:8], uint32(st.Downloaded))
+		binary.BigEndian.PutUint32(entry[8:12], uint32(st.Incomplete))
+		out = append(out, entry[:]...)
+	}
+	return out
+}
+
+func udpError(tid uint32, msg string) []byte {
+	out := make([]byte, 8, 8+len(msg))
+	binary.BigEndian.PutUint32(out[0:4], udpActionError)
+	binary.BigEndian.PutUint32(out[4:8], tid)
+	return append(out, msg...)
+}
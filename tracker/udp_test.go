@@ -0,0 +1,69 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnIDExpiry(t *testing.T) {
+	s := &UDPServer{Store: NewStore(Config{}), secret: []byte("secret")}
+	ip := net.ParseIP("10.0.0.1").To4()
+	//时间窗口的开始
+	issued := time.Unix(1000*int64(connIDWindow/time.Second), 0)
+	id := s.connID(ip, issued)
+
+	tests := []struct {
+		after time.Duration
+		valid bool
+	}{
+		{0, true},
+		{connIDWindow - time.Second, true},
+		{connIDWindow, true},
+		{2*connIDWindow - time.Second, true},
+		{2 * connIDWindow, false},
+		{time.Hour, false},
+		{-time.Second, false},
+	}
+	for _, tt := range tests {
+		if got := s.validConnID(id, ip, issued.Add(tt.after)); got != tt.valid {
+			t.Errorf("connection id %v after issue: valid = %v, want %v", tt.after, got, tt.valid)
+		}
+	}
+
+	if s.validConnID(id, net.ParseIP("10.0.0.2").To4(), issued) {
+		t.Error("connection id accepted from another address")
+	}
+	other := &UDPServer{secret: []byte("other")}
+	if other.validConnID(id, ip, issued) {
+		t.Error("connection id accepted with another secret")
+	}
+}
+
+func TestUDPRejectsUnknownConnID(t *testing.T) {
+	s := &UDPServer{Store: NewStore(Config{}), secret: []byte("secret")}
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881}
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+	binary.BigEndian.PutUint32(req[12:16], 77)
+	resp := s.handle(req, addr)
+	if len(resp) != 16 || binary.BigEndian.Uint32(resp[0:4]) != udpActionConnect || binary.BigEndian.Uint32(resp[4:8]) != 77 {
+		t.Fatalf("connect response %x", resp)
+	}
+	id := binary.BigEndian.Uint64(resp[8:16])
+
+	scrape := make([]byte, 36)
+	binary.BigEndian.PutUint64(scrape[0:8], id)
+	binary.BigEndian.PutUint32(scrape[8:12], udpActionScrape)
+	binary.BigEndian.PutUint32(scrape[12:16], 78)
+	if resp := s.handle(scrape, addr); binary.BigEndian.Uint32(resp[0:4]) != udpActionScrape {
+		t.Fatalf("scrape with valid connection id: %q", resp)
+	}
+	binary.BigEndian.PutUint64(scrape[0:8], id+1)
+	if resp := s.handle(scrape, addr); binary.BigEndian.Uint32(resp[0:4]) != udpActionError {
+		t.Fatalf("scrape with invalid connection id: %q", resp)
+	}
+}
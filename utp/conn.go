@@ -0,0 +1,629 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+//uTP连接：可靠有序的字节流，实现 net.Conn
+//拥塞控制使用LEDBAT，根据单向延迟调整发送窗口，使连接让出带宽给其他流量
+
+const (
+	maxPayload       = 1380                   //每个数据包的最大负载，避免IP分片
+	minWindow        = maxPayload             //发送窗口的下限
+	initialWindow    = 4 * maxPayload         //连接建立时的发送窗口
+	maxWindow        = 1 << 20                //发送窗口的上限
+	recvBufferSize   = 1 << 20                //接收缓冲区大小，决定通告给对方的窗口
+	maxOutOfOrder    = 1024                   //最多缓存的乱序数据包数量
+	targetDelay      = 100 * time.Millisecond //LEDBAT的目标排队延迟
+	maxCwndIncrease  = 3000                   //每个RTT发送窗口最多增加的字节数
+	initialRTO       = time.Second            //尚未测得RTT时的重传超时
+	minRTO           = 500 * time.Millisecond //重传超时的下限
+	maxRTO           = 16 * time.Second       //超时退避的上限
+	maxTransmissions = 6                      //同一个数据包发送达到该次数仍未确认时断开
+	closeTimeout     = 10 * time.Second       //Close 之后等待FIN被确认的最长时间
+	tickInterval     = 50 * time.Millisecond  //检查重传的间隔
+	dupAckThreshold  = 3                      //收到该数量的重复确认时快速重传
+)
+
+var (
+	errReset   = errors.New("uTP connection reset by peer")
+	errTimeout = errors.New("uTP connection timed out")
+)
+
+type connState int
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+	stateClosed
+)
+
+//已发送但尚未确认的数据包
+type outPacket struct {
+	typ           byte
+	seq           uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	acked         bool //已经由selective ack确认
+}
+
+//乱序到达的数据包
+type recvPacket struct {
+	payload []byte
+	fin     bool
+}
+
+// Conn 一个uTP连接，由 Socket.Dial 或 Socket.Accept 创建
+type Conn struct {
+	s      *Socket
+	raddr  *net.UDPAddr
+	recvID uint16 //对方发来的数据包中的 connection id
+	sendID uint16 //我们发出的数据包中的 connection id
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	state     connState
+	err       error //连接被重置或超时
+	closing   bool  //已经调用 Close
+	closeBy   time.Time
+	connected chan struct{}
+	done      chan struct{} //连接从 Socket 中移除时关闭
+
+	//发送
+	seq        uint16 //下一个数据包的序号
+	unacked    []*outPacket
+	inflight   int //未确认的负载字节数
+	window     int //LEDBAT计算的发送窗口
+	peerWindow int //对方通告的接收窗口
+	lastAck    uint16
+	dupAcks    int
+	lastCut    time.Time //最近一次因为丢包减小窗口的时间
+	rtt        time.Duration
+	rttVar     time.Duration
+	rto        time.Duration
+	delays     delayHistory
+
+	//接收
+	ack        uint16 //按顺序收到的最后一个数据包的序号
+	replyMicro uint32 //对方最近一个数据包的单向延迟，回显给对方
+	readBuf    []byte
+	ooo        map[uint16]recvPacket
+	oooBytes   int
+	gotFin     bool
+	finSeq     uint16
+	eof        bool //已经收到FIN以及之前的全部数据
+	lastWnd    int  //最近一次通告的接收窗口
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(s *Socket, raddr *net.UDPAddr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		s:          s,
+		raddr:      raddr,
+		recvID:     recvID,
+		sendID:     sendID,
+		connected:  make(chan struct{}),
+		done:       make(chan struct{}),
+		window:     initialWindow,
+		peerWindow: recvBufferSize,
+		rto:        initialRTO,
+		ooo:        make(map[uint16]recvPacket),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+//持有锁时调用，发送一个数据包
+func (c *Conn) sendPacket(typ byte, seq uint16, payload []byte) {
+	id := c.sendID
+	if typ == stSyn {
+		//SYN 携带的是我们的接收id，对方据此计算双方的id
+		id = c.recvID
+	}
+	c.lastWnd = c.recvWindow()
+	h := header{
+		typ:           typ,
+		connID:        id,
+		timestamp:     nowMicro(),
+		timestampDiff: c.replyMicro,
+		wnd:           uint32(c.lastWnd),
+		seq:           seq,
+		ack:           c.ack,
+		sack:          c.sackMask(),
+	}
+	c.s.pc.WriteTo(h.marshal(payload), c.raddr)
+}
+
+//发送或重传需要确认的数据包
+func (c *Conn) transmit(p *outPacket, now time.Time) {
+	p.sentAt = now
+	p.transmissions++
+	c.sendPacket(p.typ, p.seq, p.payload)
+}
+
+//加入发送队列并立即发送
+func (c *Conn) queue(typ byte, payload []byte) {
+	p := &outPacket{typ: typ, seq: c.seq, payload: payload}
+	c.seq++
+	c.unacked = append(c.unacked, p)
+	c.inflight += len(payload)
+	c.transmit(p, time.Now())
+}
+
+//确认收到的数据
+func (c *Conn) sendState() {
+	c.sendPacket(stState, c.seq, nil)
+}
+
+//接收窗口的剩余空间
+func (c *Conn) recvWindow() int {
+	wnd := recvBufferSize - len(c.readBuf) - c.oooBytes
+	if wnd < 0 {
+		return 0
+	}
+	return wnd
+}
+
+//乱序收到的数据包的位图，第一个字节的最低位表示 ack+2
+func (c *Conn) sackMask() []byte {
+	if len(c.ooo) == 0 {
+		return nil
+	}
+	last := 0
+	for seq := range c.ooo {
+		if off := int(seq - c.ack - 2); off > last {
+			last = off
+		}
+	}
+	mask := make([]byte, (last/32+1)*4)
+	for seq := range c.ooo {
+		off := int(seq - c.ack - 2)
+		mask[off/8] |= 1 << uint(off%8)
+	}
+	return mask
+}
+
+//处理收到的数据包，由 Socket 的读取循环调用
+func (c *Conn) handle(h header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	now := time.Now()
+	c.replyMicro = nowMicro() - h.timestamp
+	c.peerWindow = int(h.wnd)
+
+	switch h.typ {
+	case stReset:
+		c.fail(errReset)
+		return
+	case stSyn:
+		//我们对SYN的确认丢失，对方重传了SYN
+		c.sendState()
+		return
+	}
+	if c.state == stateSynSent {
+		if h.typ != stState || len(c.unacked) == 0 || h.ack != c.unacked[0].seq {
+			return
+		}
+		//对方的第一个数据包将使用该序号
+		c.ack = h.seq - 1
+		c.state = stateConnected
+		close(c.connected)
+	}
+
+	c.processAck(h, now)
+	if h.typ == stData || h.typ == stFin {
+		c.receive(h, payload)
+		c.sendState()
+	}
+	if c.closing && len(c.unacked) == 0 {
+		//FIN 已经被确认
+		c.teardown()
+	}
+	c.cond.Broadcast()
+}
+
+//处理确认，移除已确认的数据包并调整发送窗口
+func (c *Conn) processAck(h header, now time.Time) {
+	acked, progress := 0, false
+	for len(c.unacked) > 0 && !seqLess(h.ack, c.unacked[0].seq) {
+		p := c.unacked[0]
+		c.unacked[0] = nil
+		c.unacked = c.unacked[1:]
+		progress = true
+		if !p.acked {
+			acked += len(p.payload)
+			c.sample(p, now)
+		}
+	}
+
+	//selective ack 确认的数据包
+	for i := 0; i < len(h.sack)*8; i++ {
+		if h.sack[i/8]&(1<<uint(i%8)) == 0 {
+			continue
+		}
+		seq := h.ack + 2 + uint16(i)
+		for _, p := range c.unacked {
+			if p.seq == seq {
+				if !p.acked {
+					p.acked = true
+					progress = true
+					acked += len(p.payload)
+					c.sample(p, now)
+				}
+				break
+			}
+		}
+	}
+
+	if acked > 0 {
+		c.inflight -= acked
+		c.grow(acked, h.timestampDiff, now)
+	}
+	if progress {
+		c.dupAcks = 0
+	} else if h.typ == stState && h.ack == c.lastAck && len(c.unacked) > 0 {
+		c.dupAcks++
+	}
+	c.lastAck = h.ack
+
+	//之后已经有足够多的数据包到达，或者收到足够多的重复确认时，认为数据包已经丢失并立即重传
+	lost := false
+	after := 0
+	for i := len(c.unacked) - 1; i >= 0; i-- {
+		p := c.unacked[i]
+		if p.acked {
+			after++
+			continue
+		}
+		dup := i == 0 && c.dupAcks >= dupAckThreshold
+		if (after >= dupAckThreshold || dup) && now.Sub(p.sentAt) > c.rtt {
+			c.transmit(p, now)
+			lost = true
+		}
+	}
+	if lost {
+		c.dupAcks = 0
+		//每个RTT最多减小一次窗口
+		if now.Sub(c.lastCut) > c.rtt {
+			c.lastCut = now
+			c.window /= 2
+			if c.window < minWindow {
+				c.window = minWindow
+			}
+		}
+	}
+}
+
+//根据只发送过一次的数据包更新RTT估计
+func (c *Conn) sample(p *outPacket, now time.Time) {
+	if p.transmissions != 1 {
+		return
+	}
+	rtt := now.Sub(p.sentAt)
+	if c.rtt == 0 {
+		c.rtt, c.rttVar = rtt, rtt/2
+	} else {
+		delta := c.rtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (rtt - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+}
+
+//LEDBAT：排队延迟低于目标时增大发送窗口，高于目标时减小
+func (c *Conn) grow(acked int, diff uint32, now time.Time) {
+	var delay time.Duration
+	if diff != 0 {
+		c.delays.add(diff, now)
+		delay = time.Duration(diff-c.delays.base()) * time.Microsecond
+	}
+	offTarget := float64(targetDelay-delay) / float64(targetDelay)
+	small, large := acked, c.window
+	if small > large {
+		small, large = large, small
+	}
+	c.window += int(maxCwndIncrease * offTarget * float64(small) / float64(large))
+	if c.window < minWindow {
+		c.window = minWindow
+	}
+	if c.window > maxWindow {
+		c.window = maxWindow
+	}
+}
+
+//接收数据包，按顺序的数据放入读取缓冲区，乱序的暂存
+func (c *Conn) receive(h header, payload []byte) {
+	if c.gotFin && seqLess(c.finSeq, h.seq) {
+		return
+	}
+	if !seqLess(c.ack, h.seq) {
+		//重复的数据包
+		return
+	}
+	if h.typ == stFin {
+		c.gotFin = true
+		c.finSeq = h.seq
+	}
+	if h.seq != c.ack+1 {
+		_, dup := c.ooo[h.seq]
+		if !dup && int(h.seq-c.ack) < maxOutOfOrder && len(payload) <= c.recvWindow() {
+			c.ooo[h.seq] = recvPacket{payload: payload, fin: h.typ == stFin}
+			c.oooBytes += len(payload)
+		}
+		return
+	}
+	if len(payload) > c.recvWindow() {
+		return
+	}
+	c.readBuf = append(c.readBuf, payload...)
+	c.ack = h.seq
+	for {
+		p, ok := c.ooo[c.ack+1]
+		if !ok {
+			break
+		}
+		delete(c.ooo, c.ack+1)
+		c.oooBytes -= len(p.payload)
+		c.readBuf = append(c.readBuf, p.payload...)
+		c.ack++
+	}
+	if c.gotFin && c.ack == c.finSeq {
+		c.eof = true
+	}
+}
+
+//定期检查超时重传以及关闭
+func (c *Conn) loop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			c.tick(now)
+		}
+	}
+}
+
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	if c.closing && now.After(c.closeBy) {
+		c.teardown()
+		return
+	}
+	var first *outPacket
+	for _, p := range c.unacked {
+		if !p.acked {
+			first = p
+			break
+		}
+	}
+	if first == nil || now.Sub(first.sentAt) < c.rto {
+		return
+	}
+	if first.transmissions >= maxTransmissions {
+		c.fail(errTimeout)
+		return
+	}
+	//超时说明网络拥塞，窗口降到最小并退避
+	c.window = minWindow
+	c.rto *= 2
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+	c.transmit(first, now)
+}
+
+//持有锁时调用，连接出错
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.teardown()
+}
+
+//持有锁时调用，从 Socket 中移除连接并唤醒等待的读写
+func (c *Conn) teardown() {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	close(c.done)
+	c.s.remove(c)
+	c.cond.Broadcast()
+}
+
+//持有锁时调用，等待状态变化或者期限到达
+func (c *Conn) wait(deadline time.Time) {
+	if !deadline.IsZero() {
+		t := time.AfterFunc(time.Until(deadline), func() {
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+		defer t.Stop()
+	}
+	c.cond.Wait()
+}
+
+//读写前检查连接状态
+func (c *Conn) check(deadline time.Time) error {
+	switch {
+	case c.closing:
+		return net.ErrClosed
+	case c.err != nil:
+		return c.err
+	case c.state == stateClosed:
+		return net.ErrClosed
+	case !deadline.IsZero() && !time.Now().Before(deadline):
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// Read 读取按顺序到达的数据，对方关闭连接并且数据读完时返回 io.EOF
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.readBuf) == 0 {
+		if c.eof && !c.closing {
+			return 0, io.EOF
+		}
+		if err := c.check(c.readDeadline); err != nil {
+			return 0, err
+		}
+		c.wait(c.readDeadline)
+	}
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	if len(c.readBuf) == 0 {
+		c.readBuf = nil
+	}
+	//之前通告的窗口已经不足一个数据包时通知对方窗口恢复
+	if c.state == stateConnected && c.lastWnd < maxPayload && c.recvWindow() >= maxPayload {
+		c.sendState()
+	}
+	return n, nil
+}
+
+// Write 按照发送窗口分成数据包发送，窗口已满时等待确认
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		for !c.canSend(n) {
+			if err := c.check(c.writeDeadline); err != nil {
+				return written, err
+			}
+			c.wait(c.writeDeadline)
+		}
+		if err := c.check(c.writeDeadline); err != nil {
+			return written, err
+		}
+		payload := make([]byte, n)
+		copy(payload, b)
+		c.queue(stData, payload)
+		b = b[n:]
+		written += n
+	}
+	return written, nil
+}
+
+//发送窗口是否允许再发送 n 字节，没有未确认的数据时总是允许发送一个数据包
+func (c *Conn) canSend(n int) bool {
+	if c.state != stateConnected {
+		return false
+	}
+	if c.inflight == 0 {
+		return true
+	}
+	limit := c.window
+	if c.peerWindow < limit {
+		limit = c.peerWindow
+	}
+	return c.inflight+n <= limit
+}
+
+// Close 发送FIN并在后台等待确认，之后的读写返回 net.ErrClosed
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return nil
+	}
+	c.closing = true
+	if c.state == stateConnected && c.err == nil {
+		c.closeBy = time.Now().Add(closeTimeout)
+		c.queue(stFin, nil)
+	} else {
+		c.teardown()
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+// LocalAddr 本地UDP地址
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.pc.LocalAddr()
+}
+
+// RemoteAddr 对方的UDP地址，类型为 *net.UDPAddr
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	return nil
+}
+
+//最近两分钟内的最小单向延迟作为基础延迟，超出部分视为排队延迟
+type delayHistory struct {
+	cur, prev       uint32
+	hasCur, hasPrev bool
+	started         time.Time
+}
+
+func (d *delayHistory) add(sample uint32, now time.Time) {
+	if now.Sub(d.started) > time.Minute {
+		d.prev, d.hasPrev = d.cur, d.hasCur
+		d.hasCur = false
+		d.started = now
+	}
+	if !d.hasCur || int32(sample-d.cur) < 0 {
+		d.cur, d.hasCur = sample, true
+	}
+}
+
+func (d *delayHistory) base() uint32 {
+	if d.hasPrev && int32(d.prev-d.cur) < 0 {
+		return d.prev
+	}
+	return d.cur
+}
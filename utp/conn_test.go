@@ -0,0 +1,294 @@
+package utp
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//记录发出的数据包，ReadFrom 阻塞到关闭为止
+type recordConn struct {
+	mu      sync.Mutex
+	sent    []header
+	closed  chan struct{}
+	closeMu sync.Once
+}
+
+func newRecordConn() *recordConn {
+	return &recordConn{closed: make(chan struct{})}
+}
+
+func (r *recordConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	<-r.closed
+	return 0, nil, net.ErrClosed
+}
+
+func (r *recordConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	h, _, err := parsePacket(b)
+	if err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	r.sent = append(r.sent, h)
+	r.mu.Unlock()
+	return len(b), nil
+}
+
+func (r *recordConn) Close() error {
+	r.closeMu.Do(func() { close(r.closed) })
+	return nil
+}
+
+func (r *recordConn) LocalAddr() net.Addr                { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1} }
+func (r *recordConn) SetDeadline(t time.Time) error      { return nil }
+func (r *recordConn) SetReadDeadline(t time.Time) error  { return nil }
+func (r *recordConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (r *recordConn) packets() []header {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]header(nil), r.sent...)
+}
+
+//已经建立的连接，不运行重传循环，由测试直接调用内部方法
+func testConn(t *testing.T) (*Conn, *recordConn) {
+	pc := newRecordConn()
+	s := NewSocket(pc)
+	t.Cleanup(func() { s.Close() })
+	c := newConn(s, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 2}, 10, 11)
+	c.state = stateConnected
+	close(c.connected)
+	return c, pc
+}
+
+func TestReceiveReordering(t *testing.T) {
+	tests := []struct {
+		name string
+		ack  uint16
+		seqs []uint16
+	}{
+		{"in order", 100, []uint16{101, 102, 103, 104}},
+		{"reversed", 100, []uint16{104, 103, 102, 101}},
+		{"duplicates", 100, []uint16{102, 102, 101, 101, 103, 104, 103}},
+		{"wraparound", 65533, []uint16{65535, 1, 65534, 0, 2}},
+	}
+	for _, tt := range tests {
+		c, _ := testConn(t)
+		c.ack = tt.ack
+		var want []byte
+		for i := uint16(1); i <= uint16(len(uniq(tt.seqs))); i++ {
+			want = append(want, byte(tt.ack+i))
+		}
+		for _, seq := range tt.seqs {
+			c.receive(header{typ: stData, seq: seq}, []byte{byte(seq)})
+		}
+		if !bytes.Equal(c.readBuf, want) {
+			t.Errorf("%s: read %v, want %v", tt.name, c.readBuf, want)
+		}
+		if len(c.ooo) != 0 || c.oooBytes != 0 {
+			t.Errorf("%s: %d packets left out of order", tt.name, len(c.ooo))
+		}
+		if c.ack != tt.ack+uint16(len(want)) {
+			t.Errorf("%s: ack = %d", tt.name, c.ack)
+		}
+	}
+}
+
+func uniq(seqs []uint16) map[uint16]bool {
+	m := make(map[uint16]bool)
+	for _, s := range seqs {
+		m[s] = true
+	}
+	return m
+}
+
+func TestReceiveFin(t *testing.T) {
+	c, _ := testConn(t)
+	c.ack = 65534
+	//FIN 先于之前的数据到达，之后的数据被忽略
+	c.receive(header{typ: stFin, seq: 1}, nil)
+	c.receive(header{typ: stData, seq: 2}, []byte("late"))
+	if c.eof {
+		t.Fatal("eof before data arrived")
+	}
+	c.receive(header{typ: stData, seq: 0}, []byte("b"))
+	c.receive(header{typ: stData, seq: 65535}, []byte("a"))
+	if !c.eof || string(c.readBuf) != "ab" {
+		t.Fatalf("eof = %v, read %q", c.eof, c.readBuf)
+	}
+}
+
+func TestSackMask(t *testing.T) {
+	c, _ := testConn(t)
+	if c.sackMask() != nil {
+		t.Fatal("sack mask without out of order packets")
+	}
+	c.ack = 65534
+	//偏移为 seq-ack-2：0 -> 0, 5 -> 5, 38 -> 38
+	for _, seq := range []uint16{0, 5, 38} {
+		c.ooo[seq] = recvPacket{}
+	}
+	want := []byte{0x21, 0, 0, 0, 0x40, 0, 0, 0}
+	if got := c.sackMask(); !bytes.Equal(got, want) {
+		t.Errorf("sackMask = %x, want %x", got, want)
+	}
+}
+
+func TestProcessAckSelective(t *testing.T) {
+	c, pc := testConn(t)
+	c.seq = 65534
+	for i := 0; i < 6; i++ {
+		c.queue(stData, make([]byte, 100))
+	}
+	//序号 65534 65535 0 1 2 3
+	old := time.Now().Add(-time.Second)
+	for _, p := range c.unacked {
+		p.sentAt = old
+	}
+	c.rtt = 100 * time.Millisecond
+	window := c.window
+	sent := len(pc.packets())
+
+	//累计确认到 65534，selective ack 确认 1 2 3：偏移 1 2 3
+	c.processAck(header{typ: stState, ack: 65534, sack: []byte{0x0e, 0, 0, 0}}, time.Now())
+	if len(c.unacked) != 5 || c.unacked[0].seq != 65535 {
+		t.Fatalf("unacked starts at %d, %d packets", c.unacked[0].seq, len(c.unacked))
+	}
+	if c.inflight != 200 || !c.unacked[2].acked || c.unacked[1].acked {
+		t.Fatalf("inflight = %d", c.inflight)
+	}
+	//后面已经有3个数据包到达，65535 以及 0 被认为丢失并重传
+	resent := pc.packets()[sent:]
+	if len(resent) != 2 || resent[0].seq != 0 || resent[1].seq != 65535 {
+		t.Fatalf("retransmitted %+v", resent)
+	}
+	if c.window >= window {
+		t.Errorf("window = %d, was %d before loss", c.window, window)
+	}
+
+	//累计确认越过回绕，已经由sack确认的数据包不再计入
+	c.processAck(header{typ: stState, ack: 3}, time.Now())
+	if len(c.unacked) != 0 || c.inflight != 0 {
+		t.Errorf("%d packets unacked, inflight %d", len(c.unacked), c.inflight)
+	}
+}
+
+func TestDuplicateAcks(t *testing.T) {
+	c, pc := testConn(t)
+	c.seq = 20
+	c.queue(stData, make([]byte, 100))
+	c.queue(stData, make([]byte, 100))
+	c.unacked[0].sentAt = time.Now().Add(-time.Second)
+	c.rtt = 100 * time.Millisecond
+	c.lastAck = 19
+	sent := len(pc.packets())
+	for i := 0; i < dupAckThreshold; i++ {
+		c.processAck(header{typ: stState, ack: 19}, time.Now())
+	}
+	resent := pc.packets()[sent:]
+	if len(resent) != 1 || resent[0].seq != 20 || c.unacked[0].transmissions != 2 {
+		t.Fatalf("retransmitted %+v after %d duplicate acks", resent, dupAckThreshold)
+	}
+}
+
+func TestLEDBAT(t *testing.T) {
+	c, _ := testConn(t)
+	now := time.Now()
+	c.window = 10000
+
+	//没有排队延迟时按照 maxCwndIncrease*acked/window 增大
+	c.grow(1000, 5000, now)
+	if c.window != 10300 {
+		t.Fatalf("window = %d, want 10300", c.window)
+	}
+	//排队延迟为目标的两倍时以同样的速度减小
+	c.window = 10000
+	c.grow(1000, 5000+uint32(2*targetDelay/time.Microsecond), now)
+	if c.window != 9700 {
+		t.Fatalf("window = %d, want 9700", c.window)
+	}
+	//上下限
+	c.window = minWindow
+	c.grow(maxPayload, 5000+uint32(10*targetDelay/time.Microsecond), now)
+	if c.window != minWindow {
+		t.Errorf("window = %d, want minWindow", c.window)
+	}
+	c.window = maxWindow
+	c.grow(maxWindow, 5000, now)
+	if c.window != maxWindow {
+		t.Errorf("window = %d, want maxWindow", c.window)
+	}
+
+	//基础延迟为最近两个时间段的最小值
+	var d delayHistory
+	d.add(500, now)
+	d.add(300, now.Add(time.Second))
+	d.add(400, now.Add(2*time.Second))
+	if d.base() != 300 {
+		t.Errorf("base = %d, want 300", d.base())
+	}
+	d.add(900, now.Add(2*time.Minute))
+	if d.base() != 300 {
+		t.Errorf("base after rollover = %d, want 300", d.base())
+	}
+	d.add(800, now.Add(4*time.Minute))
+	if d.base() != 800 {
+		t.Errorf("base after two rollovers = %d, want 800", d.base())
+	}
+}
+
+func TestRTTSample(t *testing.T) {
+	c, _ := testConn(t)
+	now := time.Now()
+	c.sample(&outPacket{sentAt: now.Add(-200 * time.Millisecond), transmissions: 1}, now)
+	if c.rtt != 200*time.Millisecond || c.rto != 600*time.Millisecond {
+		t.Fatalf("rtt = %v, rto = %v", c.rtt, c.rto)
+	}
+	//重传过的数据包不能用于估计RTT
+	c.sample(&outPacket{sentAt: now.Add(-5 * time.Second), transmissions: 2}, now)
+	if c.rtt != 200*time.Millisecond {
+		t.Fatalf("rtt = %v after retransmitted sample", c.rtt)
+	}
+	c2, _ := testConn(t)
+	c2.sample(&outPacket{sentAt: now.Add(-10 * time.Millisecond), transmissions: 1}, now)
+	if c2.rto != minRTO {
+		t.Errorf("rto = %v, want minRTO", c2.rto)
+	}
+}
+
+func TestTickTimeout(t *testing.T) {
+	c, pc := testConn(t)
+	c.queue(stData, []byte("x"))
+	now := time.Now()
+	for i := 1; i < maxTransmissions; i++ {
+		rto := c.rto
+		now = now.Add(rto)
+		c.tick(now)
+		if c.unacked[0].transmissions != i+1 || c.window != minWindow {
+			t.Fatalf("after timeout %d: transmissions %d, window %d", i, c.unacked[0].transmissions, c.window)
+		}
+		if want := 2 * rto; want <= maxRTO && c.rto != want {
+			t.Fatalf("rto = %v, want %v", c.rto, want)
+		}
+	}
+	c.tick(now.Add(maxRTO))
+	if c.err != errTimeout || c.state != stateClosed {
+		t.Fatalf("err = %v, state = %d", c.err, c.state)
+	}
+	if n := len(pc.packets()); n != maxTransmissions {
+		t.Errorf("sent %d packets, want %d", n, maxTransmissions)
+	}
+}
+
+func TestHandleReset(t *testing.T) {
+	c, _ := testConn(t)
+	c.handle(header{typ: stReset}, nil)
+	if _, err := c.Read(make([]byte, 1)); err != errReset {
+		t.Errorf("Read after reset = %v", err)
+	}
+	if _, err := c.Write([]byte("x")); err != errReset {
+		t.Errorf("Write after reset = %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+//uTP (BEP 29) 数据包格式
+
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+
+	version    = 1
+	headerSize = 20
+
+	extSelectiveAck = 1
+)
+
+var errNotUTP = errors.New("Not a uTP packet")
+
+//数据包头部
+type header struct {
+	typ           byte
+	connID        uint16
+	timestamp     uint32 //发送时间，微秒
+	timestampDiff uint32 //对方最近一个数据包的单向延迟，微秒
+	wnd           uint32 //接收窗口剩余字节数
+	seq           uint16
+	ack           uint16
+	sack          []byte //selective ack扩展的位图，没有该扩展时为空
+}
+
+//编码头部以及扩展，后接负载
+func (h *header) marshal(payload []byte) []byte {
+	size := headerSize + len(payload)
+	if h.sack != nil {
+		size += 2 + len(h.sack)
+	}
+	buf := make([]byte, headerSize, size)
+	buf[0] = h.typ<<4 | version
+	if h.sack != nil {
+		buf[1] = extSelectiveAck
+	}
+	binary.BigEndian.PutUint16(buf[2:4], h.connID)
+	binary.BigEndian.PutUint32(buf[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], h.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:16], h.wnd)
+	binary.BigEndian.PutUint16(buf[16:18], h.seq)
+	binary.BigEndian.PutUint16(buf[18:20], h.ack)
+	if h.sack != nil {
+		buf = append(buf, 0, byte(len(h.sack)))
+		buf = append(buf, h.sack...)
+	}
+	return append(buf, payload...)
+}
+
+//解析数据包，不是uTP数据包时返回 errNotUTP，例如共享同一个UDP端口的DHT消息
+func parsePacket(b []byte) (header, []byte, error) {
+	var h header
+	if len(b) < headerSize || b[0]&0x0f != version || b[0]>>4 > stSyn {
+		return h, nil, errNotUTP
+	}
+	h.typ = b[0] >> 4
+	h.connID = binary.BigEndian.Uint16(b[2:4])
+	h.timestamp = binary.BigEndian.Uint32(b[4:8])
+	h.timestampDiff = binary.BigEndian.Uint32(b[8:12])
+	h.wnd = binary.BigEndian.Uint32(b[12:16])
+	h.seq = binary.BigEndian.Uint16(b[16:18])
+	h.ack = binary.BigEndian.Uint16(b[18:20])
+
+	//扩展组成链表，每个扩展的第一个字节为下一个扩展的类型
+	ext := b[1]
+	rest := b[headerSize:]
+	for ext != 0 {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return h, nil, errNotUTP
+		}
+		next, size := rest[0], int(rest[1])
+		if ext == extSelectiveAck {
+			if size == 0 || size%4 != 0 {
+				return h, nil, errNotUTP
+			}
+			h.sack = rest[2 : 2+size]
+		}
+		ext = next
+		rest = rest[2+size:]
+	}
+	return h, rest, nil
+}
+
+//当前时间的微秒数，只用于计算差值
+func nowMicro() uint32 {
+	return uint32(time.Now().UnixNano() / 1000)
+}
+
+//考虑回绕的序号比较，a 是否在 b 之前
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
@@ -0,0 +1,74 @@
+package utp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	tests := []header{
+		{typ: stSyn, connID: 7, timestamp: 1, seq: 1},
+		{typ: stData, connID: 65535, timestamp: 0xFFFFFFFF, timestampDiff: 12345, wnd: 1 << 20, seq: 65535, ack: 0},
+		{typ: stState, connID: 3, seq: 9, ack: 8, sack: []byte{0x05, 0, 0, 0x80}},
+		{typ: stFin, connID: 3, seq: 10, ack: 8, sack: []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+	}
+	for _, h := range tests {
+		payload := []byte("payload")
+		got, rest, err := parsePacket(h.marshal(payload))
+		if err != nil {
+			t.Errorf("parsePacket(%+v): %v", h, err)
+			continue
+		}
+		if got.typ != h.typ || got.connID != h.connID || got.timestamp != h.timestamp || got.timestampDiff != h.timestampDiff ||
+			got.wnd != h.wnd || got.seq != h.seq || got.ack != h.ack || !bytes.Equal(got.sack, h.sack) {
+			t.Errorf("parsePacket = %+v, want %+v", got, h)
+		}
+		if !bytes.Equal(rest, payload) {
+			t.Errorf("payload = %q", rest)
+		}
+	}
+}
+
+func TestParseNotUTP(t *testing.T) {
+	valid := (&header{typ: stData, connID: 1}).marshal(nil)
+	tests := map[string][]byte{
+		"DHT message":     []byte("d1:ad2:id20:xxxxxxxxxxxxxxxxxxxxe1:q4:pinge"),
+		"short":           valid[:headerSize-1],
+		"version 2":       append([]byte{stData<<4 | 2}, valid[1:]...),
+		"unknown type":    append([]byte{5<<4 | version}, valid[1:]...),
+		"truncated ext":   append(append([]byte{valid[0], extSelectiveAck}, valid[2:]...), 0, 8, 1, 2),
+		"sack size 3":     append(append([]byte{valid[0], extSelectiveAck}, valid[2:]...), 0, 3, 1, 2, 3),
+		"missing ext hdr": append([]byte{valid[0], extSelectiveAck}, valid[2:]...),
+	}
+	for name, b := range tests {
+		if _, _, err := parsePacket(b); err != errNotUTP {
+			t.Errorf("%s: error %v, want errNotUTP", name, err)
+		}
+	}
+
+	//未知的扩展被跳过
+	b := append(append([]byte{valid[0], 2}, valid[2:]...), 0, 2, 9, 9, 'x')
+	if _, rest, err := parsePacket(b); err != nil || string(rest) != "x" {
+		t.Errorf("unknown extension: %q, %v", rest, err)
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	tests := []struct {
+		a, b uint16
+		less bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		{65535, 0, true},
+		{0, 65535, false},
+		{65000, 100, true},
+		{100, 65000, false},
+	}
+	for _, tt := range tests {
+		if got := seqLess(tt.a, tt.b); got != tt.less {
+			t.Errorf("seqLess(%d, %d) = %v, want %v", tt.a, tt.b, got, tt.less)
+		}
+	}
+}
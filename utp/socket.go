@@ -0,0 +1,307 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+//共享的UDP端口：uTP数据包交给对应的连接，其余数据报（例如DHT消息）通过 ReadFrom 读取
+
+// AcceptBacklog 等待 Accept 的传入连接数量，超出时重置新的连接
+const AcceptBacklog = 32
+
+//等待 ReadFrom 读取的非uTP数据报数量，超出时丢弃
+const otherBacklog = 64
+
+//连接由对方地址以及对方数据包中的 connection id 确定
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+//非uTP数据报
+type datagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// Socket 在一个UDP端口上收发uTP连接，同时实现 net.Listener 以及供DHT使用的 net.PacketConn
+type Socket struct {
+	pc        net.PacketConn
+	backlog   chan *Conn
+	other     chan datagram
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu           sync.Mutex
+	conns        map[connKey]*Conn
+	readDeadline time.Time
+	deadline     chan struct{} //修改 readDeadline 时关闭，唤醒等待中的 ReadFrom
+}
+
+// Listen 监听UDP地址，例如 ":6881"
+func Listen(network, addr string) (*Socket, error) {
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+// NewSocket 接管已经打开的UDP端口，Close 时一同关闭
+func NewSocket(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:       pc,
+		backlog:  make(chan *Conn, AcceptBacklog),
+		other:    make(chan datagram, otherBacklog),
+		closed:   make(chan struct{}),
+		conns:    make(map[connKey]*Conn),
+		deadline: make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+//读取全部数据报并分发，直到端口关闭
+func (s *Socket) readLoop() {
+	defer s.Close()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		h, payload, err := parsePacket(data)
+		udp, ok := addr.(*net.UDPAddr)
+		if err != nil || !ok {
+			select {
+			case s.other <- datagram{data: data, addr: addr}:
+			default:
+			}
+			continue
+		}
+		s.dispatch(h, payload, udp)
+	}
+}
+
+//将uTP数据包交给对应的连接，SYN 创建新的传入连接
+func (s *Socket) dispatch(h header, payload []byte, addr *net.UDPAddr) {
+	key := connKey{addr: addr.String(), id: h.connID}
+	if h.typ == stSyn {
+		key.id = h.connID + 1
+	}
+	s.mu.Lock()
+	c := s.conns[key]
+	if c == nil && h.typ == stSyn {
+		c = s.accept(h, addr, key)
+	}
+	s.mu.Unlock()
+	if c == nil {
+		if h.typ != stReset {
+			s.reset(h, addr)
+		}
+		return
+	}
+	c.handle(h, payload)
+}
+
+//持有锁时调用，为收到的SYN创建连接，确认由随后的 handle 发送
+func (s *Socket) accept(h header, addr *net.UDPAddr, key connKey) *Conn {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	c := newConn(s, addr, key.id, h.connID)
+	c.state = stateConnected
+	close(c.connected)
+	c.ack = h.seq
+	c.seq = uint16(rand.Intn(1 << 16))
+	select {
+	case s.backlog <- c:
+	default:
+		return nil
+	}
+	s.conns[key] = c
+	go c.loop()
+	return c
+}
+
+//通知对方连接不存在
+func (s *Socket) reset(h header, addr *net.UDPAddr) {
+	r := header{typ: stReset, connID: h.connID, timestamp: nowMicro(), ack: h.seq}
+	s.pc.WriteTo(r.marshal(nil), addr)
+}
+
+//连接关闭后移除
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{addr: c.raddr.String(), id: c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+// Dial 建立到 addr 的uTP连接，ctx 只用于建立连接
+func (s *Socket) Dial(ctx context.Context, addr string) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil, net.ErrClosed
+	default:
+	}
+	//我们的接收id随机选取，发送id为接收id加一
+	var key connKey
+	for {
+		key = connKey{addr: raddr.String(), id: uint16(rand.Intn(1 << 16))}
+		if _, ok := s.conns[key]; !ok {
+			break
+		}
+	}
+	c := newConn(s, raddr, key.id, key.id+1)
+	c.seq = 1
+	s.conns[key] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.queue(stSyn, nil)
+	c.mu.Unlock()
+	go c.loop()
+
+	select {
+	case <-c.connected:
+		return c, nil
+	case <-c.done:
+		c.mu.Lock()
+		err = c.err
+		c.mu.Unlock()
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	c.mu.Lock()
+	c.teardown()
+	c.mu.Unlock()
+	if err == nil {
+		err = net.ErrClosed
+	}
+	return nil, err
+}
+
+// DialContext 实现 downloader.Dialer，network 被忽略，总是使用uTP
+func (s *Socket) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := s.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Accept 等待传入的uTP连接
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.backlog:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Addr 本地UDP地址
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// LocalAddr 与 Addr 相同
+func (s *Socket) LocalAddr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Close 关闭端口以及全部连接
+func (s *Socket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.pc.Close()
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.mu.Lock()
+			c.fail(net.ErrClosed)
+			c.mu.Unlock()
+		}
+	})
+	return err
+}
+
+// ReadFrom 读取一个非uTP数据报
+func (s *Socket) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		s.mu.Lock()
+		deadline, changed := s.readDeadline, s.deadline
+		s.mu.Unlock()
+		var expired <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			expired = timer.C
+		}
+		select {
+		case d := <-s.other:
+			return copy(b, d.data), d.addr, nil
+		case <-s.closed:
+			return 0, nil, net.ErrClosed
+		case <-expired:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-changed:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// WriteTo 发送一个数据报
+func (s *Socket) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return s.pc.WriteTo(b, addr)
+}
+
+// SetDeadline 只影响 ReadFrom，uTP连接使用各自的期限
+func (s *Socket) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+// SetReadDeadline 设置 ReadFrom 的期限
+func (s *Socket) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	close(s.deadline)
+	s.deadline = make(chan struct{})
+	s.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline UDP发送不会阻塞，忽略
+func (s *Socket) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,306 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//按照固定的随机序列丢弃以及延迟发送数据包，延迟的数据包会被之后的数据包超过
+type lossyConn struct {
+	net.PacketConn
+	drop    float64
+	reorder float64
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func (l *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	l.mu.Lock()
+	r := l.rnd.Float64()
+	l.mu.Unlock()
+	switch {
+	case r < l.drop:
+		return len(b), nil
+	case r < l.drop+l.reorder:
+		delayed := append([]byte(nil), b...)
+		time.AfterFunc(10*time.Millisecond, func() { l.PacketConn.WriteTo(delayed, addr) })
+		return len(b), nil
+	}
+	return l.PacketConn.WriteTo(b, addr)
+}
+
+func listenPair(t *testing.T, drop, reorder float64) (*Socket, *Socket) {
+	t.Helper()
+	var sockets [2]*Socket
+	for i := range sockets {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drop > 0 || reorder > 0 {
+			pc = &lossyConn{PacketConn: pc, drop: drop, reorder: reorder, rnd: rand.New(rand.NewSource(int64(i + 1)))}
+		}
+		sockets[i] = NewSocket(pc)
+		t.Cleanup(func() { sockets[i].Close() })
+	}
+	return sockets[0], sockets[1]
+}
+
+//建立连接，返回发起方以及接受方的连接
+func dialPair(t *testing.T, a, b *Socket) (*Conn, *Conn) {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := b.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dialed, err := a.Dial(ctx, b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := <-accepted
+	if c == nil {
+		t.FailNow()
+	}
+	return dialed, c.(*Conn)
+}
+
+//双向同时传输，Close 之后对方读到 io.EOF
+func exchange(t *testing.T, a, b *Conn, size int) {
+	t.Helper()
+	rnd := rand.New(rand.NewSource(int64(size)))
+	up := make([]byte, size)
+	down := make([]byte, size/2)
+	rnd.Read(up)
+	rnd.Read(down)
+	deadline := time.Now().Add(30 * time.Second)
+	a.SetDeadline(deadline)
+	b.SetDeadline(deadline)
+
+	var gotUp []byte
+	var errUp error
+	upDone := make(chan struct{})
+	go func() {
+		defer close(upDone)
+		gotUp, errUp = io.ReadAll(b)
+	}()
+	var errDown error
+	gotDown := make([]byte, len(down))
+	downDone := make(chan struct{})
+	go func() {
+		defer close(downDone)
+		_, errDown = io.ReadFull(a, gotDown)
+	}()
+	if _, err := b.Write(down); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Write(up); err != nil {
+		t.Fatal(err)
+	}
+	//Close 之后的读取返回错误，读完对方的数据之后再关闭
+	<-downDone
+	a.Close()
+	<-upDone
+	if errUp != nil || !bytes.Equal(gotUp, up) {
+		t.Errorf("received %d of %d bytes: %v", len(gotUp), len(up), errUp)
+	}
+	if errDown != nil || !bytes.Equal(gotDown, down) {
+		t.Errorf("received %d of %d bytes in reverse: %v", len(gotDown), len(down), errDown)
+	}
+	b.Close()
+}
+
+func TestLoopback(t *testing.T) {
+	a, b := listenPair(t, 0, 0)
+	dialed, accepted := dialPair(t, a, b)
+	if dialed.RemoteAddr().String() != b.Addr().String() || accepted.RemoteAddr().String() != a.Addr().String() {
+		t.Errorf("addresses %s %s", dialed.RemoteAddr(), accepted.RemoteAddr())
+	}
+	exchange(t, dialed, accepted, 4<<20)
+}
+
+func TestLossyReordering(t *testing.T) {
+	a, b := listenPair(t, 0.05, 0.1)
+	dialed, accepted := dialPair(t, a, b)
+	exchange(t, dialed, accepted, 512<<10)
+}
+
+func TestSeqWraparound(t *testing.T) {
+	a, b := listenPair(t, 0, 0.1)
+	dialed, accepted := dialPair(t, a, b)
+	//连接空闲时把双方的序号移到回绕之前，之后的数据包序号越过 65535
+	for _, pair := range [][2]*Conn{{dialed, accepted}, {accepted, dialed}} {
+		sender, receiver := pair[0], pair[1]
+		sender.mu.Lock()
+		receiver.mu.Lock()
+		if len(sender.unacked) != 0 {
+			t.Fatal("connection is not idle")
+		}
+		sender.seq = 65500
+		receiver.ack = 65499
+		receiver.mu.Unlock()
+		sender.mu.Unlock()
+	}
+	exchange(t, dialed, accepted, 256<<10)
+	dialed.mu.Lock()
+	seq := dialed.seq
+	dialed.mu.Unlock()
+	if seq > 1000 {
+		t.Errorf("sequence number %d did not wrap", seq)
+	}
+}
+
+func TestReadFromOther(t *testing.T) {
+	a, b := listenPair(t, 0, 0)
+	msg := []byte("d1:ad2:id20:xxxxxxxxxxxxxxxxxxxxe1:q4:pinge")
+	if _, err := a.WriteTo(msg, b.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, addr, err := b.ReadFrom(buf)
+	if err != nil || !bytes.Equal(buf[:n], msg) || addr.String() != a.Addr().String() {
+		t.Fatalf("ReadFrom = %q from %v, %v", buf[:n], addr, err)
+	}
+
+	b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := b.ReadFrom(buf); err == nil || !err.(net.Error).Timeout() {
+		t.Fatalf("ReadFrom after deadline = %v", err)
+	}
+}
+
+//通过普通UDP连接发送原始uTP数据包
+type rawPeer struct {
+	t    *testing.T
+	conn net.PacketConn
+	to   net.Addr
+}
+
+func (p *rawPeer) send(h header, payload []byte) {
+	p.t.Helper()
+	if _, err := p.conn.WriteTo(h.marshal(payload), p.to); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *rawPeer) recv() header {
+	p.t.Helper()
+	buf := make([]byte, 2048)
+	p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := p.conn.ReadFrom(buf)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	h, _, err := parsePacket(buf[:n])
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return h
+}
+
+func newRawPeer(t *testing.T, s *Socket) *rawPeer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return &rawPeer{t: t, conn: pc, to: s.Addr()}
+}
+
+func TestDispatchConnIDs(t *testing.T) {
+	_, s := listenPair(t, 0, 0)
+	p := newRawPeer(t, s)
+
+	//SYN 携带发起方的接收id 100，之后发起方发送的数据包使用 101，接收的数据包使用 100
+	p.send(header{typ: stSyn, connID: 100, seq: 1}, nil)
+	st := p.recv()
+	if st.typ != stState || st.connID != 100 || st.ack != 1 {
+		t.Fatalf("SYN reply %+v", st)
+	}
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	//重传的SYN不会创建新的连接
+	p.send(header{typ: stSyn, connID: 100, seq: 1}, nil)
+	if h := p.recv(); h.typ != stState || h.connID != 100 {
+		t.Fatalf("reply to repeated SYN %+v", h)
+	}
+
+	p.send(header{typ: stData, connID: 101, seq: 2, ack: st.seq - 1}, []byte("hello"))
+	if h := p.recv(); h.typ != stState || h.ack != 2 {
+		t.Fatalf("data ack %+v", h)
+	}
+	buf := make([]byte, 10)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+
+	//未知的connection id 收到 RESET
+	p.send(header{typ: stData, connID: 555, seq: 3}, []byte("x"))
+	if h := p.recv(); h.typ != stReset || h.connID != 555 {
+		t.Fatalf("reply to unknown connection %+v", h)
+	}
+
+	//对方重置连接后读取返回错误
+	p.send(header{typ: stReset, connID: 101}, nil)
+	if _, err := c.Read(buf); err != errReset {
+		t.Fatalf("Read after RESET = %v", err)
+	}
+}
+
+func TestAcceptBacklog(t *testing.T) {
+	_, s := listenPair(t, 0, 0)
+	p := newRawPeer(t, s)
+	for i := 0; i <= AcceptBacklog; i++ {
+		id := uint16(1000 + 2*i)
+		p.send(header{typ: stSyn, connID: id, seq: 1}, nil)
+		h := p.recv()
+		want := byte(stState)
+		if i == AcceptBacklog {
+			want = stReset
+		}
+		if h.typ != want || h.connID != id {
+			t.Fatalf("SYN %d: reply type %d id %d, want type %d", i, h.typ, h.connID, want)
+		}
+	}
+
+	//取走一个连接之后可以再接受新的连接
+	if _, err := s.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	p.send(header{typ: stSyn, connID: 5000, seq: 1}, nil)
+	if h := p.recv(); h.typ != stState {
+		t.Fatalf("SYN after Accept: reply type %d", h.typ)
+	}
+}
+
+func TestCloseSocket(t *testing.T) {
+	a, b := listenPair(t, 0, 0)
+	dialed, _ := dialPair(t, a, b)
+	a.Close()
+	if _, err := dialed.Write([]byte("x")); err != net.ErrClosed {
+		t.Errorf("Write after socket Close = %v", err)
+	}
+	if _, err := a.Accept(); err != net.ErrClosed {
+		t.Errorf("Accept after Close = %v", err)
+	}
+	if _, err := a.Dial(context.Background(), b.Addr().String()); err != net.ErrClosed {
+		t.Errorf("Dial after Close = %v", err)
+	}
+}
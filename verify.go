@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+//校验磁盘上已有的数据，输出每个文件以及损坏piece的情况
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	verbose := fs.Bool("v", false, "list every failed piece")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	tof, err := loadTorrent(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	res, err := tof.Verify(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range res.Files {
+		state := "ok"
+		switch {
+		case !f.Exists:
+			state = "missing"
+		case !f.Complete():
+			state = "incomplete"
+		}
+		fmt.Printf("%-10s %d/%d pieces  %s\n", state, f.Verified, f.Pieces, f.Path)
+	}
+	if *verbose {
+		for _, index := range res.Bad {
+			fmt.Printf("piece #%d failed\n", index)
+		}
+	}
+	total := len(tof.PieceHashes)
+	fmt.Printf("%d of %d pieces verified (%0.2f%%)\n", res.Verified, total, float64(res.Verified)/float64(total)*100)
+	return nil
+}